@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	configmodule "login-monitor/config"
+	emailmodule "login-monitor/email"
+	"login-monitor/notify"
+	"login-monitor/pgp"
+	"login-monitor/spool"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSpoolRetries    = 2
+	defaultSpoolRetryDelay = time.Second
+)
+
+// channelName returns the name of the channel. If the channel has no name, its strategy is used
+func channelName(channel configmodule.ChannelConfig) string {
+	return stringDefault(channel.Name, channel.Strategy)
+}
+
+// findChannel returns the channel with the given name (see channelName)
+func findChannel(channels []configmodule.ChannelConfig, name string) (configmodule.ChannelConfig, bool) {
+	for _, channel := range channels {
+		if channelName(channel) == name {
+			return channel, true
+		}
+	}
+	return configmodule.ChannelConfig{}, false
+}
+
+// openSpool opens the spool for emails. If the spool is disabled or can't be opened, nil is returned
+func openSpool(spoolConfig configmodule.SpoolConfig) *spool.Spool {
+	if spoolConfig.Disabled {
+		return nil
+	}
+
+	dir := stringDefault(spoolConfig.Dir, spool.DefaultDir)
+	emailSpool, err := spool.New(dir)
+	if err != nil {
+		log.Warnf("Couldn't open spool, emails will be lost if they can't be sent. %s", err)
+		return nil
+	}
+	return emailSpool
+}
+
+// newPGPBackend creates the OpenPGP backend given in the config
+func newPGPBackend(pgpConfig configmodule.PGPConfig) (pgp.Backend, error) {
+	lookup, err := newKeyLookup(pgpConfig.KeyLookup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pgpConfig.Backend {
+	case "", "gpg":
+		return (&pgp.GPGBackend{}).SetKeyLookup(lookup), nil
+	case "native":
+		backend, err := pgp.NewNativeBackend(pgpConfig.PublicKeys, pgpConfig.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		return backend.SetKeyLookup(lookup), nil
+	default:
+		return nil, fmt.Errorf("invalid pgp backend '%s'", pgpConfig.Backend)
+	}
+}
+
+// newKeyLookup creates the key lookup given in the config. If no lookup method is configured, nil is returned
+func newKeyLookup(lookupConfig configmodule.KeyLookupConfig) (*pgp.KeyLookup, error) {
+	if !lookupConfig.WKD && lookupConfig.Keyserver == "" {
+		return nil, nil
+	}
+
+	ttl, err := parseDurationDefault(lookupConfig.CacheTTL, pgp.DefaultKeyCacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key cache TTL '%s'. %w", lookupConfig.CacheTTL, err)
+	}
+	timeout, err := parseDurationDefault(lookupConfig.Timeout, pgp.DefaultKeyLookupTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key lookup timeout '%s'. %w", lookupConfig.Timeout, err)
+	}
+
+	cacheFile := stringDefault(lookupConfig.CacheFile, pgp.DefaultKeyCacheFile)
+	return pgp.NewKeyLookup(lookupConfig.WKD, lookupConfig.Keyserver, cacheFile, ttl, timeout), nil
+}
+
+// parseDurationDefault parses the duration. If it is empty, def is returned
+func parseDurationDefault(duration string, def time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return def, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+// newNotifier creates and initiates the notifier for the given channel.
+// Email notifiers send the email returned by newEmail. If emailSpool is not nil, emails are spooled until they're sent
+func newNotifier(
+	channel configmodule.ChannelConfig,
+	newEmail func() *emailmodule.Email,
+	emailSpool *spool.Spool,
+	spoolConfig configmodule.SpoolConfig,
+) (notify.Notifier, error) {
+	var notifier notify.Notifier
+	var params []interface{}
+
+	switch strings.TrimSpace(strings.ToLower(channel.Strategy)) {
+	case "go-smtp", "gmail-oauth2", "gmail-service-account":
+		strategy, strategyParams, err := newEmailStrategy(channel)
+		if err != nil {
+			return nil, err
+		}
+
+		if emailSpool != nil {
+			retries := defaultSpoolRetries
+			if spoolConfig.Retries != nil {
+				retries = *spoolConfig.Retries
+			}
+			retryDelay := defaultSpoolRetryDelay
+			if spoolConfig.RetryDelay != "" {
+				if retryDelay, err = time.ParseDuration(spoolConfig.RetryDelay); err != nil {
+					return nil, fmt.Errorf("invalid spool retry delay '%s'. %w", spoolConfig.RetryDelay, err)
+				}
+			}
+			strategy = emailmodule.NewSpoolStrategy(strategy, emailSpool, channelName(channel), retries, retryDelay)
+		}
+
+		notifier, params = notify.NewEmailNotifier(newEmail().SetStrategy(strategy)), strategyParams
+	case "webhook":
+		hookConfig := configmodule.WebhookConfig{}
+		if err := readJSONConfig(channel.Config, &hookConfig); err != nil {
+			return nil, err
+		}
+		notifier, params = &notify.WebhookNotifier{}, []interface{}{&hookConfig}
+	case "file":
+		notifier, params = &notify.FileNotifier{}, []interface{}{channel.Path}
+	default:
+		return nil, fmt.Errorf("%s is not recognized as a valid strategy", channel.Strategy)
+	}
+
+	if _, err := notifier.Init(params...); err != nil {
+		return nil, fmt.Errorf("error while initiating %s strategy. %w", channel.Strategy, err)
+	}
+	return notifier, nil
+}
+
+// newEmailStrategy creates the email strategy for the given channel.
+// The returned params must be given to EmailStrategy.Init (or Email.InitStrategy)
+func newEmailStrategy(channel configmodule.ChannelConfig) (emailmodule.EmailStrategy, []interface{}, error) {
+	switch strings.TrimSpace(strings.ToLower(channel.Strategy)) {
+	case "go-smtp":
+		smtpConfig := configmodule.GoSMTPConfig{}
+		if err := readJSONConfig(channel.Config, &smtpConfig); err != nil {
+			return nil, nil, err
+		}
+
+		smtpConfig.Host = stringDefault(smtpConfig.Host, "127.0.0.1")
+		smtpConfig.Port = stringDefault(smtpConfig.Port, "25")
+		return &emailmodule.GoSMTPStrategy{}, []interface{}{&smtpConfig}, nil
+	case "gmail-oauth2":
+		return &emailmodule.GmailOAuth2Strategy{}, []interface{}{channel.Config, channel.Token}, nil
+	case "gmail-service-account":
+		return &emailmodule.GmailServiceAccountStrategy{}, []interface{}{channel.Config, channel.Impersonate}, nil
+	default:
+		return nil, nil, fmt.Errorf("%s is not recognized as a valid email strategy", channel.Strategy)
+	}
+}
+
+// readJSONConfig decodes the JSON file at path into v
+func readJSONConfig(path string, v interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err = json.NewDecoder(file).Decode(v); err != nil {
+		return fmt.Errorf("error while parsing JSON config %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package config
+
+// ChannelConfig configuration for a notification channel
+type ChannelConfig struct {
+	Name     string `json:"name"`     // name of the channel, used only for logging. Defaults to Strategy
+	Strategy string `json:"strategy"` // gmail-oauth2, gmail-service-account, go-smtp, webhook or file
+	Required bool   `json:"required"` // if true and the channel fails, the program exits with a non-zero status
+	Config   string `json:"config"`   // config file for go-smtp and webhook, credentials file for gmail-oauth2 and gmail-service-account
+	Token    string `json:"token"`    // token file for gmail-oauth2
+	Path     string `json:"path"`     // log file for file
+
+	// Impersonate user impersonated by gmail-service-account (domain-wide delegation). Defaults to the sender
+	Impersonate string `json:"impersonate"`
+}
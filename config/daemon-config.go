@@ -0,0 +1,9 @@
+package config
+
+// DaemonConfig configuration for the daemon mode
+type DaemonConfig struct {
+	Enabled       bool   `json:"enabled"`       // if true, login events are handed to the daemon instead of being handled by the PAM-invoked process
+	Socket        string `json:"socket"`        // unix socket the daemon listens on. Defaults to /run/login-monitor/login-monitor.sock
+	Timeout       string `json:"timeout"`       // timeout for handing a login event to the daemon, e.g. 2s
+	FlushInterval string `json:"flushInterval"` // interval at which the daemon flushes the spool, e.g. 1m
+}
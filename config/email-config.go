@@ -1,8 +1,26 @@
 package config
 
+// Encryption policies for an Entity
+const (
+	EncryptionPrefer  = "prefer"  // the entity receives an encrypted copy if its public key is known, a plain one otherwise
+	EncryptionRequire = "require" // the entity receives an encrypted copy if its public key is known, nothing otherwise
+	EncryptionNever   = "never"   // the entity always receives a plain copy
+)
+
+// Schemes used to encrypt and sign emails for an Entity
+const (
+	SchemePGP   = "pgp"   // PGP/MIME (RFC 3156)
+	SchemeSMIME = "smime" // S/MIME (RFC 8551)
+)
+
 type Entity struct {
-	Email    string `json:"email"`    // email, e.g. sysadmin@example.com
-	PGPKeyId string `json:"pgpKeyId"` // PGP key id, e.g. 0x7ADE4B572836C909 (it can be the email too, but just in some cases)
+	Email      string `json:"email"`      // email, e.g. sysadmin@example.com
+	PGPKeyId   string `json:"pgpKeyId"`   // PGP key id, e.g. 0x7ADE4B572836C909 (it can be the email too, but just in some cases)
+	Encryption string `json:"encryption"` // encryption policy: prefer (default), require or never
+	Scheme     string `json:"scheme"`     // scheme used to encrypt (and sign) emails: pgp (default) or smime
+
+	Certificate string `json:"certificate"` // path to the PEM-encoded X.509 certificate (S/MIME)
+	PrivateKey  string `json:"privateKey"`  // path to the PEM-encoded (unencrypted) private key of the certificate (S/MIME, sender only)
 }
 
 // NewEntity creates a new entity with Entity.PGPKeyId and Entity.Email equal to the given email
@@ -20,9 +38,94 @@ type EmailConfig struct {
 	FakeSender     string   `json:"fakeSender"`
 	Recipient      Entity   `json:"recipient"`
 	Cc             []Entity `json:"cc"`
+	Bcc            []Entity `json:"bcc"` // recipients that are not in the headers (blind carbon copy)
 	Subject        string   `json:"subject"`
 	TextMessage    string   `json:"textMessage"`
 	HTMLMessage    string   `json:"htmlMessage"`
 	Attachments    []string `json:"attachments"`
 	SenderPassFile string   `json:"senderPassFile"` // path to the sender's private key passphrase (required if the message is signed)
+
+	// Events overrides the configuration for specific PAM event types (PAM_TYPE), e.g. open_session, close_session,
+	// auth, account or password. Event types not in the map use the configuration as is
+	Events map[string]EventConfig `json:"events"`
+
+	Rules RulesConfig `json:"rules"` // rules deciding whether a login should trigger an alert
+
+	// Severities overrides the configuration for specific severities (info, warning or critical) assigned by the rules.
+	// Severities not in the map use the configuration as is
+	Severities map[string]SeverityConfig `json:"severities"`
+
+	// Channels the notification is sent through. If empty, the strategy given in the command line is used
+	Channels []ChannelConfig `json:"channels"`
+
+	Spool SpoolConfig `json:"spool"` // spool where emails are kept until they are delivered
+
+	Daemon DaemonConfig `json:"daemon"` // daemon mode
+
+	PGP PGPConfig `json:"pgp"` // OpenPGP implementation used to encrypt and sign emails
+}
+
+// EventConfig configuration for a specific PAM event type
+type EventConfig struct {
+	Skip        bool   `json:"skip"`        // if true, no email is sent for the event type
+	Subject     string `json:"subject"`     // overrides EmailConfig.Subject (if not empty)
+	TextMessage string `json:"textMessage"` // overrides EmailConfig.TextMessage (if not empty)
+	HTMLMessage string `json:"htmlMessage"` // overrides EmailConfig.HTMLMessage (if not empty)
+}
+
+// SeverityConfig configuration for a specific severity
+type SeverityConfig struct {
+	Recipient     Entity   `json:"recipient"`     // overrides EmailConfig.Recipient (if email is not empty)
+	Cc            []Entity `json:"cc"`            // overrides EmailConfig.Cc (if not nil)
+	SubjectPrefix string   `json:"subjectPrefix"` // prefix added to the subject, e.g. [CRITICAL]
+	TextMessage   string   `json:"textMessage"`   // overrides EmailConfig.TextMessage (if not empty)
+	HTMLMessage   string   `json:"htmlMessage"`   // overrides EmailConfig.HTMLMessage (if not empty)
+}
+
+// ForEvent returns a copy of c with the overrides for the given PAM event type applied.
+// The returned bool tells whether an email should be sent for the event type
+func (c EmailConfig) ForEvent(eventType string) (EmailConfig, bool) {
+	eventConfig, ok := c.Events[eventType]
+	if !ok {
+		return c, true
+	}
+	if eventConfig.Skip {
+		return c, false
+	}
+
+	if eventConfig.Subject != "" {
+		c.Subject = eventConfig.Subject
+	}
+	if eventConfig.TextMessage != "" {
+		c.TextMessage = eventConfig.TextMessage
+	}
+	if eventConfig.HTMLMessage != "" {
+		c.HTMLMessage = eventConfig.HTMLMessage
+	}
+	return c, true
+}
+
+// ForSeverity returns a copy of c with the overrides for the given severity applied
+func (c EmailConfig) ForSeverity(severity string) EmailConfig {
+	severityConfig, ok := c.Severities[severity]
+	if !ok {
+		return c
+	}
+
+	if severityConfig.Recipient.Email != "" {
+		c.Recipient = severityConfig.Recipient
+	}
+	if severityConfig.Cc != nil {
+		c.Cc = severityConfig.Cc
+	}
+	if severityConfig.SubjectPrefix != "" {
+		c.Subject = severityConfig.SubjectPrefix + " " + c.Subject
+	}
+	if severityConfig.TextMessage != "" {
+		c.TextMessage = severityConfig.TextMessage
+	}
+	if severityConfig.HTMLMessage != "" {
+		c.HTMLMessage = severityConfig.HTMLMessage
+	}
+	return c
 }
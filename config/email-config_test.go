@@ -0,0 +1,77 @@
+package config
+
+import "testing"
+
+func TestForEvent(t *testing.T) {
+	config := EmailConfig{
+		Subject:     "New login on %h",
+		TextMessage: "login.txt",
+		HTMLMessage: "login.html",
+		Events: map[string]EventConfig{
+			"close_session": {Subject: "Logout from %h", TextMessage: "logout.txt"},
+			"auth":          {Skip: true},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		eventType   string
+		wantSend    bool
+		wantSubject string
+		wantText    string
+		wantHTML    string
+	}{
+		{"Testing event without overrides", "open_session", true, "New login on %h", "login.txt", "login.html"},
+		{"Testing event with overrides", "close_session", true, "Logout from %h", "logout.txt", "login.html"},
+		{"Testing skipped event", "auth", false, "New login on %h", "login.txt", "login.html"},
+		{"Testing empty event type", "", true, "New login on %h", "login.txt", "login.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, send := config.ForEvent(tt.eventType)
+			if send != tt.wantSend {
+				t.Errorf("ForEvent() send = %v, want %v", send, tt.wantSend)
+			}
+			if got.Subject != tt.wantSubject || got.TextMessage != tt.wantText || got.HTMLMessage != tt.wantHTML {
+				t.Errorf("ForEvent() = %+v", got)
+			}
+		})
+	}
+
+	if config.Subject != "New login on %h" {
+		t.Error("ForEvent() must not modify the original config")
+	}
+}
+
+func TestForSeverity(t *testing.T) {
+	config := EmailConfig{
+		Recipient: NewEntity("audit@example.com"),
+		Cc:        []Entity{NewEntity("sysadmin@example.com")},
+		Subject:   "New login on %h",
+		Severities: map[string]SeverityConfig{
+			"critical": {
+				Recipient:     NewEntity("oncall@example.com"),
+				Cc:            []Entity{},
+				SubjectPrefix: "[CRITICAL]",
+				TextMessage:   "critical.txt",
+			},
+			"warning": {SubjectPrefix: "[WARNING]"},
+		},
+	}
+
+	got := config.ForSeverity("critical")
+	if got.Recipient.Email != "oncall@example.com" || len(got.Cc) != 0 ||
+		got.Subject != "[CRITICAL] New login on %h" || got.TextMessage != "critical.txt" {
+		t.Errorf("ForSeverity(critical) = %+v", got)
+	}
+
+	got = config.ForSeverity("warning")
+	if got.Recipient.Email != "audit@example.com" || len(got.Cc) != 1 || got.Subject != "[WARNING] New login on %h" {
+		t.Errorf("ForSeverity(warning) = %+v", got)
+	}
+
+	got = config.ForSeverity("info")
+	if got.Recipient.Email != "audit@example.com" || got.Subject != "New login on %h" {
+		t.Errorf("ForSeverity(info) = %+v", got)
+	}
+}
@@ -1,9 +1,62 @@
 package config
 
 type GoSMTPConfig struct {
-	Identity string `json:"identity"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
-	Port     string `json:"port"`
+	// Delivery relay (default) to submit emails to Host:Port or Relays, or mx to deliver them directly to the MX hosts
+	// of the recipients' domains (Port is the port of the MX hosts)
+	Delivery string `json:"delivery"`
+
+	Identity string      `json:"identity"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Host     string      `json:"host"`
+	Port     string      `json:"port"`
+	TLS      TLSConfig   `json:"tls"`  // TLS used to connect to the SMTP server
+	DKIM     *DKIMConfig `json:"dkim"` // if not nil, messages are DKIM-signed before being sent
+
+	// Relays SMTP servers tried in order until one accepts the message. If empty, Host and Port are the only relay
+	Relays         []RelayConfig `json:"relays"`
+	ConnectTimeout string        `json:"connectTimeout"` // default connect timeout of the relays, e.g. 5s. Defaults to 10s
+	CommandTimeout string        `json:"commandTimeout"` // default timeout of each SMTP command, e.g. 30s. Defaults to 20s
+
+	// HeloName name the client sends in EHLO/HELO, e.g. mail.example.com. Defaults to the hostname
+	HeloName string `json:"heloName"`
+
+	// AuthMechanisms SMTP AUTH mechanisms (PLAIN, LOGIN, CRAM-MD5 or XOAUTH2) in order of preference.
+	// The first one supported by the server is used. Defaults to XOAUTH2 if OAuth2 is given, CRAM-MD5, PLAIN and LOGIN otherwise
+	AuthMechanisms []string      `json:"authMechanisms"`
+	OAuth2         *OAuth2Config `json:"oauth2"` // OAuth 2 credentials for XOAUTH2 (Username is the email)
+}
+
+// RelayConfig SMTP server the message can be submitted to
+type RelayConfig struct {
+	Host           string     `json:"host"`
+	Port           string     `json:"port"`           // defaults to 25
+	TLS            *TLSConfig `json:"tls"`            // overrides GoSMTPConfig.TLS (if not nil)
+	ConnectTimeout string     `json:"connectTimeout"` // overrides GoSMTPConfig.ConnectTimeout (if not empty)
+	CommandTimeout string     `json:"commandTimeout"` // overrides GoSMTPConfig.CommandTimeout (if not empty)
+}
+
+// OAuth2Config OAuth 2 client config and token
+type OAuth2Config struct {
+	CredentialsFile string `json:"credentialsFile"` // client config (client id, client secret, token uri...) in the format of Google's credentials files
+	TokenFile       string `json:"tokenFile"`       // token (access token, refresh token...)
+}
+
+// TLSConfig TLS configuration for the connection to the SMTP server
+type TLSConfig struct {
+	// Mode none, starttls (use STARTTLS if the server supports it), starttls-required (fail if the server doesn't
+	// support STARTTLS) or tls (implicit TLS, e.g. port 465). Defaults to tls for port 465 and starttls otherwise
+	Mode       string `json:"mode"`
+	CAFile     string `json:"caFile"`     // PEM-encoded CA bundle to verify the server's certificate. If empty, the system's CAs
+	CertFile   string `json:"certFile"`   // PEM-encoded client certificate (optional)
+	KeyFile    string `json:"keyFile"`    // PEM-encoded private key of the client certificate
+	ServerName string `json:"serverName"` // name to verify the server's certificate against. Defaults to the host
+}
+
+// DKIMConfig configuration for DKIM signing (RFC 6376)
+type DKIMConfig struct {
+	Domain     string   `json:"domain"`     // signing domain (d= tag), e.g. example.com. It should be the domain of the From header
+	Selector   string   `json:"selector"`   // selector (s= tag). The public key is published at <selector>._domainkey.<domain>
+	PrivateKey string   `json:"privateKey"` // path to the PEM-encoded RSA or Ed25519 private key
+	Headers    []string `json:"headers"`    // signed header fields. If empty, email.DefaultDKIMHeaders
 }
@@ -0,0 +1,36 @@
+package config
+
+// PGPConfig configuration for the OpenPGP implementation used to encrypt and sign emails
+type PGPConfig struct {
+	// Backend OpenPGP implementation: "gpg" (executes the gpg binary and uses its keyring) or "native" (pure Go
+	// implementation using the key files below). Defaults to gpg
+	Backend string `json:"backend"`
+
+	// Mode decides whether emails are encrypted and/or signed: "encrypt" (encrypt and sign if any recipient's public key
+	// is known, otherwise send plain), "encrypt-or-sign" (like encrypt, but sign if no recipient's public key is known),
+	// "sign" (sign but never encrypt) or "none". Defaults to encrypt
+	Mode string `json:"mode"`
+
+	// ProtectedSubject subject in the (unencrypted) headers of encrypted emails, the real subject is encrypted.
+	// Placeholders are replaced. Defaults to ...
+	ProtectedSubject string `json:"protectedSubject"`
+
+	PublicKeys []string `json:"publicKeys"` // paths to armored public key files (recipients' keys). Only used by the native backend
+	SigningKey string   `json:"signingKey"` // path to the armored private key file of the sender. Only used by the native backend
+
+	// ExpiryWarningDays a warning notification is sent if any key expires within this number of days (see the
+	// check-keys command). Defaults to 14
+	ExpiryWarningDays *int `json:"expiryWarningDays"`
+
+	// KeyLookup retrieval of recipients' public keys through WKD and/or an HKP keyserver
+	KeyLookup KeyLookupConfig `json:"keyLookup"`
+}
+
+// KeyLookupConfig configuration for the retrieval of public keys
+type KeyLookupConfig struct {
+	WKD       bool   `json:"wkd"`       // if true, keys are looked up through Web Key Directory
+	Keyserver string `json:"keyserver"` // HKP keyserver URL, e.g. https://keys.openpgp.org. Empty if no keyserver is used
+	CacheFile string `json:"cacheFile"` // file where retrieved keys are cached. Defaults to /var/cache/login-monitor/keys.json
+	CacheTTL  string `json:"cacheTTL"`  // time retrieved keys are cached, e.g. 12h. Defaults to 24h
+	Timeout   string `json:"timeout"`   // timeout for each request, e.g. 5s. Defaults to 10s
+}
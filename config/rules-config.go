@@ -0,0 +1,27 @@
+package config
+
+// RulesConfig configuration for the rules deciding whether a login should trigger an alert
+type RulesConfig struct {
+	Default         string       `json:"default"`         // action to take if no rule matches: "alert" (default) or "ignore"
+	DefaultSeverity string       `json:"defaultSeverity"` // severity if no rule matches or the matching rule has no severity: "info" (default), "warning" or "critical"
+	Rules           []RuleConfig `json:"rules"`           // rules are evaluated in order, the first matching rule decides the action
+}
+
+// RuleConfig a single rule. A rule matches a login if ALL its non-empty criteria match.
+// A criterion (list) matches if ANY of its items matches. Items prefixed with ! are negated,
+// i.e. the criterion doesn't match if a negated item matches.
+//
+// Items in Users, Groups, Services and TTYs can be glob patterns (see path.Match)
+type RuleConfig struct {
+	Name     string   `json:"name"`     // name of the rule, used only for logging
+	Action   string   `json:"action"`   // "alert" or "ignore"
+	Severity string   `json:"severity"` // severity of the login: "info", "warning" or "critical". Defaults to RulesConfig.DefaultSeverity
+	Users    []string `json:"users"`    // users (PAM_USER), e.g. root, ci-*
+	Groups   []string `json:"groups"`   // groups (names or ids) the user belongs to, e.g. wheel
+	Hosts    []string `json:"hosts"`    // remote hosts (PAM_RHOST) as CIDRs, IPs or hostnames (*.example.com is allowed)
+	Services []string `json:"services"` // PAM services (PAM_SERVICE), e.g. sshd
+	TTYs     []string `json:"ttys"`     // ttys (PAM_TTY), e.g. /dev/pts/*
+	From     string   `json:"from"`     // start of the time-of-day window in 24-hour format, e.g. 09:00
+	To       string   `json:"to"`       // end of the time-of-day window in 24-hour format, e.g. 18:00. It can be less than From (e.g. 22:00 - 06:00)
+	Weekdays []string `json:"weekdays"` // days of the week, e.g. monday, tue
+}
@@ -0,0 +1,9 @@
+package config
+
+// SpoolConfig configuration for the spool where emails are kept until they are delivered
+type SpoolConfig struct {
+	Disabled   bool   `json:"disabled"`   // if true, emails are not spooled (i.e. they are lost if they can't be sent)
+	Dir        string `json:"dir"`        // spool directory. Defaults to /var/spool/login-monitor
+	Retries    *int   `json:"retries"`    // number of times sending is retried before leaving the email in the spool. Defaults to 2
+	RetryDelay string `json:"retryDelay"` // delay before the first retry (doubled for each retry), e.g. 1s
+}
@@ -0,0 +1,9 @@
+package config
+
+type WebhookConfig struct {
+	URL        string            `json:"url"`        // URL the notification is POSTed to
+	Headers    map[string]string `json:"headers"`    // additional headers, e.g. Authorization
+	Secret     string            `json:"secret"`     // secret used to sign the body with HMAC-SHA256
+	SecretFile string            `json:"secretFile"` // file containing the secret (used if Secret is empty)
+	Timeout    string            `json:"timeout"`    // request timeout, e.g. 10s
+}
@@ -0,0 +1,192 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"login-monitor/pam"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultSocket default path for the daemon socket
+const DefaultSocket = "/run/login-monitor/login-monitor.sock"
+
+// DefaultTimeout default timeout for handing an event to the daemon
+const DefaultTimeout = 2 * time.Second
+
+// ack response sent by the server once the event has been received
+const ack = "ok"
+
+// Handler handles a login event received by the server
+type Handler func(event *pam.LoginEvent) error
+
+// Server receives login events on a unix socket and handles them in the background.
+//
+// The protocol is simple: the client sends a login event as a single JSON line and the server responds with "ok"
+// as soon as the event is received (i.e. the client doesn't wait for the event to be handled)
+type Server struct {
+	socketPath string
+	handle     Handler
+	listener   net.Listener
+
+	wg      sync.WaitGroup // in-flight connections
+	closing chan struct{}
+}
+
+// NewServer creates a new Server listening on the given socket path
+func NewServer(socketPath string, handle Handler) *Server {
+	return &Server{
+		socketPath: socketPath,
+		handle:     handle,
+		closing:    make(chan struct{}),
+	}
+}
+
+// Listen creates the socket. Only the owner of the process (root) can connect to it.
+// A stale socket (e.g. left by a daemon that crashed) is removed.
+// If the socket directory already exists, it must be owned by the owner of the process and not writable by others
+func (s *Server) Listen() error {
+	dir := filepath.Dir(s.socketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("couldn't create socket directory: %w", err)
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return err
+	}
+	if err := os.Remove(s.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("couldn't remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(s.socketPath, 0600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("couldn't set socket permissions: %w", err)
+	}
+	s.listener = listener
+	return nil
+}
+
+// checkSocketDir checks that dir is a directory (not a symlink) owned by the owner of the process and that group and
+// others can't write to it. Otherwise, other users could replace the socket and receive the login events
+func checkSocketDir(dir string) error {
+	stat, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("couldn't stat socket directory: %w", err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok && int(sys.Uid) != os.Geteuid() {
+		return fmt.Errorf("socket directory %s is owned by uid %d, expected %d", dir, sys.Uid, os.Geteuid())
+	}
+	if perm := stat.Mode().Perm(); perm&0022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by group or others (permissions %o)", dir, perm)
+	}
+	return nil
+}
+
+// Serve accepts connections until Close is called. Listen must be called before
+func (s *Server) Serve() error {
+	if s.listener == nil {
+		return errors.New("server is not listening")
+	}
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closing:
+				return nil
+			default:
+				return err
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections and waits for the in-flight events to be handled
+func (s *Server) Close() error {
+	close(s.closing)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// serveConn reads the login event, acknowledges it and then handles it
+func (s *Server) serveConn(conn net.Conn) {
+	event, err := s.receive(conn)
+	_ = conn.Close()
+	if err != nil {
+		log.Warnf("Couldn't receive login event from socket. %s", err)
+		return
+	}
+
+	if err = s.handle(event); err != nil {
+		log.Errorf("Error while handling login event. %s", err)
+	}
+}
+
+func (s *Server) receive(conn net.Conn) (*pam.LoginEvent, error) {
+	_ = conn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	event := &pam.LoginEvent{}
+	if err = json.Unmarshal(line, event); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write([]byte(ack + "\n")); err != nil {
+		return nil, fmt.Errorf("couldn't acknowledge login event: %w", err)
+	}
+	return event, nil
+}
+
+// Send hands the login event to the daemon listening on socketPath.
+// It returns as soon as the daemon acknowledges the event, without waiting for it to be handled
+func Send(socketPath string, event *pam.LoginEvent, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to daemon: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("couldn't send login event to daemon: %w", err)
+	}
+
+	res, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("daemon didn't acknowledge login event: %w", err)
+	}
+	if strings.TrimSpace(res) != ack {
+		return fmt.Errorf("unexpected response from daemon: %s", res)
+	}
+	return nil
+}
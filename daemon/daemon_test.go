@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"login-monitor/pam"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendAndServe(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "run", "login-monitor.sock")
+
+	received := make(chan *pam.LoginEvent, 1)
+	server := NewServer(socketPath, func(event *pam.LoginEvent) error {
+		time.Sleep(100 * time.Millisecond) // handling an event (e.g. sending an email) is slow
+		received <- event
+		return nil
+	})
+	if err := server.Listen(); err != nil {
+		t.Fatal("Couldn't listen", err)
+	}
+	go func() {
+		if err := server.Serve(); err != nil {
+			t.Error("Serve() returned an error", err)
+		}
+	}()
+
+	stat, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal("Socket was not created", err)
+	}
+	if perm := stat.Mode().Perm(); perm != 0600 {
+		t.Errorf("Socket permissions should be 0600, got %o", perm)
+	}
+
+	start := time.Now()
+	event := &pam.LoginEvent{User: "root", RemoteHost: "192.168.1.10", Type: pam.OpenSession}
+	if err := Send(socketPath, event, time.Second); err != nil {
+		t.Fatal("Couldn't send event", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("Send() should not wait for the event to be handled, it took %s", elapsed)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Error("Couldn't close server", err)
+	}
+	select {
+	case got := <-received:
+		if got.User != "root" || got.RemoteHost != "192.168.1.10" || got.Type != pam.OpenSession {
+			t.Errorf("Event was not received correctly. Got %+v", got)
+		}
+	default:
+		t.Error("Close() should wait for in-flight events to be handled")
+	}
+}
+
+func TestSendNoDaemon(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "login-monitor.sock")
+	if err := Send(socketPath, &pam.LoginEvent{}, 100*time.Millisecond); err == nil {
+		t.Error("Send() should return an error if the daemon is not running")
+	}
+}
+
+func TestListenSocketDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(dir string) error // creates the socket directory
+		err   bool
+	}{
+		{"Testing new directory", func(string) error { return nil }, false},
+		{
+			"Testing existing directory",
+			func(dir string) error { return os.Mkdir(dir, 0755) },
+			false,
+		},
+		{
+			"Testing world-writable directory",
+			func(dir string) error {
+				if err := os.Mkdir(dir, 0700); err != nil {
+					return err
+				}
+				return os.Chmod(dir, 0777) // Mkdir applies the umask
+			},
+			true,
+		},
+		{
+			"Testing symlink",
+			func(dir string) error {
+				target := dir + "-target"
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+				return os.Symlink(target, dir)
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "run")
+			if err := tt.setup(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			server := NewServer(filepath.Join(dir, "login-monitor.sock"), func(*pam.LoginEvent) error { return nil })
+			err := server.Listen()
+			if (err != nil) != tt.err {
+				t.Fatalf("Listen() error = %v, want error %t", err, tt.err)
+			}
+			if err == nil {
+				_ = server.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-msgauth/dkim"
+	"login-monitor/config"
+	"os"
+	"strings"
+)
+
+// DefaultDKIMHeaders header fields signed by DKIMSigner if none are configured.
+// Fields not present in the message are signed too, so they can't be added afterwards
+var DefaultDKIMHeaders = []string{"From", "To", "Cc", "Subject", "Date", "Message-ID", "Content-Type"}
+
+// DKIMSigner signs payloads with DKIM (RFC 6376) using relaxed canonicalization
+type DKIMSigner struct {
+	options dkim.SignOptions
+}
+
+// NewDKIMSigner creates a new DKIMSigner from the given config.
+// The private key can be an RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) key
+func NewDKIMSigner(c *config.DKIMConfig) (*DKIMSigner, error) {
+	if c.Domain == "" || c.Selector == "" {
+		return nil, errors.New("DKIM domain and selector can't be empty")
+	}
+
+	key, err := readDKIMKey(c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	hasFrom := false
+	for _, header := range headers {
+		hasFrom = hasFrom || strings.EqualFold(header, "From")
+	}
+	if !hasFrom {
+		return nil, errors.New("DKIM signed headers must include From")
+	}
+
+	return &DKIMSigner{options: dkim.SignOptions{
+		Domain:                 c.Domain,
+		Selector:               c.Selector,
+		Signer:                 key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             headers,
+	}}, nil
+}
+
+// Sign returns the payload with a DKIM-Signature header prepended
+func (s *DKIMSigner) Sign(payload []byte) ([]byte, error) {
+	signed := bytes.Buffer{}
+	if err := dkim.Sign(&signed, bytes.NewReader(payload), &s.options); err != nil {
+		return nil, fmt.Errorf("error while DKIM-signing email. %w", err)
+	}
+	return signed.Bytes(), nil
+}
+
+// readDKIMKey reads the PEM-encoded private key in the given file
+func readDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading DKIM private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s doesn't contain a PEM-encoded private key", path)
+	}
+
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DKIM private key %s: %w", path, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("DKIM private key %s is not an RSA or Ed25519 key", path)
+	}
+}
@@ -0,0 +1,198 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/emersion/go-msgauth/dkim"
+	"login-monitor/config"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDKIMKey writes the private key (PKCS #8) to dir and returns its path and the DNS TXT record of its public key
+func writeDKIMKey(t *testing.T, dir string, key interface{}) (string, string) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dkim.key")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		return path, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+	case ed25519.PrivateKey:
+		return path, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	}
+	return path, ""
+}
+
+func TestDKIMSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := NewEmail(nil).
+		SetFakeSender("alerts@example.com").
+		SetRecipient(config.NewEntity("benja@kobd.io")).
+		SetCc([]config.Entity{config.NewEntity("sysadmin@benjaminguzman.dev")}).
+		SetSubject("Testing DKIM").
+		SetTextMessage("Testing DKIM").
+		CreatePayload()
+	if err != nil {
+		t.Fatal("Couldn't create payload", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     interface{}
+		headers []string
+		signed  string // expected h= tag
+	}{
+		{"Testing RSA key", rsaKey, nil, "h=From:To:Cc:Subject:Date:Message-ID:Content-Type;"},
+		{"Testing Ed25519 key", ed25519Key, nil, "h=From:To:Cc:Subject:Date:Message-ID:Content-Type;"},
+		{"Testing custom headers", rsaKey, []string{"From", "Subject"}, "h=From:Subject;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyPath, record := writeDKIMKey(t, t.TempDir(), tt.key)
+			signer, err := NewDKIMSigner(&config.DKIMConfig{
+				Domain:     "example.com",
+				Selector:   "login-monitor",
+				PrivateKey: keyPath,
+				Headers:    tt.headers,
+			})
+			if err != nil {
+				t.Fatal("Couldn't create DKIM signer", err)
+			}
+
+			signed, err := signer.Sign(payload)
+			if err != nil {
+				t.Fatal("Couldn't sign payload", err)
+			}
+			if !bytes.HasPrefix(signed, []byte("DKIM-Signature: ")) || !bytes.HasSuffix(signed, payload) {
+				t.Fatalf("Signed payload is not the payload with a DKIM-Signature header. Payload: %s", signed)
+			}
+			if signature := strings.ReplaceAll(string(signed[:len(signed)-len(payload)]), "\r\n ", ""); !strings.Contains(signature, tt.signed) {
+				t.Errorf("Signature doesn't contain %q. Signature: %s", tt.signed, signature)
+			}
+
+			verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					if domain != "login-monitor._domainkey.example.com" {
+						t.Errorf("Public key looked up at %s", domain)
+					}
+					return []string{record}, nil
+				},
+			})
+			if err != nil {
+				t.Fatal("Couldn't verify signature", err)
+			}
+			if len(verifications) != 1 || verifications[0].Err != nil {
+				t.Errorf("Signature is not valid. %+v", verifications[0])
+			}
+		})
+	}
+}
+
+func TestDKIMSignerMTAHeaders(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, record := writeDKIMKey(t, t.TempDir(), ed25519Key)
+	signer, err := NewDKIMSigner(&config.DKIMConfig{Domain: "example.com", Selector: "login-monitor", PrivateKey: keyPath})
+	if err != nil {
+		t.Fatal("Couldn't create DKIM signer", err)
+	}
+
+	strategy := &recordingStrategy{}
+	email := NewEmail(strategy).
+		SetPGPMode(PGPNone).
+		SetFakeSender("alerts@example.com").
+		SetRecipient(config.NewEntity("benja@kobd.io")).
+		SetSubject("Testing DKIM").
+		SetTextMessage("Testing DKIM")
+	if _, err = email.InitStrategy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = email.Send(); err != nil {
+		t.Fatal("Couldn't send email", err)
+	}
+	signed, err := signer.Sign(strategy.payloads[0])
+	if err != nil {
+		t.Fatal("Couldn't sign payload", err)
+	}
+
+	// like Postfix does for local clients, the MTA adds the Date and Message-ID headers if they're missing
+	headers := textproto.NewReader(bufio.NewReader(bytes.NewReader(signed)))
+	header, err := headers.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal("Couldn't parse payload", err)
+	}
+	relayed := "Received: from localhost by mx.example.com\r\n"
+	for _, key := range []string{"Date", "Message-Id", "Mime-Version"} {
+		if header.Get(key) == "" {
+			t.Errorf("Payload doesn't have a %s header", key)
+			relayed += key + ": added by the MTA\r\n"
+		}
+	}
+	relayed += string(signed)
+
+	verifications, err := dkim.VerifyWithOptions(strings.NewReader(relayed), &dkim.VerifyOptions{
+		LookupTXT: func(string) ([]string, error) { return []string{record}, nil },
+	})
+	if err != nil {
+		t.Fatal("Couldn't verify signature", err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil {
+		t.Errorf("Signature is not valid after relaying. %+v", verifications[0])
+	}
+}
+
+func TestNewDKIMSignerErrors(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeyPath, _ := writeDKIMKey(t, t.TempDir(), ecKey)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	keyPath, _ := writeDKIMKey(t, t.TempDir(), ed25519Key)
+
+	tests := []struct {
+		name   string
+		config config.DKIMConfig
+	}{
+		{"Testing missing domain", config.DKIMConfig{Selector: "s", PrivateKey: keyPath}},
+		{"Testing missing selector", config.DKIMConfig{Domain: "example.com", PrivateKey: keyPath}},
+		{"Testing missing key", config.DKIMConfig{Domain: "example.com", Selector: "s", PrivateKey: "/nonexistent"}},
+		{"Testing unsupported key", config.DKIMConfig{Domain: "example.com", Selector: "s", PrivateKey: ecKeyPath}},
+		{"Testing headers without From", config.DKIMConfig{Domain: "example.com", Selector: "s", PrivateKey: keyPath, Headers: []string{"Subject"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDKIMSigner(&tt.config); err == nil {
+				t.Error("NewDKIMSigner() should fail")
+			}
+		})
+	}
+}
@@ -2,34 +2,58 @@ package email
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"html"
 	"io"
 	"io/fs"
 	"login-monitor/config"
+	"login-monitor/pam"
+	"login-monitor/pgp"
 	"mime/multipart"
 	"net/http"
+	"net/mail"
 	"net/textproto"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // MaxLen Max line length for the email
 const MaxLen = 76
 
+// DefaultProtectedSubject default subject in the (unencrypted) headers of PGP-encrypted emails
+const DefaultProtectedSubject = "..."
+
+// PGP modes (see Email.SetPGPMode)
+const (
+	PGPEncrypt       = "encrypt"         // encrypt (and sign) if any recipient's public key is known, otherwise send plain
+	PGPEncryptOrSign = "encrypt-or-sign" // like PGPEncrypt, but sign if no recipient's public key is known
+	PGPSign          = "sign"            // sign but never encrypt
+	PGPNone          = "none"            // neither encrypt nor sign
+)
+
 type Email struct {
 	sender         config.Entity
 	fakeSender     string
 	recipient      config.Entity
 	cc             []config.Entity
+	bcc            []config.Entity // recipients that are not in the headers
 	subject        string
 	textMessage    string
 	htmlMessage    string
 	attachments    []string
 	senderPassFile string // path to the sender's private key passphrase (required if the message is signed)
+	loginEvent     *pam.LoginEvent
+	pgp            pgp.Backend
+	pgpMode        string // see Email.SetPGPMode
+
+	// protectedSubject subject in the (unencrypted) headers of PGP-encrypted emails. The real subject is encrypted
+	protectedSubject string
 
 	initiated bool
 	strategy  EmailStrategy
@@ -39,7 +63,9 @@ type Email struct {
 func NewEmail(strategy EmailStrategy) *Email {
 	return &Email{
 		cc:          []config.Entity{},
+		bcc:         []config.Entity{},
 		attachments: []string{},
+		pgp:         &pgp.GPGBackend{},
 		strategy:    strategy,
 	}
 }
@@ -48,6 +74,7 @@ func NewEmail(strategy EmailStrategy) *Email {
 func (e *Email) Init() *Email {
 	// these setters have specific logic
 	return e.SetSubject(e.subject).
+		SetProtectedSubject(e.protectedSubject).
 		SetTextMessage(e.textMessage).
 		SetHtmlMessage(e.htmlMessage)
 }
@@ -55,13 +82,16 @@ func (e *Email) Init() *Email {
 func (e *Email) InitFromConfig(c *config.EmailConfig) *Email {
 	return e.SetSubject(c.Subject).
 		SetCc(c.Cc).
+		SetBcc(c.Bcc).
 		SetSender(c.Sender).
 		SetFakeSender(c.FakeSender).
 		SetAttachments(c.Attachments).
 		SetRecipient(c.Recipient).
 		SetHtmlMessage(c.HTMLMessage).
 		SetTextMessage(c.TextMessage).
-		SetSenderPassFile(c.SenderPassFile)
+		SetSenderPassFile(c.SenderPassFile).
+		SetPGPMode(c.PGP.Mode).
+		SetProtectedSubject(c.PGP.ProtectedSubject)
 }
 
 func (e *Email) Sender() config.Entity {
@@ -87,10 +117,23 @@ func (e *Email) Cc() []config.Entity {
 	return e.cc
 }
 
+// Bcc returns the recipients that are not in the headers (blind carbon copy)
+func (e *Email) Bcc() []config.Entity {
+	return e.bcc
+}
+
 func (e *Email) Subject() string {
 	return e.subject
 }
 
+// ProtectedSubject returns the subject in the (unencrypted) headers of PGP-encrypted emails
+func (e *Email) ProtectedSubject() string {
+	if e.protectedSubject == "" {
+		return DefaultProtectedSubject
+	}
+	return e.protectedSubject
+}
+
 func (e *Email) TextMessage() string {
 	return e.textMessage
 }
@@ -103,6 +146,10 @@ func (e *Email) Attachments() []string {
 	return e.attachments
 }
 
+func (e *Email) LoginEvent() *pam.LoginEvent {
+	return e.loginEvent
+}
+
 func (e *Email) SetSender(sender config.Entity) *Email {
 	e.sender = sender
 	return e
@@ -128,8 +175,28 @@ func (e *Email) SetCc(cc []config.Entity) *Email {
 	return e
 }
 
+// SetBcc sets the recipients that receive the email without being in the headers (blind carbon copy)
+func (e *Email) SetBcc(bcc []config.Entity) *Email {
+	e.bcc = bcc
+	return e
+}
+
+// SetLoginEvent sets the login event used to replace login placeholders (see ReplaceLoginPlaceholders).
+// Placeholders are replaced when the subject and messages are set, so call this before setting them
+func (e *Email) SetLoginEvent(event *pam.LoginEvent) *Email {
+	e.loginEvent = event
+	return e
+}
+
 func (e *Email) SetSubject(subject string) *Email {
-	e.subject = ReplacePlaceholders(subject)
+	e.subject = stripNewlines(e.replacePlaceholders(subject, nil)) // values must not inject headers
+	return e
+}
+
+// SetProtectedSubject sets the subject in the (unencrypted) headers of PGP-encrypted emails.
+// If empty, DefaultProtectedSubject is used
+func (e *Email) SetProtectedSubject(subject string) *Email {
+	e.protectedSubject = stripNewlines(e.replacePlaceholders(subject, nil)) // values must not inject headers
 	return e
 }
 
@@ -139,7 +206,7 @@ func (e *Email) SetTextMessage(textMessage string) *Email {
 			textMessage = string(contents)
 		}
 	}
-	e.textMessage = ReplacePlaceholders(textMessage)
+	e.textMessage = e.replacePlaceholders(textMessage, nil)
 	return e
 }
 
@@ -150,10 +217,26 @@ func (e *Email) SetHtmlMessage(htmlMessage string) *Email {
 		}
 	}
 
-	e.htmlMessage = ReplacePlaceholders(htmlMessage)
+	e.htmlMessage = e.replacePlaceholders(htmlMessage, html.EscapeString)
 	return e
 }
 
+// replacePlaceholders replaces the general placeholders and the login placeholders in a single pass.
+// Login values may be controlled by the remote user (e.g. PAM_RUSER) and file contents may contain anything, so
+// replaced text is never interpreted as another placeholder. For the same reason, login values are escaped with
+// escape (if not nil), so they can't inject markup or headers.
+// Time placeholders are replaced with the time of the login event, if any
+func (e *Email) replacePlaceholders(str string, escape func(string) string) string {
+	at := time.Now()
+	if e.loginEvent != nil && !e.loginEvent.Time.IsZero() {
+		at = e.loginEvent.Time
+	}
+	if escape == nil {
+		escape = func(value string) string { return value }
+	}
+	return replaceAllPlaceholders(str, at, e.loginEvent, escape)
+}
+
 func (e *Email) SetAttachments(attachments []string) *Email {
 	realAttachments := make([]string, 0, len(attachments))
 	for _, attachment := range attachments {
@@ -201,6 +284,37 @@ func (e *Email) CCEmails() []string {
 	return emails
 }
 
+// BCCEmails Returns only the emails in Email.bcc
+func (e *Email) BCCEmails() []string {
+	emails := make([]string, 0, len(e.bcc))
+	for _, entity := range e.bcc {
+		if entity.Email != "" {
+			emails = append(emails, entity.Email)
+		}
+	}
+	return emails
+}
+
+// Envelope returns the SMTP envelope of the email: the sender and the recipient, Cc and Bcc emails
+func (e *Email) Envelope() Envelope {
+	envelope := Envelope{From: e.Sender().Email, Bcc: e.BCCEmails()}
+	if e.recipient.Email != "" {
+		envelope.To = append(envelope.To, e.recipient.Email)
+	}
+	envelope.To = append(envelope.To, e.CCEmails()...)
+	return envelope
+}
+
+// recipients returns the recipient (if any), Cc and Bcc entities, i.e. the entities the email is encrypted for
+func (e *Email) recipients() []config.Entity {
+	entities := make([]config.Entity, 0, 1+len(e.cc)+len(e.bcc))
+	if e.recipient.Email != "" {
+		entities = append(entities, e.recipient)
+	}
+	entities = append(entities, e.cc...)
+	return append(entities, e.bcc...)
+}
+
 // CCPGPKeyIds Returns the values of Email.cc
 func (e *Email) CCPGPKeyIds() []string {
 	if e.cc == nil {
@@ -220,9 +334,29 @@ type EmailStrategy interface {
 	// Init initialize the strategy. Read config files, credentials, generate tokens, etc..
 	Init(...interface{}) (interface{}, error)
 
-	// SendEmail sends the given payload as email with the specified sender
-	// (it is recommended to be the same as provided to CreatePayload, but it's not necessary)
-	SendEmail(payload []byte, sender string) (interface{}, error)
+	// SendEmail sends the given payload as email to the recipients in the envelope.
+	// The payload must not be parsed to know the recipients, e.g. Bcc recipients are only in the envelope
+	SendEmail(payload []byte, envelope Envelope) (interface{}, error)
+}
+
+// SetPGPBackend sets the OpenPGP backend used to encrypt and sign the email (gpg by default)
+func (e *Email) SetPGPBackend(backend pgp.Backend) *Email {
+	e.pgp = backend
+	return e
+}
+
+// SetPGPMode sets the PGP mode deciding whether the email is encrypted and/or signed (see Email.Send).
+// Valid values are PGPEncrypt (default), PGPEncryptOrSign, PGPSign and PGPNone
+func (e *Email) SetPGPMode(mode string) *Email {
+	e.pgpMode = mode
+	return e
+}
+
+// SetStrategy sets the context's strategy. The strategy must be initiated with Email.InitStrategy afterwards
+func (e *Email) SetStrategy(strategy EmailStrategy) *Email {
+	e.strategy = strategy
+	e.initiated = false
+	return e
 }
 
 // InitStrategy simply calls EmailStrategy.Init on the context's strategy
@@ -249,7 +383,7 @@ func (e *Email) SendEmail() (interface{}, error) {
 	log.Debugln("Done creating email payload")
 
 	log.Debugln("Sending email payload")
-	res, err := e.strategy.SendEmail(payload, e.Sender().Email)
+	res, err := e.sendPayload(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -258,6 +392,26 @@ func (e *Email) SendEmail() (interface{}, error) {
 	return res, nil
 }
 
+// sendPayload sends the payload with the context's strategy, adding the Date, Message-ID and MIME-Version headers at
+// the end of its headers. They're added to the outermost headers only (i.e. not to the headers of encrypted or signed
+// parts), and they must be in the payload before it's DKIM-signed, otherwise the MTA adds them and the signature breaks
+func (e *Email) sendPayload(payload []byte) (interface{}, error) {
+	headers, err := createMessageHeaders(e.FakeSender(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	end := 0 // end of the headers, i.e. after the CRLF of the last header
+	if i := bytes.Index(payload, []byte("\r\n\r\n")); i != -1 {
+		end = i + 2
+	}
+	withHeaders := make([]byte, 0, len(payload)+len(headers))
+	withHeaders = append(withHeaders, payload[:end]...)
+	withHeaders = append(withHeaders, headers...)
+	withHeaders = append(withHeaders, payload[end:]...)
+	return e.strategy.SendEmail(withHeaders, e.Envelope())
+}
+
 // SendPGPEmail Sends a PGP-encrypted email using the context's strategy.
 // Prior to calling this method (or any other method on e) you should set fields via setters
 //
@@ -272,7 +426,7 @@ func (e *Email) SendPGPEmail() (interface{}, error) {
 		return nil, err
 	}
 
-	res, err := e.strategy.SendEmail(payload, e.Sender().Email)
+	res, err := e.sendPayload(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -280,14 +434,265 @@ func (e *Email) SendPGPEmail() (interface{}, error) {
 	return res, nil
 }
 
+// SendSignedEmail Sends a PGP-signed (but not encrypted) email using the context's strategy.
+// Prior to calling this method (or any other method on e) you should set fields via setters
+//
+// See also Email.CreateSignedPayload
+func (e *Email) SendSignedEmail() (interface{}, error) {
+	if !e.initiated {
+		return nil, errors.New("strategy needs to be initiated")
+	}
+
+	payload, err := e.CreateSignedPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.sendPayload(payload)
+}
+
+// Send Sends the email plain, encrypted or signed depending on the PGP mode (see Email.SetPGPMode),
+// the encryption policy and scheme (PGP/MIME or S/MIME) of each recipient (see config.Entity) and the keys known by
+// the PGP backend (or the certificates of the recipients).
+//
+// Recipients are split in groups (see Email.GroupRecipients and Email.copies) and each group receives its own copy
+// of the email, i.e. the strategy sends each copy separately.
+// Returns the strategy's result (a slice with the result for each group if more than 1 copy was sent)
+func (e *Email) Send() (interface{}, error) {
+	switch e.pgpMode {
+	case "", PGPEncrypt, PGPEncryptOrSign, PGPSign, PGPNone:
+	default:
+		return nil, fmt.Errorf("invalid PGP mode '%s'", e.pgpMode)
+	}
+	for _, entity := range e.recipients() {
+		switch entity.Scheme {
+		case "", config.SchemePGP, config.SchemeSMIME:
+		default:
+			return nil, fmt.Errorf("invalid scheme '%s' for %s", entity.Scheme, entity.Email)
+		}
+	}
+
+	encrypted, plain := e.GroupRecipients()
+	if len(encrypted) == 0 && len(plain) == 0 {
+		return nil, errors.New("there are no recipients the email can be sent to")
+	}
+
+	copies := e.copies(encrypted, plain)
+	results := make([]interface{}, 0, len(copies))
+	errs := make([]string, 0, len(copies))
+	for _, emailCopy := range copies {
+		if res, err := emailCopy.send(e.withRecipients(emailCopy.recipients)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s copy: %s", emailCopy.name, err))
+		} else {
+			results = append(results, res)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("couldn't send email. %s", strings.Join(errs, "; "))
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return results, nil
+}
+
+// emailCopy copy of the email sent to a group of recipients
+type emailCopy struct {
+	name       string // used for logging
+	recipients []config.Entity
+	send       func(*Email) (interface{}, error)
+}
+
+// copies splits the encrypted and plain recipients (see Email.GroupRecipients) by scheme and returns the copies of
+// the email that must be sent:
+//
+// - encrypted recipients receive a PGP/MIME or S/MIME encrypted copy, according to their scheme
+// (see Email.encryptedCopies)
+//
+// - plain recipients receive a PGP/MIME or S/MIME signed copy (according to their scheme) if the PGP mode is
+// PGPEncryptOrSign or PGPSign and the sender's private key (or certificate) can be used. Otherwise, a plain copy
+func (e *Email) copies(encrypted, plain []config.Entity) []emailCopy {
+	pgpEncrypted, smimeEncrypted := splitByScheme(encrypted)
+	copies := append(
+		e.encryptedCopies("encrypted", pgpEncrypted, (*Email).SendPGPEmail),
+		e.encryptedCopies("S/MIME encrypted", smimeEncrypted, (*Email).SendSMIMEEmail)...,
+	)
+
+	unsigned := plain
+	if e.pgpMode == PGPEncryptOrSign || e.pgpMode == PGPSign {
+		unsigned = nil
+		pgpPlain, smimePlain := splitByScheme(plain)
+		switch {
+		case len(pgpPlain) == 0:
+		case e.CanSign():
+			copies = append(copies, emailCopy{"signed", pgpPlain, (*Email).SendSignedEmail})
+		default:
+			log.Warnf("PGP mode is %s but sender's private key is not known. Sending plain email", e.pgpMode)
+			unsigned = append(unsigned, pgpPlain...)
+		}
+		switch {
+		case len(smimePlain) == 0:
+		case e.CanSignSMIME():
+			copies = append(copies, emailCopy{"S/MIME signed", smimePlain, (*Email).SendSMIMESignedEmail})
+		default:
+			log.Warnf("PGP mode is %s but sender's certificate can't be used to sign. Sending plain email", e.pgpMode)
+			unsigned = append(unsigned, smimePlain...)
+		}
+	}
+	copies = append(copies, emailCopy{"plain", unsigned, (*Email).SendEmail})
+
+	nonEmpty := make([]emailCopy, 0, len(copies))
+	for _, emailCopy := range copies {
+		if len(emailCopy.recipients) > 0 {
+			nonEmpty = append(nonEmpty, emailCopy)
+		}
+	}
+	return nonEmpty
+}
+
+// encryptedCopies returns the encrypted copy for the recipients and a separate copy for each Bcc recipient.
+// The encrypted payload identifies the keys (or certificates) it is encrypted for, so Bcc recipients can't share it
+func (e *Email) encryptedCopies(name string, recipients []config.Entity, send func(*Email) (interface{}, error)) []emailCopy {
+	visible, bcc := e.splitBcc(recipients)
+	copies := []emailCopy{{name, visible, send}}
+	for _, entity := range bcc {
+		copies = append(copies, emailCopy{name + " Bcc", []config.Entity{entity}, send})
+	}
+	return copies
+}
+
+// splitBcc splits the entities in the ones that are in the headers (recipient and Cc) and the ones in Email.Bcc
+func (e *Email) splitBcc(entities []config.Entity) (visible []config.Entity, bcc []config.Entity) {
+	for _, entity := range entities {
+		if e.isBcc(entity) {
+			bcc = append(bcc, entity)
+		} else {
+			visible = append(visible, entity)
+		}
+	}
+	return visible, bcc
+}
+
+// isBcc tells if the entity is a Bcc recipient
+func (e *Email) isBcc(entity config.Entity) bool {
+	for _, bcc := range e.bcc {
+		if bcc.Email == entity.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// splitByScheme splits the entities in the ones using PGP/MIME (default) and the ones using S/MIME
+func splitByScheme(entities []config.Entity) (pgpEntities []config.Entity, smimeEntities []config.Entity) {
+	for _, entity := range entities {
+		if entity.Scheme == config.SchemeSMIME {
+			smimeEntities = append(smimeEntities, entity)
+		} else {
+			pgpEntities = append(pgpEntities, entity)
+		}
+	}
+	return pgpEntities, smimeEntities
+}
+
+// GroupRecipients splits the recipients (Email.Recipient, Email.Cc and Email.Bcc) in the ones receiving an encrypted copy of
+// the email and the ones receiving a plain (or signed) copy, according to their encryption policy:
+//
+// - config.EncryptionPrefer (default): encrypted if their public key (or certificate for S/MIME) is known,
+// plain otherwise
+//
+// - config.EncryptionRequire: encrypted if their public key (or certificate for S/MIME) is known, skipped otherwise
+//
+// - config.EncryptionNever: plain
+//
+// If the PGP mode doesn't allow encryption (PGPSign or PGPNone), public keys are considered unknown
+func (e *Email) GroupRecipients() (encrypted []config.Entity, plain []config.Entity) {
+	canEncrypt := e.pgpMode == "" || e.pgpMode == PGPEncrypt || e.pgpMode == PGPEncryptOrSign
+	for _, entity := range e.recipients() {
+		if entity.Email == "" {
+			continue
+		}
+
+		switch {
+		case canEncrypt && entity.Encryption != config.EncryptionNever && e.canEncryptFor(entity):
+			encrypted = append(encrypted, entity)
+		case entity.Encryption == config.EncryptionRequire:
+			log.Warnf("Encryption is required for %s but it is not possible. Email won't be sent to %s", entity.Email, entity.Email)
+		default:
+			plain = append(plain, entity)
+		}
+	}
+	return encrypted, plain
+}
+
+// canEncryptFor tells if the email can be encrypted for the entity with its scheme, i.e. its public key is known
+// and can be used (see Email.KeyUsable) or its certificate can be used (see Email.CertificateUsable)
+func (e *Email) canEncryptFor(entity config.Entity) bool {
+	if entity.Scheme == config.SchemeSMIME {
+		return e.CertificateUsable(true, entity.Certificate)
+	}
+	return e.KeyUsable(true, entity.PGPKeyId)
+}
+
+// withRecipients returns a copy of e sent to the given recipients: Bcc recipients remain in Bcc, the first of the
+// other ones is the recipient and the rest are Cc. If all of them are Bcc recipients, the copy has no recipient
+func (e *Email) withRecipients(recipients []config.Entity) *Email {
+	email := *e
+	visible, bcc := e.splitBcc(recipients)
+	email.recipient = config.Entity{}
+	email.cc = []config.Entity{}
+	if len(visible) > 0 {
+		email.recipient = visible[0]
+		email.cc = visible[1:]
+	}
+	email.bcc = bcc
+	return &email
+}
+
 // IsPGPCandidate tells if the email can be a PGP email. It is considered a candidate if at least one of the recipients'
-// (Email.Recipient or Email.Cc) public key is present in the GPG keyring
+// (Email.Recipient or Email.Cc) public key is known by the PGP backend and can be used (see Email.KeyUsable)
 func (e *Email) IsPGPCandidate() bool {
 	recipientsKeyIds := append(e.CCPGPKeyIds(), e.Recipient().PGPKeyId) // This may seem wrong, but is actually right because we modify a copy of the Cc emails (getter returns such copy)
-	return recipientsKeyExist(true, recipientsKeyIds...)
+	for _, keyId := range recipientsKeyIds {
+		if e.KeyUsable(true, keyId) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSign tells if the email can be PGP-signed, i.e. the sender's private key is known by the PGP backend
+// and can be used (see Email.KeyUsable)
+func (e *Email) CanSign() bool {
+	return e.KeyUsable(false, e.Sender().PGPKeyId)
+}
+
+// KeyUsable tells if the public (to encrypt) or private (to sign) key for the given id is known by the PGP backend
+// and it can be used, i.e. it's not expired nor revoked and it has the required capability.
+// Keys that exist but can't be used are logged as a warning
+func (e *Email) KeyUsable(public bool, keyId string) bool {
+	if keyId == "" {
+		return false
+	}
+	info, err := e.pgp.KeyInfo(public, keyId)
+	if err != nil {
+		log.Debugf("PGP key %s is not known. %s", keyId, err)
+		return false
+	}
+	if err = info.Check(public, time.Now()); err != nil {
+		log.Warnf("PGP key can't be used. %s", err)
+		return false
+	}
+	return true
 }
 
+// createBasicHeaders creates the From, To and Subject headers. If to is empty (only Bcc recipients), the To header is
+// an empty group
 func createBasicHeaders(from, to, subject string) string {
+	if to == "" {
+		to = "undisclosed-recipients:;"
+	}
 	return fmt.Sprintf(
 		"From: %s\r\n"+
 			"To: %s\r\n"+
@@ -298,6 +703,32 @@ func createBasicHeaders(from, to, subject string) string {
 	)
 }
 
+// createMessageHeaders creates the Date, Message-ID and MIME-Version headers. The domain of the Message-ID is the
+// domain of from (or the hostname if from is not a valid address)
+func createMessageHeaders(from string, date time.Time) (string, error) {
+	domain, _ := os.Hostname()
+	if address, err := mail.ParseAddress(from); err == nil {
+		domain = address.Address[strings.LastIndex(address.Address, "@")+1:]
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("couldn't create Message-ID. %w", err)
+	}
+	return fmt.Sprintf(
+		"Date: %s\r\n"+
+			"Message-ID: <%d.%s@%s>\r\n"+
+			"MIME-Version: 1.0\r\n",
+		date.Format(time.RFC1123Z),
+		date.UnixNano(),
+		hex.EncodeToString(random),
+		domain,
+	), nil
+}
+
 func (e *Email) createCCHeader() string {
 	strBuilder := strings.Builder{}
 	if ccEmails := e.CCEmails(); ccEmails != nil && len(ccEmails) > 0 {
@@ -359,11 +790,23 @@ func (e *Email) CreateMessagePayload() ([]byte, error) {
 //
 // This is a pure function, i.e. e is not modified
 func (e *Email) CreatePayload() ([]byte, error) {
+	return e.createPayload(false)
+}
+
+// createPayload creates the payload (see Email.CreatePayload).
+// If protectedHeaders is true, the payload is marked as having protected headers, i.e. the headers in the payload
+// are the real ones and the ones outside the (encrypted or signed) payload must be ignored.
+// See https://datatracker.ietf.org/doc/draft-autocrypt-lamps-protected-headers/
+func (e *Email) createPayload(protectedHeaders bool) ([]byte, error) {
 	payload := bytes.Buffer{}
 	mpWriter := multipart.NewWriter(&payload)
 
 	// write email headers
-	payload.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", mpWriter.Boundary()))
+	if protectedHeaders {
+		payload.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"; protected-headers=\"v1\"\r\n", mpWriter.Boundary()))
+	} else {
+		payload.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", mpWriter.Boundary()))
+	}
 	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.subject))
 
 	// write CC headers
@@ -417,12 +860,15 @@ func (e *Email) CreatePayload() ([]byte, error) {
 }
 
 // CreatePGPPayload Similarly to Email.CreatePayload, this creates a multipart payload encrypted with the recipient's public key.
-// IMPORTANT: This requires gpg installed on the system
+// Encryption and signing are done by the PGP backend (see Email.SetPGPBackend)
+//
+// Recipient's public key must be known by the backend, otherwise an error is returned.
 //
-// Recipient's public key must exists in the gpg keyring, otherwise an error is returned.
+// If sender private key is known by the backend, the message will also be signed
+// It is recommended that sender's public key is known by the backend too. See below.
 //
-// If sender private key is in the keyring, the message will also be signed
-// It is recommended that sender's public key is present in the keyring. See below.
+// The real headers (Subject, From, To and Cc) are only in the encrypted payload (protected headers),
+// the Subject outside the encrypted payload is Email.ProtectedSubject
 //
 // Some clients (thunderbird) don't handle the single recipient case (when sender = recipient) so it may show some error.
 // But, that's actually not right. Info about multiple recipient case:
@@ -433,7 +879,7 @@ func (e *Email) CreatePGPPayload() ([]byte, error) {
 
 	// write email headers
 	payload.WriteString(fmt.Sprintf("Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"%s\"\r\n", mpWriter.Boundary()))
-	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.subject))
+	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.ProtectedSubject())) // real subject is encrypted
 
 	// write CC headers
 	payload.WriteString(e.createCCHeader())
@@ -452,57 +898,32 @@ func (e *Email) CreatePGPPayload() ([]byte, error) {
 	}
 
 	// create plain text body (the plain payload inside the encrypted payload)
-	body, err := e.CreatePayload()
+	body, err := e.createPayload(true)
 	if err != nil {
 		return nil, err
 	}
 
 	// sign body and create a wrapper consisting of 2 parts: body and signature
-	senderPrivKeyExists := recipientsKeyExist(false, e.Sender().PGPKeyId)
+	senderPrivKeyExists := e.CanSign()
 	if senderPrivKeyExists {
-		var signature []byte
-		if signature, err = pgpSign(body, e.Sender().PGPKeyId, e.senderPassFile); err != nil {
-			return nil, err
-		}
-		wrapper := bytes.Buffer{}
-		wrapperWriter := multipart.NewWriter(&wrapper)
-		wrapper.WriteString(fmt.Sprintf(
-			"Content-Type: multipart/signed; "+
-				"micalg=pgp-sha256; "+ // TODO change MICalg
-				"protocol=\"application/pgp-signature\"; "+
-				"boundary=\"%s\"",
-			wrapperWriter.Boundary(),
-		))
-		wrapper.WriteString("\r\n\r\nThis is an OpenPGP/MIME signed message (RFC 4880 and 3156)\r\n")
-
-		// write body (write it without creating a new part because the body itself contains all the required headers)
-		wrapper.WriteString(fmt.Sprintf("--%s\r\n%s\r\n", wrapperWriter.Boundary(), body))
-
-		// write signature
-		sigPart, err := wrapperWriter.CreatePart(textproto.MIMEHeader{
-			"Content-Type":        {"application/pgp-signature; name=\"OpenPGP_signature.asc\""},
-			"Content-Description": {"OpenPGP digital signature"},
-			"Content-Disposition": {"attachment; filename=\"OpenPGP_signature\""},
-		})
+		contentType, signed, err := e.signPayload(body)
 		if err != nil {
 			return nil, err
 		}
-		if _, err = sigPart.Write(signature); err != nil {
-			return nil, err
-		}
-		_ = wrapperWriter.Close()
-
-		body = wrapper.Bytes() // new body = (previous) body + signature
+		body = append([]byte(contentType+"\r\n\r\n"), signed...) // new body = (previous) body + signature
 	}
 
 	// encrypt plain text body
-	var encryptedBody []byte
-	recipientsKeyIds := append(e.CCPGPKeyIds(), e.Recipient().PGPKeyId)       // This may seem wrong, but is actually right because we modify a copy of the Cc emails (getter returns such copy)
-	if senderPrivKeyExists || recipientsKeyExist(true, e.Sender().PGPKeyId) { // If private key exist, public key must exist (or at least can be obtained from the private key)
-		encryptedBody, err = pgpEncrypt(body, e.Sender().PGPKeyId, recipientsKeyIds...) // encrypt for both
-	} else {
-		encryptedBody, err = pgpEncrypt(body, "", recipientsKeyIds...) // encrypt only for recipient as sender key doesn't exist
+	recipientsKeyIds := make([]string, 0, len(e.cc)+len(e.bcc)+2)
+	for _, entity := range e.recipients() {
+		if entity.PGPKeyId != "" {
+			recipientsKeyIds = append(recipientsKeyIds, entity.PGPKeyId)
+		}
 	}
+	if senderPrivKeyExists || e.KeyUsable(true, e.Sender().PGPKeyId) {
+		recipientsKeyIds = append(recipientsKeyIds, e.Sender().PGPKeyId) // encrypt for the sender too
+	}
+	encryptedBody, err := e.pgp.Encrypt(body, recipientsKeyIds...)
 	if err != nil {
 		return nil, err
 	}
@@ -525,108 +946,72 @@ func (e *Email) CreatePGPPayload() ([]byte, error) {
 	return payload.Bytes(), nil
 }
 
-// TODO migrate functions below to GPGME or https://pkg.go.dev/github.com/ProtonMail/go-crypto or github.com/ProtonMail/gopenpgp/v2
-
-// pgpEncrypt Encrypt the given data using gpg and the public keys for the given recipients
-//
-// If senderId is not empty and is associated to a public key, message will be encrypted for the sender too
+// CreateSignedPayload Similarly to Email.CreatePGPPayload, this creates a multipart/signed payload (RFC 3156),
+// i.e. the message is signed with the sender's private key but it is NOT encrypted.
 //
-// If senderId is not empty and is associated to a private key, message will be signed
-func pgpEncrypt(data []byte, senderId string, recipientsIds ...string) ([]byte, error) {
-	var initialArgs []string
-	if senderId != "" {
-		// encrypt the message for the sender too
-		initialArgs = []string{"--batch", "--pinentry-mode", "loopback", "--encrypt", "--armor", "--trust-model", "always", "--recipient", senderId}
-	} else {
-		initialArgs = []string{"--batch", "--pinentry-mode", "loopback", "--encrypt", "--armor", "--trust-model", "always"}
-	}
-	gpgArgs := make([]string, len(initialArgs)+len(recipientsIds)*2)
-	copy(gpgArgs, initialArgs)
-	for i := len(initialArgs); i < len(gpgArgs); i += 2 {
-		gpgArgs[i] = "--recipient"
-		gpgArgs[i+1] = recipientsIds[(i-len(initialArgs))/2]
-	}
-
-	log.Debugln("Encrypting data. Executing gpg", gpgArgs)
-	encryptCmd := exec.Command("gpg", gpgArgs...)
-	var stdout, stderr bytes.Buffer
-	encryptCmd.Stderr = &stderr
-	encryptCmd.Stdout = &stdout
-
-	stdin, err := encryptCmd.StdinPipe()
+// Sender's private key must be known by the PGP backend, otherwise an error is returned
+func (e *Email) CreateSignedPayload() ([]byte, error) {
+	body, err := e.createPayload(true)
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		defer stdin.Close() // we need to close it, otherwise gpg will keep reading from it and block the thread
-		_, err = stdin.Write(data)
-	}()
-
-	if err := encryptCmd.Start(); err != nil {
+	contentType, signed, err := e.signPayload(body)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := encryptCmd.Wait(); err != nil { // if recipient's key doesn't exist, this will return an error
-		return nil, fmt.Errorf("error while encrypting PGP message, pgp stderr: \"%s\". %w", stderr.Bytes(), err)
-	}
+	payload := bytes.Buffer{}
+	payload.WriteString(contentType + "\r\n")
+	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.subject))
+	payload.WriteString(e.createCCHeader())
+	payload.WriteString("\r\n")
+	payload.Write(signed)
 
-	encrypted := stdout.Bytes()
-	return encrypted, nil
+	return payload.Bytes(), nil
 }
 
-// pgpSign signs the given data and returns the signature
-func pgpSign(data []byte, senderId string, passphraseFile string) ([]byte, error) {
-	gpgArgs := []string{
-		"--batch",
-		"--pinentry-mode", "loopback",
-		"--armor",
-		"--trust-model", "always",
-		"--detach-sig",
-		"--local-user", senderId,
-	}
-	if passphraseFile != "" {
-		gpgArgs = append(gpgArgs, "--passphrase-file", passphraseFile)
-	}
-
-	log.Debugln("Signing data. Executing gpg", gpgArgs)
-	signCmd := exec.Command("gpg", gpgArgs...)
-	var stdout, stderr bytes.Buffer
-	signCmd.Stderr = &stderr
-	signCmd.Stdout = &stdout
-
-	stdin, err := signCmd.StdinPipe()
+// signPayload signs the payload with the sender's private key and creates a multipart/signed wrapper consisting of
+// 2 parts: payload and signature.
+// Returns the Content-Type header of the wrapper (without line terminator) and the wrapper's content
+func (e *Email) signPayload(payload []byte) (string, []byte, error) {
+	signature, hash, err := e.pgp.Sign(payload, e.Sender().PGPKeyId, e.senderPassFile)
 	if err != nil {
-		return nil, err
-	}
-
-	go func() {
-		defer stdin.Close() // we need to close it, otherwise gpg will keep reading from it and block the thread
-		_, err = stdin.Write(data)
-	}()
+		return "", nil, err
+	}
+	micalg := pgp.MICAlg(hash)
+	if micalg == "" {
+		return "", nil, fmt.Errorf("hash %s used to sign PGP message is not supported", hash)
+	}
+
+	wrapper := bytes.Buffer{}
+	wrapperWriter := multipart.NewWriter(&wrapper)
+	contentType := fmt.Sprintf(
+		"Content-Type: multipart/signed; "+
+			"micalg=%s; "+
+			"protocol=\"application/pgp-signature\"; "+
+			"boundary=\"%s\"",
+		micalg,
+		wrapperWriter.Boundary(),
+	)
+	wrapper.WriteString("This is an OpenPGP/MIME signed message (RFC 4880 and 3156)\r\n")
 
-	if err := signCmd.Start(); err != nil {
-		return nil, err
-	}
+	// write payload (write it without creating a new part because the payload itself contains all the required headers)
+	wrapper.WriteString(fmt.Sprintf("--%s\r\n%s\r\n", wrapperWriter.Boundary(), payload))
 
-	if err := signCmd.Wait(); err != nil { // if recipient's key doesn't exist, this will return an error
-		return nil, fmt.Errorf("error while signing PGP message, pgp stderr: \"%s\". %w", stderr.Bytes(), err)
+	// write signature
+	sigPart, err := wrapperWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-signature; name=\"OpenPGP_signature.asc\""},
+		"Content-Description": {"OpenPGP digital signature"},
+		"Content-Disposition": {"attachment; filename=\"OpenPGP_signature\""},
+	})
+	if err != nil {
+		return "", nil, err
 	}
-
-	signed := stdout.Bytes()
-	return signed, nil
-}
-
-// recipientsKeyExist Tells whether the public/private exists in the gpg keyring for ANY of the recipients given.
-func recipientsKeyExist(public bool, recipients ...string) bool {
-	gpgArgs := []string{"--list-public-keys", "--batch", "--with-colons"} // with-colons is actually not needed (for now)
-	if !public {
-		gpgArgs[0] = "--list-secret-keys"
+	if _, err = sigPart.Write(signature); err != nil {
+		return "", nil, err
 	}
-	gpgArgs = append(gpgArgs, recipients...)
+	_ = wrapperWriter.Close()
 
-	if err := exec.Command("gpg", gpgArgs...).Run(); err != nil { // recipient's key doesn't exist
-		return false
-	}
-	return true
+	return contentType, wrapper.Bytes(), nil
 }
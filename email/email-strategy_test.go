@@ -1,12 +1,90 @@
 package email
 
 import (
+	"crypto"
+	"errors"
+	"fmt"
 	"log"
 	"login-monitor/config"
+	"login-monitor/pam"
+	"login-monitor/pgp"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// fakePGPBackend pgp.Backend which "signs" with the given hash
+type fakePGPBackend struct {
+	hash         crypto.Hash
+	publicKeys   []string     // ids of the known public keys. If nil, every public key is known
+	noPrivateKey bool         // if true, no private key is known
+	keyInfo      *pgp.KeyInfo // info returned for every known key. If nil, keys are valid
+}
+
+func (b *fakePGPBackend) Encrypt(data []byte, _ ...string) ([]byte, error) {
+	return []byte("-----BEGIN PGP MESSAGE-----\n"), nil
+}
+
+func (b *fakePGPBackend) Sign(data []byte, _, _ string) ([]byte, crypto.Hash, error) {
+	return []byte("-----BEGIN PGP SIGNATURE-----\n"), b.hash, nil
+}
+
+func (b *fakePGPBackend) KeyExists(public bool, ids ...string) bool {
+	if !public {
+		return !b.noPrivateKey
+	}
+	if b.publicKeys == nil {
+		return true
+	}
+	for _, id := range ids {
+		for _, key := range b.publicKeys {
+			if id == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pgpPayloadRecorder fakePGPBackend that records the data given to Encrypt
+type pgpPayloadRecorder struct {
+	fakePGPBackend
+	encrypted []byte
+}
+
+func (b *pgpPayloadRecorder) Encrypt(data []byte, recipients ...string) ([]byte, error) {
+	b.encrypted = data
+	return b.fakePGPBackend.Encrypt(data, recipients...)
+}
+
+// recordingStrategy EmailStrategy that records the payloads sent and their envelopes
+type recordingStrategy struct {
+	payloads  [][]byte
+	envelopes []Envelope
+}
+
+func (s *recordingStrategy) Init(...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *recordingStrategy) SendEmail(payload []byte, envelope Envelope) (interface{}, error) {
+	s.payloads = append(s.payloads, payload)
+	s.envelopes = append(s.envelopes, envelope)
+	return nil, nil
+}
+
+func (b *fakePGPBackend) KeyInfo(public bool, id string) (*pgp.KeyInfo, error) {
+	if !b.KeyExists(public, id) {
+		return nil, errors.New("key doesn't exist")
+	}
+	if b.keyInfo != nil {
+		return b.keyInfo, nil
+	}
+	return &pgp.KeyInfo{ID: id, CanEncrypt: true, CanSign: true}, nil
+}
+
 func getBoundary(payload string) string {
 	boundaryStart := strings.Index(payload, "boundary=\"") + len("boundary=\"")
 	boundaryEnd := boundaryStart + strings.IndexRune(payload[boundaryStart:], '"')
@@ -88,3 +166,399 @@ dG8gYXBwbHkgY2hhbmdlcyIK
 		t.Errorf("Payloads differ. Expected: %s, Actual: %s", expectedPayload, string(actualPayload))
 	}
 }
+
+func TestCreatePGPPayloadMICAlg(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     crypto.Hash
+		expected string
+	}{
+		{"Testing SHA-256 signature", crypto.SHA256, "micalg=pgp-sha256;"},
+		{"Testing SHA-512 signature", crypto.SHA512, "micalg=pgp-sha512;"},
+		{"Testing SHA-1 signature", crypto.SHA1, "micalg=pgp-sha1;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &pgpPayloadRecorder{fakePGPBackend: fakePGPBackend{hash: tt.hash}}
+			email := NewEmail(nil).
+				SetPGPBackend(backend).
+				SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+				SetRecipient(config.NewEntity("benja@kobd.io")).
+				SetSubject("Testing CreatePGPPayload").
+				SetTextMessage("Testing CreatePGPPayload")
+
+			if _, err := email.CreatePGPPayload(); err != nil {
+				t.Fatal("Couldn't create PGP payload", err)
+			}
+			if !strings.Contains(string(backend.encrypted), tt.expected) {
+				t.Errorf("Signed payload doesn't contain %s. Payload: %s", tt.expected, backend.encrypted)
+			}
+		})
+	}
+}
+
+func TestCreateSignedPayload(t *testing.T) {
+	email := NewEmail(nil).
+		SetPGPBackend(&fakePGPBackend{hash: crypto.SHA512}).
+		SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+		SetRecipient(config.NewEntity("benja@kobd.io")).
+		SetCc([]config.Entity{config.NewEntity("sysadmin@benjaminguzman.dev")}).
+		SetSubject("Testing CreateSignedPayload").
+		SetTextMessage("Testing CreateSignedPayload")
+
+	payload, err := email.CreateSignedPayload()
+	if err != nil {
+		t.Fatal("Couldn't create signed payload", err)
+	}
+
+	expectedHeaders := "Content-Type: multipart/signed; micalg=pgp-sha512; protocol=\"application/pgp-signature\"; " +
+		"boundary=\"signedboundary\"\r\n" +
+		"From: bg@benjaminguzman.dev\r\n" +
+		"To: benja@kobd.io\r\n" +
+		"Subject: Testing CreateSignedPayload\r\n" +
+		"Cc: sysadmin@benjaminguzman.dev\r\n" +
+		"\r\n" +
+		"This is an OpenPGP/MIME signed message (RFC 4880 and 3156)\r\n" +
+		"--signedboundary\r\n" +
+		"Content-Type: multipart/mixed;"
+	expectedHeaders = strings.ReplaceAll(expectedHeaders, "signedboundary", getBoundary(string(payload)))
+	if !strings.HasPrefix(string(payload), expectedHeaders) {
+		t.Errorf("Signed payload doesn't start with %q. Payload: %s", expectedHeaders, payload)
+	}
+	if !strings.Contains(string(payload), "Content-Type: application/pgp-signature") ||
+		!strings.Contains(string(payload), "-----BEGIN PGP SIGNATURE-----") {
+		t.Errorf("Signed payload doesn't contain the signature. Payload: %s", payload)
+	}
+	if strings.Contains(string(payload), "multipart/encrypted") {
+		t.Errorf("Signed payload must not be encrypted. Payload: %s", payload)
+	}
+}
+
+func TestSendPGPMode(t *testing.T) {
+	const (
+		plain     = "multipart/mixed"
+		signed    = "multipart/signed"
+		encrypted = "multipart/encrypted"
+	)
+	tests := []struct {
+		name     string
+		mode     string
+		backend  fakePGPBackend
+		expected string // Content-Type of the payload sent
+		err      bool
+	}{
+		{"Testing default mode with public key", "", fakePGPBackend{}, encrypted, false},
+		{"Testing encrypt without public key", PGPEncrypt, fakePGPBackend{publicKeys: []string{}}, plain, false},
+		{"Testing encrypt-or-sign with public key", PGPEncryptOrSign, fakePGPBackend{}, encrypted, false},
+		{"Testing encrypt-or-sign without public key", PGPEncryptOrSign, fakePGPBackend{publicKeys: []string{}}, signed, false},
+		{"Testing encrypt-or-sign without keys", PGPEncryptOrSign, fakePGPBackend{publicKeys: []string{}, noPrivateKey: true}, plain, false},
+		{"Testing sign with public key", PGPSign, fakePGPBackend{}, signed, false},
+		{"Testing sign without private key", PGPSign, fakePGPBackend{noPrivateKey: true}, plain, false},
+		{"Testing none", PGPNone, fakePGPBackend{}, plain, false},
+		{"Testing invalid mode", "sign-and-encrypt", fakePGPBackend{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &recordingStrategy{}
+			backend := tt.backend
+			backend.hash = crypto.SHA256
+			email := NewEmail(strategy).
+				SetPGPBackend(&backend).
+				SetPGPMode(tt.mode).
+				SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+				SetRecipient(config.NewEntity("benja@kobd.io")).
+				SetSubject("Testing Send").
+				SetTextMessage("Testing Send")
+			if _, err := email.InitStrategy(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := email.Send()
+			if (err != nil) != tt.err {
+				t.Fatalf("Send() error = %v, want error %t", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if len(strategy.payloads) != 1 || !strings.HasPrefix(string(strategy.payloads[0]), "Content-Type: "+tt.expected+";") {
+				t.Errorf("Expected a single %s payload. Payloads: %q", tt.expected, strategy.payloads)
+			}
+		})
+	}
+}
+
+func TestSendEncryptionPolicy(t *testing.T) {
+	withKey := func(email, encryption string) config.Entity {
+		return config.Entity{Email: email, PGPKeyId: email, Encryption: encryption}
+	}
+	withoutKey := func(email, encryption string) config.Entity {
+		return config.Entity{Email: email, PGPKeyId: "nokey-" + email, Encryption: encryption}
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		recipient config.Entity
+		cc        []config.Entity
+		encrypted []string // recipients of the encrypted copy
+		plain     []string // recipients of the plain copy
+		err       bool
+	}{
+		{
+			"Testing prefer",
+			PGPEncrypt,
+			withKey("a@example.com", ""),
+			[]config.Entity{withoutKey("b@example.com", config.EncryptionPrefer), withKey("c@example.com", config.EncryptionPrefer)},
+			[]string{"a@example.com", "c@example.com"},
+			[]string{"b@example.com"},
+			false,
+		},
+		{
+			"Testing require",
+			PGPEncrypt,
+			withKey("a@example.com", config.EncryptionRequire),
+			[]config.Entity{withoutKey("b@example.com", config.EncryptionRequire), withoutKey("c@example.com", "")},
+			[]string{"a@example.com"},
+			[]string{"c@example.com"},
+			false,
+		},
+		{
+			"Testing never",
+			PGPEncrypt,
+			withKey("a@example.com", config.EncryptionNever),
+			[]config.Entity{withKey("b@example.com", "")},
+			[]string{"b@example.com"},
+			[]string{"a@example.com"},
+			false,
+		},
+		{
+			"Testing require in sign mode",
+			PGPSign,
+			withKey("a@example.com", config.EncryptionRequire),
+			[]config.Entity{withKey("b@example.com", "")},
+			nil,
+			[]string{"b@example.com"},
+			false,
+		},
+		{
+			"Testing all recipients skipped",
+			PGPEncrypt,
+			withoutKey("a@example.com", config.EncryptionRequire),
+			nil,
+			nil,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &recordingStrategy{}
+			email := NewEmail(strategy).
+				SetPGPBackend(&fakePGPBackend{
+					hash:       crypto.SHA256,
+					publicKeys: []string{"a@example.com", "b@example.com", "c@example.com"},
+				}).
+				SetPGPMode(tt.mode).
+				SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+				SetRecipient(tt.recipient).
+				SetCc(tt.cc).
+				SetSubject("Testing Send").
+				SetTextMessage("Testing Send")
+			if _, err := email.InitStrategy(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := email.Send()
+			if (err != nil) != tt.err {
+				t.Fatalf("Send() error = %v, want error %t", err, tt.err)
+			}
+
+			// each group must receive its own copy
+			var encrypted, plain []string
+			for i, payload := range strategy.payloads {
+				recipients := strategy.envelopes[i].Recipients()
+				if strings.HasPrefix(string(payload), "Content-Type: multipart/encrypted;") {
+					encrypted = append(encrypted, recipients...)
+				} else {
+					plain = append(plain, recipients...)
+				}
+			}
+			if strings.Join(encrypted, ",") != strings.Join(tt.encrypted, ",") {
+				t.Errorf("Encrypted copy sent to %v, want %v", encrypted, tt.encrypted)
+			}
+			if strings.Join(plain, ",") != strings.Join(tt.plain, ",") {
+				t.Errorf("Plain copy sent to %v, want %v", plain, tt.plain)
+			}
+		})
+	}
+}
+
+func TestSendBcc(t *testing.T) {
+	strategy := &recordingStrategy{}
+	email := NewEmail(strategy).
+		SetPGPBackend(&fakePGPBackend{hash: crypto.SHA256, publicKeys: []string{"a@example.com", "c@example.com"}}).
+		SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+		SetRecipient(config.NewEntity("a@example.com")).
+		SetCc([]config.Entity{config.NewEntity("b@example.com")}).
+		SetBcc([]config.Entity{config.NewEntity("c@example.com"), config.NewEntity("d@example.com")}).
+		SetSubject("Testing Bcc").
+		SetTextMessage("Testing Bcc")
+	if _, err := email.InitStrategy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := email.Send(); err != nil {
+		t.Fatal("Couldn't send email", err)
+	}
+
+	// Bcc recipients with a known key receive their own encrypted copy
+	expected := []Envelope{
+		{From: "bg@benjaminguzman.dev", To: []string{"a@example.com"}},
+		{From: "bg@benjaminguzman.dev", Bcc: []string{"c@example.com"}},
+		{From: "bg@benjaminguzman.dev", To: []string{"b@example.com"}, Bcc: []string{"d@example.com"}},
+	}
+	if len(strategy.envelopes) != len(expected) {
+		t.Fatalf("%d copies were sent, expected %d. Envelopes: %+v", len(strategy.envelopes), len(expected), strategy.envelopes)
+	}
+	for i, envelope := range strategy.envelopes {
+		if fmt.Sprint(envelope) != fmt.Sprint(expected[i]) {
+			t.Errorf("Envelope of copy %d is %+v, expected %+v", i, envelope, expected[i])
+		}
+		if payload := string(strategy.payloads[i]); strings.Contains(payload, "c@example.com") || strings.Contains(payload, "d@example.com") {
+			t.Errorf("Bcc recipients are in the payload of copy %d: %s", i, payload)
+		}
+	}
+	if !strings.Contains(string(strategy.payloads[1]), "To: undisclosed-recipients:;\r\n") {
+		t.Errorf("Payload of the Bcc copy doesn't have an empty To group. Payload: %s", strategy.payloads[1])
+	}
+}
+
+func TestLoginPlaceholdersEscaping(t *testing.T) {
+	event := &pam.LoginEvent{User: "root", RemoteUser: "x\r\nBcc: spy@example.com", RemoteHost: "<script>alert(1)</script>"}
+	email := NewEmail(&recordingStrategy{}).
+		SetLoginEvent(event).
+		SetSubject("Login by %R from %r").
+		SetTextMessage("Login by %R from %r").
+		SetHtmlMessage("<p>Login by <b>%u</b> from %r</p>")
+
+	if subject := email.Subject(); subject != "Login by x Bcc: spy@example.com from <script>alert(1)</script>" {
+		t.Errorf("Subject is %q", subject)
+	}
+	if text := email.TextMessage(); text != "Login by x\r\nBcc: spy@example.com from <script>alert(1)</script>" {
+		t.Errorf("Text message is %q", text)
+	}
+	if html := email.HtmlMessage(); html != "<p>Login by <b>root</b> from &lt;script&gt;alert(1)&lt;/script&gt;</p>" {
+		t.Errorf("HTML message is %q", html)
+	}
+}
+
+func TestFilePlaceholderContents(t *testing.T) {
+	// e.g. a banner or log excerpt that happens to contain placeholders
+	file := filepath.Join(t.TempDir(), "contents.txt")
+	if err := os.WriteFile(file, []byte("%u %r %s %f/etc/shadowf% %t2006t%"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	event := &pam.LoginEvent{User: "root", RemoteHost: "192.168.1.10", Service: "sshd"}
+	email := NewEmail(&recordingStrategy{}).
+		SetLoginEvent(event).
+		SetTextMessage("Login by %u: %f" + file + "f%")
+
+	if text := email.TextMessage(); text != "Login by root: %u %r %s %f/etc/shadowf% %t2006t%" {
+		t.Errorf("Text message is %q", text)
+	}
+}
+
+func TestLoginTimePlaceholders(t *testing.T) {
+	// e.g. an event handled by the daemon long after the login
+	event := &pam.LoginEvent{User: "root", Time: time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)}
+	email := NewEmail(&recordingStrategy{}).
+		SetLoginEvent(event).
+		SetSubject("Login at %t2006-01-02 15:04:05t%")
+
+	if subject := email.Subject(); subject != "Login at 2020-01-02 03:04:05" {
+		t.Errorf("Subject is %q", subject)
+	}
+}
+
+func TestCreatePGPPayloadProtectedHeaders(t *testing.T) {
+	tests := []struct {
+		name             string
+		protectedSubject string
+		expected         string // outer subject
+	}{
+		{"Testing default protected subject", "", DefaultProtectedSubject},
+		{"Testing custom protected subject", "Login alert", "Login alert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &pgpPayloadRecorder{fakePGPBackend: fakePGPBackend{hash: crypto.SHA256, noPrivateKey: true}}
+			email := NewEmail(nil).
+				SetPGPBackend(backend).
+				SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+				SetRecipient(config.NewEntity("benja@kobd.io")).
+				SetCc([]config.Entity{config.NewEntity("sysadmin@benjaminguzman.dev")}).
+				SetSubject("New login on server").
+				SetProtectedSubject(tt.protectedSubject).
+				SetTextMessage("Testing protected headers")
+
+			payload, err := email.CreatePGPPayload()
+			if err != nil {
+				t.Fatal("Couldn't create PGP payload", err)
+			}
+
+			if !strings.Contains(string(payload), "\r\nSubject: "+tt.expected+"\r\n") {
+				t.Errorf("Outer subject is not %q. Payload: %s", tt.expected, payload)
+			}
+			if strings.Contains(string(payload), "New login on server") {
+				t.Errorf("Real subject is not encrypted. Payload: %s", payload)
+			}
+
+			encrypted := string(backend.encrypted)
+			if !strings.HasPrefix(encrypted, "Content-Type: multipart/mixed;") || !strings.Contains(encrypted, "protected-headers=\"v1\"") {
+				t.Errorf("Encrypted payload is not marked as having protected headers. Payload: %s", encrypted)
+			}
+			for _, header := range []string{
+				"From: bg@benjaminguzman.dev",
+				"To: benja@kobd.io",
+				"Subject: New login on server",
+				"Cc: sysadmin@benjaminguzman.dev",
+			} {
+				if !strings.Contains(encrypted, "\r\n"+header+"\r\n") {
+					t.Errorf("Encrypted payload doesn't contain header %q. Payload: %s", header, encrypted)
+				}
+			}
+		})
+	}
+}
+
+func TestSendUnusableKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyInfo *pgp.KeyInfo
+	}{
+		{"Testing expired key", &pgp.KeyInfo{Expires: time.Now().Add(-time.Hour), CanEncrypt: true, CanSign: true}},
+		{"Testing revoked key", &pgp.KeyInfo{Revoked: true, CanEncrypt: true, CanSign: true}},
+		{"Testing key that can't encrypt nor sign", &pgp.KeyInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &recordingStrategy{}
+			email := NewEmail(strategy).
+				SetPGPBackend(&fakePGPBackend{hash: crypto.SHA256, keyInfo: tt.keyInfo}).
+				SetPGPMode(PGPEncryptOrSign).
+				SetSender(config.NewEntity("bg@benjaminguzman.dev")).
+				SetRecipient(config.NewEntity("benja@kobd.io")).
+				SetSubject("Testing Send").
+				SetTextMessage("Testing Send")
+			if _, err := email.InitStrategy(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := email.Send(); err != nil {
+				t.Fatal("Couldn't send email", err)
+			}
+			if len(strategy.payloads) != 1 || !strings.HasPrefix(string(strategy.payloads[0]), "Content-Type: multipart/mixed;") {
+				t.Errorf("Expected a single plain payload. Payloads: %q", strategy.payloads)
+			}
+		})
+	}
+}
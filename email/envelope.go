@@ -0,0 +1,92 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+)
+
+// Envelope SMTP envelope of an email, i.e. who the payload is delivered to, regardless of its headers
+type Envelope struct {
+	From string   // reverse-path (MAIL FROM)
+	To   []string // recipients in the To and Cc headers
+	Bcc  []string // recipients that are not in the headers
+}
+
+// Recipients returns all the recipients of the envelope (RCPT TO), including Bcc
+func (e Envelope) Recipients() []string {
+	recipients := make([]string, 0, len(e.To)+len(e.Bcc))
+	recipients = append(recipients, e.To...)
+	return append(recipients, e.Bcc...)
+}
+
+// only returns the envelope with only the given recipients (which remain in To or Bcc)
+func (e Envelope) only(recipients []string) Envelope {
+	keep := make(map[string]bool, len(recipients))
+	for _, recipient := range recipients {
+		keep[recipient] = true
+	}
+	filtered := Envelope{From: e.From}
+	for _, recipient := range e.To {
+		if keep[recipient] {
+			filtered.To = append(filtered.To, recipient)
+		}
+	}
+	for _, recipient := range e.Bcc {
+		if keep[recipient] {
+			filtered.Bcc = append(filtered.Bcc, recipient)
+		}
+	}
+	return filtered
+}
+
+// PartialDeliveryError error returned by strategies that delivered the email to some of the recipients only
+// (e.g. in DeliveryMX mode, if the MX hosts of some domains failed). Only the Remaining envelope must be retried,
+// otherwise the other recipients receive the email again
+type PartialDeliveryError struct {
+	Remaining Envelope // envelope with the recipients the email wasn't delivered to
+	Err       error
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialDeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// RemainingEnvelope returns the envelope that must be retried after sending failed with err, i.e. the remaining
+// envelope of a PartialDeliveryError or the given envelope for any other error
+func RemainingEnvelope(envelope Envelope, err error) Envelope {
+	var partialErr *PartialDeliveryError
+	if errors.As(err, &partialErr) {
+		return partialErr.Remaining
+	}
+	return envelope
+}
+
+// ParseEnvelope creates the envelope from the To and Cc headers of the payload.
+// It should only be used for payloads whose envelope is not known, e.g. spool entries written by older versions
+func ParseEnvelope(payload []byte, sender string) (Envelope, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(payload))
+	if err != nil {
+		return Envelope{}, fmt.Errorf("couldn't parse payload headers. %w", err)
+	}
+
+	envelope := Envelope{From: sender}
+	for _, header := range []string{"To", "Cc"} {
+		addresses, err := msg.Header.AddressList(header)
+		if errors.Is(err, mail.ErrHeaderNotPresent) {
+			continue
+		}
+		if err != nil {
+			return Envelope{}, fmt.Errorf("couldn't parse %s header. %w", header, err)
+		}
+		for _, address := range addresses {
+			envelope.To = append(envelope.To, address.Address)
+		}
+	}
+	return envelope, nil
+}
@@ -0,0 +1,49 @@
+package email
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected []string // nil if parsing must fail
+	}{
+		{
+			"Testing To and Cc",
+			"From: sender@example.com\r\nTo: a@example.com\r\nCc: b@example.com, Carol <c@example.com>\r\n\r\nbody\r\n",
+			[]string{"a@example.com", "b@example.com", "c@example.com"},
+		},
+		{
+			"Testing folded header",
+			"To: a@example.com,\r\n b@example.com\r\nSubject: Testing\r\n\r\nTo: attacker@example.com\r\n",
+			[]string{"a@example.com", "b@example.com"},
+		},
+		{
+			"Testing empty group",
+			"To: undisclosed-recipients:;\r\n\r\nbody\r\n",
+			[]string{},
+		},
+		{
+			"Testing invalid address",
+			"To: a@example.com <\r\n\r\nbody\r\n",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := ParseEnvelope([]byte(tt.payload), "sender@example.com")
+			if (err != nil) != (tt.expected == nil) {
+				t.Fatalf("ParseEnvelope() error = %v, want error %t", err, tt.expected == nil)
+			}
+			if tt.expected == nil {
+				return
+			}
+			if envelope.From != "sender@example.com" || fmt.Sprint(envelope.To) != fmt.Sprint(tt.expected) || len(envelope.Bcc) != 0 {
+				t.Errorf("Envelope is %+v, expected recipients %v", envelope, tt.expected)
+			}
+		})
+	}
+}
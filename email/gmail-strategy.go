@@ -3,14 +3,13 @@ package email
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
-	"io/ioutil"
 	"os"
+	"strings"
 )
 
 type GmailOAuth2Strategy struct {
@@ -25,36 +24,10 @@ func (s *GmailOAuth2Strategy) Init(params ...interface{}) (interface{}, error) {
 	configFilepath := fmt.Sprint(params[0])
 	tokenFilepath := fmt.Sprint(params[1])
 
-	// read config
-	configFile, err := os.Open(configFilepath)
+	tokenSource, err := newOAuth2TokenSource(configFilepath, tokenFilepath, gmail.GmailSendScope)
 	if err != nil {
-		return nil, fmt.Errorf("error reading Gmail Oauth 2 config: %w", err)
+		return nil, fmt.Errorf("error initiating Gmail Oauth 2 client. %w", err)
 	}
-	defer configFile.Close()
-
-	b, err := ioutil.ReadAll(configFile)
-	if err != nil {
-		return nil, fmt.Errorf("error reading Gmail Oauth 2 config: %w", err)
-	}
-	config, err := google.ConfigFromJSON(b, gmail.GmailSendScope)
-	if err != nil {
-		return nil, fmt.Errorf("error reading Gmail Oauth 2 config: %w", err)
-	}
-
-	// read token
-	tokenFile, err := os.Open(tokenFilepath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading Gmail Oauth 2 token: %w", err)
-	}
-	defer tokenFile.Close()
-
-	token := oauth2.Token{}
-	err = json.NewDecoder(tokenFile).Decode(&token)
-	if err != nil {
-		return nil, fmt.Errorf("error while parsing Gmail Oauth 2 token: %w", err)
-	}
-
-	tokenSource := config.TokenSource(context.Background(), &token)
 
 	service, err := gmail.NewService(context.Background(), option.WithTokenSource(tokenSource))
 	if err != nil {
@@ -66,12 +39,13 @@ func (s *GmailOAuth2Strategy) Init(params ...interface{}) (interface{}, error) {
 }
 
 // SendEmail sends the email with the gmail api. Returns nothing but an error, if any.
-func (s *GmailOAuth2Strategy) SendEmail(payload []byte, sender string) (interface{}, error) {
+// Gmail takes the recipients from the headers, so Bcc recipients are given in a Bcc header (Gmail removes it)
+func (s *GmailOAuth2Strategy) SendEmail(payload []byte, envelope Envelope) (interface{}, error) {
 	var msg gmail.Message
-	msg.Raw = base64.StdEncoding.EncodeToString(payload)
+	msg.Raw = base64.StdEncoding.EncodeToString(withBccHeader(payload, envelope.Bcc))
 	//str, _ := base64.StdEncoding.DecodeString(msg.Raw)
 	//fmt.Println(string(str))
-	call := s.gmailService.Users.Messages.Send(sender, &msg)
+	call := s.gmailService.Users.Messages.Send(envelope.From, &msg)
 	if _, err := call.Do(); err != nil {
 		return nil, fmt.Errorf("couldn't send email: %w", err)
 	}
@@ -80,37 +54,67 @@ func (s *GmailOAuth2Strategy) SendEmail(payload []byte, sender string) (interfac
 
 type GmailServiceAccountStrategy struct {
 	gmailService *gmail.Service
+	endpoint     string // Gmail API endpoint. If empty, the default one
 }
 
-// Init initiates a new gmail.Service (required by other methods)
-// 1st param: path to credentials file
+// Init initiates a new gmail.Service (required by other methods) that sends emails as the given user through
+// domain-wide delegation, i.e. the service account impersonates the user. The service account's client id must be
+// authorized for the gmail.send scope in the Google Workspace admin console
+// 1st param: path to the service account credentials file (JSON key)
+// 2nd param: email of the user to impersonate (the sender)
 // Returns nothing
-// THIS DOESN'T WORK YET. Issues associated: https://github.com/googleapis/google-api-go-client/issues/645
 func (s *GmailServiceAccountStrategy) Init(params ...interface{}) (interface{}, error) {
-	b, _ := os.ReadFile(fmt.Sprint(params[0]))
-	config, err := google.JWTConfigFromJSON(b, gmail.GmailSendScope)
-	service, err := gmail.NewService(
-		context.Background(),
-		option.WithHTTPClient(config.Client(context.Background())),
-		//option.WithCredentialsFile(fmt.Print(params[0])), // this won't work either
-		//option.WithScopes(gmail.GmailSendScope),
-	)
+	if len(params) < 2 {
+		return nil, errors.New("credentials file and user to impersonate are required")
+	}
+	credentialsFile := fmt.Sprint(params[0])
+	subject := fmt.Sprint(params[1])
+	if subject == "" {
+		return nil, errors.New("user to impersonate is required")
+	}
+
+	b, err := os.ReadFile(credentialsFile)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error reading service account credentials: %w", err)
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(b, gmail.GmailSendScope)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing service account credentials: %w", err)
+	}
+	jwtConfig.Subject = subject
+
+	ctx := context.Background()
+	options := []option.ClientOption{option.WithTokenSource(jwtConfig.TokenSource(ctx))}
+	if s.endpoint != "" {
+		options = append(options, option.WithEndpoint(s.endpoint))
+	}
+	service, err := gmail.NewService(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start Gmail service account client: %w", err)
 	}
 	s.gmailService = service
 
 	return nil, nil
 }
 
-func (s *GmailServiceAccountStrategy) SendEmail(payload []byte, sender string) (interface{}, error) {
+// SendEmail sends the email with the gmail api as the impersonated user. Returns nothing but an error, if any.
+// Gmail takes the recipients from the headers, so Bcc recipients are given in a Bcc header (Gmail removes it)
+func (s *GmailServiceAccountStrategy) SendEmail(payload []byte, envelope Envelope) (interface{}, error) {
 	var msg gmail.Message
-	msg.Raw = base64.StdEncoding.EncodeToString(payload)
+	msg.Raw = base64.StdEncoding.EncodeToString(withBccHeader(payload, envelope.Bcc))
 	//str, _ := base64.StdEncoding.DecodeString(msg.Raw)
 	//fmt.Println(string(str))
-	call := s.gmailService.Users.Messages.Send(sender, &msg)
+	call := s.gmailService.Users.Messages.Send("me", &msg) // "me" is the impersonated user
 	if _, err := call.Do(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("couldn't send email: %w", err)
 	}
 	return nil, nil
 }
+
+// withBccHeader returns the payload with a Bcc header containing the given recipients (if any)
+func withBccHeader(payload []byte, bcc []string) []byte {
+	if len(bcc) == 0 {
+		return payload
+	}
+	return append([]byte("Bcc: "+strings.Join(bcc, ",")+"\r\n"), payload...)
+}
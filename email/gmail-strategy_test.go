@@ -1,8 +1,24 @@
 package email
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
+	"fmt"
+	"google.golang.org/api/gmail/v1"
 	"login-monitor/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -55,6 +71,190 @@ func TestOAuth2PGP(t *testing.T) {
 	}
 }
 
-func TestServiceAccount(t *testing.T) {
-	return // Service account doesn't work yet
+// fakeGoogleServer fake OAuth 2 token endpoint (JWT bearer grant) and Gmail API that records the messages sent
+type fakeGoogleServer struct {
+	*httptest.Server
+	t           *testing.T
+	key         *rsa.PublicKey // key the JWT assertions must be signed with
+	clientEmail string
+	denied      string // user the service account is not allowed to impersonate
+
+	mutex    sync.Mutex
+	messages []string
+}
+
+const fakeServiceAccountToken = "service-account-token"
+
+func newFakeGoogleServer(t *testing.T, key *rsa.PublicKey, clientEmail, denied string) *fakeGoogleServer {
+	s := &fakeGoogleServer{t: t, key: key, clientEmail: clientEmail, denied: denied}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/gmail/v1/users/me/messages/send", s.send)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeGoogleServer) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		s.t.Errorf("Unexpected grant type %s", r.FormValue("grant_type"))
+	}
+
+	// verify the JWT assertion
+	parts := strings.Split(r.FormValue("assertion"), ".")
+	if len(parts) != 3 {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(s.key, crypto.SHA256, hash[:], signature); err != nil {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	claims := map[string]interface{}{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	_ = json.Unmarshal(payload, &claims)
+	if claims["iss"] != s.clientEmail || claims["scope"] != gmail.GmailSendScope {
+		s.t.Errorf("Unexpected JWT claims %v", claims)
+	}
+	if claims["sub"] == s.denied {
+		http.Error(w, `{"error": "unauthorized_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"access_token": "%s", "token_type": "Bearer", "expires_in": 3600}`, fakeServiceAccountToken)
+}
+
+func (s *fakeGoogleServer) send(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeServiceAccountToken {
+		http.Error(w, `{"error": {"code": 401}}`, http.StatusUnauthorized)
+		return
+	}
+	msg := gmail.Message{}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, `{"error": {"code": 400}}`, http.StatusBadRequest)
+		return
+	}
+	raw, _ := base64.StdEncoding.DecodeString(msg.Raw)
+	s.mutex.Lock()
+	s.messages = append(s.messages, string(raw))
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"id": "1"}`))
+}
+
+// writeServiceAccountFile writes a service account credentials file whose token endpoint is tokenURI
+func writeServiceAccountFile(t *testing.T, dir string, key *rsa.PrivateKey, clientEmail, tokenURI string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "login-monitor",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   clientEmail,
+		"client_id":      "1",
+		"token_uri":      tokenURI,
+	})
+	path := filepath.Join(dir, "service-account.json")
+	if err = os.WriteFile(path, credentials, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGmailServiceAccountStrategy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const clientEmail = "login-monitor@login-monitor.iam.gserviceaccount.com"
+	server := newFakeGoogleServer(t, &key.PublicKey, clientEmail, "denied@example.com")
+	credentialsFile := writeServiceAccountFile(t, t.TempDir(), key, clientEmail, server.URL+"/token")
+
+	tests := []struct {
+		name     string
+		subject  string
+		envelope Envelope
+		expected string // prefix of the message received by Gmail. Empty if sending must fail
+	}{
+		{
+			"Testing impersonation",
+			"alerts@example.com",
+			Envelope{From: "alerts@example.com", To: []string{"a@example.com"}},
+			"Subject: Testing service account",
+		},
+		{
+			"Testing Bcc",
+			"alerts@example.com",
+			Envelope{From: "alerts@example.com", To: []string{"a@example.com"}, Bcc: []string{"b@example.com", "c@example.com"}},
+			"Bcc: b@example.com,c@example.com\r\nSubject: Testing service account",
+		},
+		{
+			"Testing impersonation not allowed",
+			"denied@example.com",
+			Envelope{From: "denied@example.com", To: []string{"a@example.com"}},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.mutex.Lock()
+			server.messages = nil
+			server.mutex.Unlock()
+
+			strategy := &GmailServiceAccountStrategy{endpoint: server.URL + "/"}
+			if _, err := strategy.Init(credentialsFile, tt.subject); err != nil {
+				t.Fatal("Couldn't initiate Gmail service account strategy", err)
+			}
+
+			payload := []byte("Subject: Testing service account\r\n\r\nTesting service account\r\n")
+			_, err := strategy.SendEmail(payload, tt.envelope)
+			if (err != nil) != (tt.expected == "") {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.expected == "")
+			}
+
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			if tt.expected == "" {
+				if len(server.messages) != 0 {
+					t.Errorf("Message was sent even though SendEmail failed")
+				}
+				return
+			}
+			if len(server.messages) != 1 || !strings.HasPrefix(server.messages[0], tt.expected) {
+				t.Errorf("Gmail received %q, expected a message starting with %q", server.messages, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGmailServiceAccountStrategyInitErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"type": "service_account"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params []interface{}
+	}{
+		{"Testing missing params", []interface{}{invalid}},
+		{"Testing missing user", []interface{}{invalid, ""}},
+		{"Testing missing credentials", []interface{}{filepath.Join(dir, "nonexistent.json"), "alerts@example.com"}},
+		{"Testing invalid credentials", []interface{}{invalid, "alerts@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := (&GmailServiceAccountStrategy{}).Init(tt.params...); err == nil {
+				t.Error("Init() should fail")
+			}
+		})
+	}
 }
@@ -1,123 +1,431 @@
 package email
 
 import (
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	log "github.com/sirupsen/logrus"
+	"login-monitor/config"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
 	"strings"
+	"time"
+)
+
+// TLS modes for the connection to the SMTP server (see config.TLSConfig)
+const (
+	TLSNone             = "none"              // never use TLS
+	TLSStartTLS         = "starttls"          // use STARTTLS if the server supports it
+	TLSStartTLSRequired = "starttls-required" // use STARTTLS, fail if the server doesn't support it
+	TLSImplicit         = "tls"               // connect with TLS (e.g. port 465)
+)
+
+// Delivery modes (see config.GoSMTPConfig)
+const (
+	DeliveryRelay = "relay" // submit emails to the relays
+	DeliveryMX    = "mx"    // deliver emails directly to the MX hosts of the recipients' domains
+)
+
+// Default timeouts of the relays (see config.GoSMTPConfig). They're short because the login waits for the email
+// unless the daemon is used
+const (
+	DefaultSMTPConnectTimeout = 10 * time.Second
+	DefaultSMTPCommandTimeout = 20 * time.Second
 )
 
 type GoSMTPStrategy struct {
-	auth    smtp.Auth
-	address string
+	credentials *smtpCredentials // nil if no username was given
+	relays      []*smtpRelay     // tried in order until one accepts the message. Empty in DeliveryMX mode
+	mx          *mxDelivery      // settings to connect to MX hosts. nil in DeliveryRelay mode
+	resolver    MXResolver       // resolves MX records in DeliveryMX mode. If nil, net.DefaultResolver
+	dkim        *DKIMSigner      // nil if messages are not DKIM-signed
+}
+
+// smtpRelay SMTP server the message can be submitted to
+type smtpRelay struct {
+	host           string
+	address        string
+	tlsMode        string
+	tlsConfig      *tls.Config
+	connectTimeout time.Duration
+	commandTimeout time.Duration // timeout of each read or write, i.e. the server must reply to each command in time
+	heloName       string        // name sent in EHLO/HELO
 }
 
-// Init initiates a new gmail.Service (required by other methods)
+// Init initiates the strategy (required by other methods)
+// 1st param: go-smtp config (*config.GoSMTPConfig)
+//
+// Alternatively, the config can be given as separate params:
 // 1st param: identity
 // 2nd param: username
 // 3rd param: password
 // 4th param: host
 // 5th param: port
+// 6th param (optional): DKIM config (*config.DKIMConfig). If nil, messages are not DKIM-signed
 // See smtp.PlainAuth for more information about the parameters
 // Returns nothing
 func (s *GoSMTPStrategy) Init(params ...interface{}) (interface{}, error) {
-	identity := fmt.Sprint(params[0])
-	username := fmt.Sprint(params[1])
-	password := fmt.Sprint(params[2])
-	host := fmt.Sprint(params[3])
-	port := fmt.Sprint(params[4])
+	c, ok := params[0].(*config.GoSMTPConfig)
+	if !ok {
+		c = &config.GoSMTPConfig{
+			Identity: fmt.Sprint(params[0]),
+			Username: fmt.Sprint(params[1]),
+			Password: fmt.Sprint(params[2]),
+			Host:     fmt.Sprint(params[3]),
+			Port:     fmt.Sprint(params[4]),
+		}
+		if len(params) > 5 {
+			c.DKIM, _ = params[5].(*config.DKIMConfig)
+		}
+	}
+
+	credentials, err := newSMTPCredentials(c)
+	if err != nil {
+		return nil, err
+	}
+	s.credentials = credentials
 
-	s.auth = smtp.PlainAuth(identity, username, password, host)
-	s.address = host + ":" + port
+	s.relays, s.mx = nil, nil
+	switch c.Delivery {
+	case "", DeliveryRelay:
+		s.relays, err = newSMTPRelays(c)
+	case DeliveryMX:
+		s.mx, err = newMXDelivery(c)
+	default:
+		err = fmt.Errorf("invalid delivery mode '%s'", c.Delivery)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.dkim = nil
+	if c.DKIM != nil {
+		signer, err := NewDKIMSigner(c.DKIM)
+		if err != nil {
+			return nil, fmt.Errorf("error while initiating DKIM signer. %w", err)
+		}
+		s.dkim = signer
+	}
 
 	return nil, nil
 }
 
-// SendEmail sends the email with the gmail api. Returns nothing but an error, if any.
-func (s *GoSMTPStrategy) SendEmail(payload []byte, sender string) (interface{}, error) {
-	to := extractCc(payload)
-	to = append(to, extractRecipient(payload))
+// newSMTPCredentials creates the credentials to authenticate to the SMTP server. nil is returned if no username was given
+func newSMTPCredentials(c *config.GoSMTPConfig) (*smtpCredentials, error) {
+	if c.Username == "" {
+		return nil, nil
+	}
 
-	err := smtp.SendMail(s.address, s.auth, sender, to, payload)
-	if err != nil {
-		if strings.Contains(err.Error(), "smtp: server doesn't support AUTH") {
-			return s.sendMailNoAuth(payload, sender, to...)
+	credentials := &smtpCredentials{identity: c.Identity, username: c.Username, password: c.Password}
+	if c.OAuth2 != nil {
+		tokenSource, err := newOAuth2TokenSource(c.OAuth2.CredentialsFile, c.OAuth2.TokenFile, GmailSMTPScope)
+		if err != nil {
+			return nil, err
+		}
+		credentials.tokenSource = tokenSource
+	}
+
+	for _, mechanism := range c.AuthMechanisms {
+		mechanism = strings.ToUpper(strings.TrimSpace(mechanism))
+		if !validAuthMechanism(mechanism) {
+			return nil, fmt.Errorf("invalid auth mechanism '%s'", mechanism)
+		}
+		if mechanism == AuthXOAuth2 && credentials.tokenSource == nil {
+			return nil, errors.New("XOAUTH2 auth mechanism requires an Oauth 2 token")
+		}
+		credentials.mechanisms = append(credentials.mechanisms, mechanism)
+	}
+	if len(credentials.mechanisms) == 0 {
+		credentials.mechanisms = DefaultAuthMechanisms
+		if credentials.tokenSource != nil {
+			credentials.mechanisms = []string{AuthXOAuth2}
+		}
+	}
+	return credentials, nil
+}
+
+// newSMTPRelays creates the relays in c.Relays or, if there are none, the relay for c.Host and c.Port
+func newSMTPRelays(c *config.GoSMTPConfig) ([]*smtpRelay, error) {
+	relayConfigs := c.Relays
+	if len(relayConfigs) == 0 {
+		relayConfigs = []config.RelayConfig{{Host: c.Host, Port: c.Port}}
+	}
+
+	relays := make([]*smtpRelay, 0, len(relayConfigs))
+	for _, relayConfig := range relayConfigs {
+		relay, err := newSMTPRelay(relayConfig, c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %s. %w", net.JoinHostPort(relayConfig.Host, relayConfig.Port), err)
+		}
+		relays = append(relays, relay)
+	}
+	return relays, nil
+}
+
+// newSMTPRelay creates the relay from its config. TLS and timeouts not given in the relay config are taken from c
+func newSMTPRelay(r config.RelayConfig, c *config.GoSMTPConfig) (*smtpRelay, error) {
+	if r.Host == "" {
+		return nil, errors.New("relay host is required")
+	}
+	if r.Port == "" {
+		r.Port = "25"
+	}
+	relay := &smtpRelay{host: r.Host, address: net.JoinHostPort(r.Host, r.Port), heloName: heloName(c)}
+
+	tlsConfig := c.TLS
+	if r.TLS != nil {
+		tlsConfig = *r.TLS
+	}
+	relay.tlsMode = tlsConfig.Mode
+	if relay.tlsMode == "" {
+		relay.tlsMode = TLSStartTLS
+		if r.Port == "465" {
+			relay.tlsMode = TLSImplicit
 		}
+	}
+	switch relay.tlsMode {
+	case TLSNone, TLSStartTLS, TLSStartTLSRequired, TLSImplicit:
+	default:
+		return nil, fmt.Errorf("invalid TLS mode '%s'", relay.tlsMode)
+	}
+	var err error
+	if relay.tlsConfig, err = newTLSConfig(tlsConfig, r.Host); err != nil {
 		return nil, err
 	}
-	return nil, nil
+
+	if relay.connectTimeout, err = parseTimeout(r.ConnectTimeout, c.ConnectTimeout, DefaultSMTPConnectTimeout); err != nil {
+		return nil, fmt.Errorf("invalid connect timeout. %w", err)
+	}
+	if relay.commandTimeout, err = parseTimeout(r.CommandTimeout, c.CommandTimeout, DefaultSMTPCommandTimeout); err != nil {
+		return nil, fmt.Errorf("invalid command timeout. %w", err)
+	}
+	return relay, nil
+}
+
+// heloName returns the name the client sends in EHLO/HELO: c.HeloName or the hostname.
+// If the hostname is unknown, localhost is returned
+func heloName(c *config.GoSMTPConfig) string {
+	if c.HeloName != "" {
+		return c.HeloName
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "localhost"
+}
+
+// parseTimeout parses the first non-empty timeout. If both are empty, def is returned
+func parseTimeout(timeout, fallback string, def time.Duration) (time.Duration, error) {
+	if timeout == "" {
+		timeout = fallback
+	}
+	if timeout == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err == nil && d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, got %s", timeout)
+	}
+	return d, err
 }
 
-func (s *GoSMTPStrategy) sendMailNoAuth(payload []byte, sender string, recipients ...string) (interface{}, error) {
-	client, err := smtp.Dial(s.address)
+// newTLSConfig creates the TLS config to connect to the given host
+func newTLSConfig(c config.TLSConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if c.ServerName != "" {
+		tlsConfig.ServerName = c.ServerName
+	}
+
+	if c.CAFile != "" {
+		caBundle, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("CA bundle %s doesn't contain any PEM-encoded certificate", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// SendEmail sends the email through the first relay that accepts it. Returns the address of that relay.
+//
+// The next relay is tried if the relay is unreachable, the TLS handshake fails, the relay times out or it replies with
+// a transient (4xx) error. Permanent (5xx) errors are returned right away, other relays would reject the email too.
+//
+// In DeliveryMX mode, the email is delivered to the MX hosts of each recipient domain instead (see GoSMTPStrategy.sendMX)
+func (s *GoSMTPStrategy) SendEmail(payload []byte, envelope Envelope) (interface{}, error) {
+	recipients := envelope.Recipients()
+	if len(recipients) == 0 {
+		return nil, errors.New("envelope has no recipients")
+	}
+
+	if s.dkim != nil {
+		signed, err := s.dkim.Sign(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = signed
+	}
+
+	if s.mx != nil {
+		return s.sendMX(payload, envelope)
+	}
+	address, err := sendThroughRelays(s.relays, payload, s.credentials, envelope.From, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+// sendThroughRelays sends the payload through the first relay that accepts it (see GoSMTPStrategy.SendEmail).
+// Returns the address of that relay
+func sendThroughRelays(relays []*smtpRelay, payload []byte, credentials *smtpCredentials, sender string, recipients ...string) (string, error) {
+	errs := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		err := relay.sendMail(payload, credentials, sender, recipients...)
+		if err == nil {
+			log.Infof("Email accepted by relay %s", relay.address)
+			return relay.address, nil
+		}
+		if !isTransientSMTPError(err) {
+			return "", fmt.Errorf("relay %s rejected the email. %w", relay.address, err)
+		}
+		log.Warnf("Couldn't send email through relay %s. %s", relay.address, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", relay.address, err))
+	}
+	return "", fmt.Errorf("couldn't send email through any relay. %s", strings.Join(errs, "; "))
+}
+
+// isTransientSMTPError tells if the email may be accepted by another relay, i.e. the error is not a permanent (5xx)
+// reply from the relay
+func isTransientSMTPError(err error) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code < 500
+	}
+	return true // connection, TLS or timeout error
+}
+
+// sendMail sends the payload to the relay according to the TLS mode.
+// The client authenticates only if credentials are given and the server supports AUTH. The auth mechanism is
+// negotiated from the mechanisms supported by the server
+func (r *smtpRelay) sendMail(payload []byte, credentials *smtpCredentials, sender string, recipients ...string) error {
+	client, err := r.dial()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't connect to %s. %w", s.address, err)
+		return fmt.Errorf("couldn't connect to %s. %w", r.address, err)
 	}
 	defer client.Close()
 
+	if r.tlsMode == TLSStartTLS || r.tlsMode == TLSStartTLSRequired {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(r.tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS with %s failed. %w", r.address, err)
+			}
+		} else if r.tlsMode == TLSStartTLSRequired {
+			return fmt.Errorf("%s doesn't support STARTTLS, but it is required", r.address)
+		} else {
+			log.Warnf("%s doesn't support STARTTLS. Sending email in cleartext", r.address)
+		}
+	}
+
+	if ok, advertised := client.Extension("AUTH"); ok && credentials != nil {
+		auth, err := credentials.negotiate(r.host, advertised)
+		if err != nil {
+			return err
+		}
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
 	if err = client.Mail(sender); err != nil {
-		return nil, err
+		return err
 	}
 	for _, rcpt := range recipients {
 		if err = client.Rcpt(rcpt); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	w, err := client.Data()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	_, err = w.Write(payload)
-	if err != nil {
-		return nil, err
+	if _, err = w.Write(payload); err != nil {
+		return err
 	}
-
 	if err = w.Close(); err != nil {
-		return nil, err
+		return err
+	}
+
+	// the message was accepted, an error now must not make the caller send it again
+	if err = client.Quit(); err != nil {
+		log.Debugf("QUIT failed on %s after the email was accepted. %s", r.address, err)
 	}
-	err = client.Quit()
-	return nil, err
+	return nil
 }
 
-func extractRecipient(payload []byte) string {
-	rcptStart := bytes.Index(payload, []byte("To:"))
-	if rcptStart == -1 {
-		return ""
+// dial connects to the relay, with TLS if the TLS mode is TLSImplicit, and greets it with EHLO/HELO
+func (r *smtpRelay) dial() (*smtp.Client, error) {
+	dialer := &net.Dialer{Timeout: r.connectTimeout}
+	rawConn, err := dialer.Dial("tcp", r.address)
+	if err != nil {
+		return nil, err
 	}
-	rcptStart += len([]byte("To:"))
 
-	var rcptEnd int
-	for i := rcptStart; i < len(payload); i++ {
-		if payload[i] == '\n' {
-			rcptEnd = i + 1
-			break
+	var conn net.Conn = &timeoutConn{Conn: rawConn, timeout: r.commandTimeout}
+	if r.tlsMode == TLSImplicit {
+		tlsConn := tls.Client(conn, r.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
 		}
+		conn = tlsConn
 	}
 
-	recipient := strings.TrimSpace(string(payload[rcptStart:rcptEnd]))
-	return recipient
+	client, err := smtp.NewClient(conn, r.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// otherwise, net/smtp sends EHLO localhost, which many servers penalize
+	if err = client.Hello(r.heloName); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
 }
 
-func extractCc(payload []byte) []string {
-	ccStart := bytes.Index(payload, []byte("Cc:"))
-	if ccStart == -1 {
-		return []string{}
-	}
-	ccStart += len([]byte("Cc:"))
+// timeoutConn net.Conn whose reads and writes fail if they don't complete within the timeout
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
 
-	var ccEnd int
-	for i := ccStart; i < len(payload); i++ {
-		if payload[i] == '\n' {
-			ccEnd = i + 1
-			break
-		}
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
+	return c.Conn.Read(b)
+}
 
-	recipients := strings.Split(strings.TrimSpace(string(payload[ccStart:ccEnd])), ",")
-	for i, recipient := range recipients {
-		recipients[i] = strings.TrimSpace(recipient)
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
-	return recipients
+	return c.Conn.Write(b)
 }
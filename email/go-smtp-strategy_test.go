@@ -1,9 +1,30 @@
 package email
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"flag"
+	"fmt"
 	"login-monitor/config"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var sender1 = flag.String("go-smtp-sender", "sender@example.com", "Sender email")
@@ -51,3 +72,586 @@ func TestSMTPStrategyPGP(t *testing.T) {
 		t.Log("Check your email!")
 	}
 }
+
+// smtpMessage message received by fakeSMTPServer
+type smtpMessage struct {
+	helo      string // name sent in EHLO/HELO
+	from      string
+	to        []string
+	data      string // message with LF line endings
+	tls       bool   // true if the message was received over TLS
+	user      string // authenticated user. Empty if the client didn't authenticate
+	mechanism string // auth mechanism used by the client
+}
+
+// credentials accepted by fakeSMTPServer
+const (
+	fakeSMTPPassword    = "password"
+	fakeSMTPAccessToken = "access-token"
+)
+
+// fakeSMTPServer minimal SMTP server that records the messages it receives
+type fakeSMTPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config // if not nil, STARTTLS is advertised (unless implicitTLS is true)
+	implicitTLS bool        // if true, connections are TLS from the start
+	mechanisms  []string    // advertised auth mechanisms. If empty, AUTH is not advertised
+
+	mutex    sync.Mutex
+	messages []smtpMessage
+	replies  map[string]string // replies overriding the default ones (see fakeSMTPServer.SetReply)
+}
+
+// newFakeSMTPServer starts a new fakeSMTPServer on a random port. It is closed when the test finishes
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool, mechanisms ...string) *fakeSMTPServer {
+	return startFakeSMTPServer(t, "127.0.0.1:0", tlsConfig, implicitTLS, mechanisms...)
+}
+
+// startFakeSMTPServer starts a new fakeSMTPServer listening on the given address. It is closed when the test finishes
+func startFakeSMTPServer(t *testing.T, address string, tlsConfig *tls.Config, implicitTLS bool, mechanisms ...string) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal("Couldn't start SMTP server", err)
+	}
+	s := &fakeSMTPServer{listener: listener, tlsConfig: tlsConfig, implicitTLS: implicitTLS, mechanisms: mechanisms}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if implicitTLS {
+				conn = tls.Server(conn, tlsConfig)
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) Port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// SetReply sets the reply to the given command (e.g. MAIL) or to the connection (CONNECT) instead of the default one.
+// If reply is empty, the server never replies
+func (s *fakeSMTPServer) SetReply(command, reply string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.replies == nil {
+		s.replies = map[string]string{}
+	}
+	s.replies[command] = reply
+}
+
+// reply writes the reply set with fakeSMTPServer.SetReply for the command, if any. Returns false if there is none
+func (s *fakeSMTPServer) reply(text *textproto.Conn, command string) bool {
+	s.mutex.Lock()
+	reply, ok := s.replies[command]
+	s.mutex.Unlock()
+	if ok && reply != "" {
+		_ = text.PrintfLine("%s", reply)
+	}
+	return ok
+}
+
+func (s *fakeSMTPServer) Messages() []smtpMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]smtpMessage{}, s.messages...)
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	_, isTLS := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	message := smtpMessage{tls: isTLS}
+
+	if !s.reply(text, "CONNECT") {
+		_ = text.PrintfLine("220 localhost ESMTP fake")
+	}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if s.reply(text, command) {
+			continue
+		}
+		switch command {
+		case "EHLO", "HELO":
+			message.helo = strings.TrimSpace(line[len(command):])
+			extensions := []string{"localhost"}
+			if s.tlsConfig != nil && !message.tls {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if len(s.mechanisms) > 0 {
+				extensions = append(extensions, "AUTH "+strings.Join(s.mechanisms, " "))
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				_ = text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			_ = text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, text, message = tlsConn, textproto.NewConn(tlsConn), smtpMessage{tls: true}
+		case "AUTH":
+			fields := strings.Fields(line)
+			user, ok := s.authenticate(text, fields[1], fields[2:])
+			if !ok {
+				_ = text.PrintfLine("535 Authentication failed")
+				continue
+			}
+			message.user, message.mechanism = user, fields[1]
+			_ = text.PrintfLine("235 Authenticated")
+		case "MAIL":
+			message.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			_ = text.PrintfLine("250 OK")
+		case "RCPT":
+			message.to = append(message.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			_ = text.PrintfLine("250 OK")
+		case "DATA":
+			_ = text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			message.data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, message)
+			s.mutex.Unlock()
+			_ = text.PrintfLine("250 OK")
+		case "QUIT":
+			_ = text.PrintfLine("221 Bye")
+			return
+		default:
+			_ = text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// authenticate runs the given auth mechanism. initial is the initial response (if any).
+// Returns the authenticated user and whether the credentials are valid
+func (s *fakeSMTPServer) authenticate(text *textproto.Conn, mechanism string, initial []string) (string, bool) {
+	challenge := func(challenge string) string {
+		_ = text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, _ := text.ReadLine()
+		response, _ := base64.StdEncoding.DecodeString(line)
+		return string(response)
+	}
+	response := ""
+	if len(initial) > 0 {
+		decoded, _ := base64.StdEncoding.DecodeString(initial[0])
+		response = string(decoded)
+	}
+
+	switch mechanism {
+	case AuthPlain:
+		fields := strings.Split(response, "\x00")
+		return fields[1], len(fields) == 3 && fields[2] == fakeSMTPPassword
+	case AuthLogin:
+		user := challenge("Username:")
+		return user, challenge("Password:") == fakeSMTPPassword
+	case AuthCRAMMD5:
+		const nonce = "<1896.697170952@localhost>"
+		fields := strings.Fields(challenge(nonce))
+		mac := hmac.New(md5.New, []byte(fakeSMTPPassword))
+		mac.Write([]byte(nonce))
+		return fields[0], len(fields) == 2 && fields[1] == hex.EncodeToString(mac.Sum(nil))
+	case AuthXOAuth2:
+		fields := strings.Split(response, "\x01")
+		user, token := strings.TrimPrefix(fields[0], "user="), strings.TrimPrefix(fields[1], "auth=Bearer ")
+		if token != fakeSMTPAccessToken {
+			challenge(`{"status":"401","schemes":"bearer"}`)
+			return user, false
+		}
+		return user, true
+	}
+	return "", false
+}
+
+// writeServerCertificate generates a self-signed certificate for 127.0.0.1 and localhost and writes it (and its
+// private key) to dir. Returns the TLS certificate and the paths of the certificate and the key
+func writeServerCertificate(t *testing.T, dir, name string) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPath, keyPath
+}
+
+func TestGoSMTPStrategyTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, caFile, _ := writeServerCertificate(t, dir, "server")
+	_, clientCertFile, clientKeyFile := writeServerCertificate(t, dir, "client")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	clientAuthTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert}
+
+	tests := []struct {
+		name        string
+		serverTLS   *tls.Config
+		implicitTLS bool
+		tlsConfig   config.TLSConfig
+		username    string
+		err         bool
+		expectedTLS bool
+	}{
+		{"Testing none mode", serverTLS, false, config.TLSConfig{Mode: TLSNone}, "", false, false},
+		{"Testing STARTTLS", serverTLS, false, config.TLSConfig{CAFile: caFile}, "", false, true},
+		{"Testing STARTTLS not supported", nil, false, config.TLSConfig{Mode: TLSStartTLS, CAFile: caFile}, "", false, false},
+		{"Testing required STARTTLS", serverTLS, false, config.TLSConfig{Mode: TLSStartTLSRequired, CAFile: caFile}, "", false, true},
+		{"Testing required STARTTLS not supported", nil, false, config.TLSConfig{Mode: TLSStartTLSRequired, CAFile: caFile}, "", true, false},
+		{"Testing implicit TLS", serverTLS, true, config.TLSConfig{Mode: TLSImplicit, CAFile: caFile}, "", false, true},
+		{"Testing unknown CA", serverTLS, false, config.TLSConfig{Mode: TLSStartTLS}, "", true, false},
+		{"Testing server name", serverTLS, false, config.TLSConfig{CAFile: caFile, ServerName: "localhost"}, "", false, true},
+		{"Testing wrong server name", serverTLS, true, config.TLSConfig{Mode: TLSImplicit, CAFile: caFile, ServerName: "example.com"}, "", true, false},
+		{"Testing client certificate", clientAuthTLS, false, config.TLSConfig{CAFile: caFile, CertFile: clientCertFile, KeyFile: clientKeyFile}, "", false, true},
+		{"Testing missing client certificate", clientAuthTLS, false, config.TLSConfig{CAFile: caFile}, "", true, false},
+		{"Testing authentication over TLS", serverTLS, false, config.TLSConfig{CAFile: caFile}, "user", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, tt.serverTLS, tt.implicitTLS, AuthPlain)
+			strategy := &GoSMTPStrategy{}
+			_, err := strategy.Init(&config.GoSMTPConfig{
+				Username: tt.username,
+				Password: fakeSMTPPassword,
+				Host:     "127.0.0.1",
+				Port:     server.Port(),
+				TLS:      tt.tlsConfig,
+			})
+			if err != nil {
+				t.Fatal("Couldn't initiate Go SMTP strategy", err)
+			}
+
+			payload := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Testing TLS\r\n\r\nTesting TLS\r\n")
+			_, err = strategy.SendEmail(payload, Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}})
+			if (err != nil) != tt.err {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.err)
+			}
+
+			messages := server.Messages()
+			if tt.err {
+				if len(messages) != 0 {
+					t.Errorf("Message was sent even though SendEmail failed")
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Fatalf("%d messages were received, expected 1", len(messages))
+			}
+			message := messages[0]
+			if message.tls != tt.expectedTLS {
+				t.Errorf("Message received over TLS = %t, expected %t", message.tls, tt.expectedTLS)
+			}
+			if message.user != tt.username {
+				t.Errorf("Authenticated user is %q, expected %q", message.user, tt.username)
+			}
+			if message.from != "sender@example.com" || strings.Join(message.to, ",") != "recipient@example.com" {
+				t.Errorf("Message envelope is %s -> %v", message.from, message.to)
+			}
+			if expected := strings.ReplaceAll(string(payload), "\r\n", "\n"); message.data != expected {
+				t.Errorf("Message is %q, expected %q", message.data, expected)
+			}
+		})
+	}
+}
+
+func TestGoSMTPStrategyEnvelope(t *testing.T) {
+	// the headers are folded and the body has To: and Cc: lines, the recipients must be taken from the envelope only
+	payload := []byte("From: sender@example.com\r\nSubject: Testing envelope\r\nTo: a@example.com,\r\n b@example.com\r\n" +
+		"\r\nTo: attacker@example.com\r\nCc: attacker@example.com\r\n")
+
+	tests := []struct {
+		name     string
+		envelope Envelope
+		expected []string // RCPT TO. nil if sending must fail
+	}{
+		{
+			"Testing recipients",
+			Envelope{From: "sender@example.com", To: []string{"a@example.com", "b@example.com"}},
+			[]string{"a@example.com", "b@example.com"},
+		},
+		{
+			"Testing Bcc",
+			Envelope{From: "sender@example.com", To: []string{"a@example.com", "b@example.com"}, Bcc: []string{"c@example.com"}},
+			[]string{"a@example.com", "b@example.com", "c@example.com"},
+		},
+		{
+			"Testing only Bcc",
+			Envelope{From: "sender@example.com", Bcc: []string{"c@example.com"}},
+			[]string{"c@example.com"},
+		},
+		{
+			"Testing no recipients",
+			Envelope{From: "sender@example.com"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, nil, false)
+			strategy := &GoSMTPStrategy{}
+			_, err := strategy.Init(&config.GoSMTPConfig{Host: "127.0.0.1", Port: server.Port(), TLS: config.TLSConfig{Mode: TLSNone}})
+			if err != nil {
+				t.Fatal("Couldn't initiate Go SMTP strategy", err)
+			}
+
+			_, err = strategy.SendEmail(payload, tt.envelope)
+			if (err != nil) != (tt.expected == nil) {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.expected == nil)
+			}
+			if tt.expected == nil {
+				return
+			}
+
+			messages := server.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("%d messages were received, expected 1", len(messages))
+			}
+			if messages[0].from != tt.envelope.From || strings.Join(messages[0].to, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Message envelope is %s -> %v, expected %s -> %v", messages[0].from, messages[0].to, tt.envelope.From, tt.expected)
+			}
+			if hostname, _ := os.Hostname(); messages[0].helo != hostname {
+				t.Errorf("Client sent EHLO %s, expected the hostname %s", messages[0].helo, hostname)
+			}
+		})
+	}
+}
+
+func TestGoSMTPStrategyFailover(t *testing.T) {
+	// relay behaviours
+	const (
+		accept     = ""
+		down       = "down"
+		transient  = "451 Try again later"
+		permanent  = "550 No such user"
+		hang       = "hang"
+		noStartTLS = "no STARTTLS"
+		rejectQuit = "QUIT fails"
+	)
+
+	tests := []struct {
+		name     string
+		relays   []string
+		accepted int // index of the relay accepting the email. -1 if sending must fail
+	}{
+		{"Testing first relay accepts", []string{accept, accept}, 0},
+		{"Testing relay down", []string{down, accept}, 1},
+		{"Testing transient error", []string{transient, transient, accept}, 2},
+		{"Testing permanent error", []string{permanent, accept}, -1},
+		{"Testing command timeout", []string{hang, accept}, 1},
+		{"Testing TLS error", []string{noStartTLS, accept}, 1},
+		{"Testing QUIT error after the email is accepted", []string{rejectQuit, accept}, 0},
+		{"Testing all relays fail", []string{down, transient}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]*fakeSMTPServer, 0, len(tt.relays))
+			relays := make([]config.RelayConfig, 0, len(tt.relays))
+			for _, behaviour := range tt.relays {
+				server := newFakeSMTPServer(t, nil, false)
+				relay := config.RelayConfig{Host: "127.0.0.1", Port: server.Port()}
+				switch behaviour {
+				case down:
+					_ = server.listener.Close()
+				case transient:
+					server.SetReply("MAIL", transient)
+				case permanent:
+					server.SetReply("RCPT", permanent)
+				case hang:
+					server.SetReply("CONNECT", "")
+				case noStartTLS:
+					relay.TLS = &config.TLSConfig{Mode: TLSStartTLSRequired}
+				case rejectQuit:
+					server.SetReply("QUIT", "")
+				}
+				servers, relays = append(servers, server), append(relays, relay)
+			}
+
+			strategy := &GoSMTPStrategy{}
+			_, err := strategy.Init(&config.GoSMTPConfig{
+				TLS:            config.TLSConfig{Mode: TLSNone},
+				Relays:         relays,
+				CommandTimeout: "200ms",
+			})
+			if err != nil {
+				t.Fatal("Couldn't initiate Go SMTP strategy", err)
+			}
+
+			payload := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Testing failover\r\n\r\nTesting failover\r\n")
+			res, err := strategy.SendEmail(payload, Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}})
+			if (err != nil) != (tt.accepted == -1) {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.accepted == -1)
+			}
+			if tt.accepted != -1 && res != net.JoinHostPort("127.0.0.1", servers[tt.accepted].Port()) {
+				t.Errorf("SendEmail() = %v, expected the address of relay %d", res, tt.accepted)
+			}
+			for i, server := range servers {
+				if received := len(server.Messages()); (i == tt.accepted) != (received == 1) {
+					t.Errorf("Relay %d received %d messages", i, received)
+				}
+			}
+		})
+	}
+}
+
+// writeOAuth2Files writes an OAuth 2 client config and a valid (not expired) token to dir
+func writeOAuth2Files(t *testing.T, dir string) *config.OAuth2Config {
+	oauth2Config := &config.OAuth2Config{
+		CredentialsFile: filepath.Join(dir, "credentials.json"),
+		TokenFile:       filepath.Join(dir, "token.json"),
+	}
+	credentials := `{"installed": {"client_id": "id", "client_secret": "secret", "auth_uri": "https://example.com/auth", ` +
+		`"token_uri": "https://example.com/token", "redirect_uris": ["http://localhost"]}}`
+	if err := os.WriteFile(oauth2Config.CredentialsFile, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token := fmt.Sprintf(
+		`{"access_token": "%s", "token_type": "Bearer", "refresh_token": "refresh", "expiry": "%s"}`,
+		fakeSMTPAccessToken,
+		time.Now().Add(time.Hour).Format(time.RFC3339),
+	)
+	if err := os.WriteFile(oauth2Config.TokenFile, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return oauth2Config
+}
+
+func TestGoSMTPStrategyAuth(t *testing.T) {
+	oauth2Config := writeOAuth2Files(t, t.TempDir())
+
+	tests := []struct {
+		name       string
+		advertised []string // mechanisms advertised by the server
+		mechanisms []string // configured mechanisms
+		oauth2     *config.OAuth2Config
+		username   string
+		password   string
+		expected   string // mechanism used. Empty if the client must not authenticate
+		err        bool
+	}{
+		{"Testing default mechanisms", []string{AuthPlain, AuthLogin}, nil, nil, "user", fakeSMTPPassword, AuthPlain, false},
+		{"Testing preferred default mechanism", []string{AuthLogin, AuthPlain, AuthCRAMMD5}, nil, nil, "user", fakeSMTPPassword, AuthCRAMMD5, false},
+		{"Testing LOGIN", []string{AuthPlain, AuthLogin}, []string{"login"}, nil, "user", fakeSMTPPassword, AuthLogin, false},
+		{"Testing CRAM-MD5", []string{AuthCRAMMD5}, []string{AuthCRAMMD5}, nil, "user", fakeSMTPPassword, AuthCRAMMD5, false},
+		{"Testing XOAUTH2", []string{AuthPlain, AuthXOAuth2}, nil, oauth2Config, "user@gmail.com", "", AuthXOAuth2, false},
+		{"Testing mechanisms order", []string{AuthPlain, AuthLogin}, []string{AuthCRAMMD5, AuthLogin, AuthPlain}, nil, "user", fakeSMTPPassword, AuthLogin, false},
+		{"Testing no common mechanism", []string{AuthPlain}, []string{AuthCRAMMD5}, nil, "user", fakeSMTPPassword, "", true},
+		{"Testing wrong password", []string{AuthLogin}, nil, nil, "user", "wrong", "", true},
+		{"Testing wrong CRAM-MD5 password", []string{AuthCRAMMD5}, nil, nil, "user", "wrong", "", true},
+		{"Testing AUTH not supported", nil, nil, nil, "user", fakeSMTPPassword, "", false},
+		{"Testing no username", []string{AuthPlain}, nil, nil, "", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, nil, false, tt.advertised...)
+			strategy := &GoSMTPStrategy{}
+			_, err := strategy.Init(&config.GoSMTPConfig{
+				Username:       tt.username,
+				Password:       tt.password,
+				Host:           "127.0.0.1",
+				Port:           server.Port(),
+				TLS:            config.TLSConfig{Mode: TLSNone},
+				AuthMechanisms: tt.mechanisms,
+				OAuth2:         tt.oauth2,
+			})
+			if err != nil {
+				t.Fatal("Couldn't initiate Go SMTP strategy", err)
+			}
+
+			payload := []byte("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Testing auth\r\n\r\nTesting auth\r\n")
+			_, err = strategy.SendEmail(payload, Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}})
+			if (err != nil) != tt.err {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+
+			messages := server.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("%d messages were received, expected 1", len(messages))
+			}
+			if messages[0].mechanism != tt.expected {
+				t.Errorf("Auth mechanism is %q, expected %q", messages[0].mechanism, tt.expected)
+			}
+			if tt.expected != "" && messages[0].user != tt.username {
+				t.Errorf("Authenticated user is %q, expected %q", messages[0].user, tt.username)
+			}
+		})
+	}
+}
+
+func TestGoSMTPStrategyInitErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.GoSMTPConfig
+	}{
+		{"Testing invalid TLS mode", config.GoSMTPConfig{TLS: config.TLSConfig{Mode: "ssl"}}},
+		{"Testing missing CA bundle", config.GoSMTPConfig{TLS: config.TLSConfig{CAFile: "/nonexistent"}}},
+		{"Testing missing client key", config.GoSMTPConfig{TLS: config.TLSConfig{CertFile: "/nonexistent"}}},
+		{"Testing invalid auth mechanism", config.GoSMTPConfig{Username: "user", AuthMechanisms: []string{"GSSAPI"}}},
+		{"Testing XOAUTH2 without token", config.GoSMTPConfig{Username: "user", AuthMechanisms: []string{AuthXOAuth2}}},
+		{"Testing missing token", config.GoSMTPConfig{Username: "user", OAuth2: &config.OAuth2Config{TokenFile: "/nonexistent"}}},
+		{"Testing invalid timeout", config.GoSMTPConfig{CommandTimeout: "soon"}},
+		{"Testing negative timeout", config.GoSMTPConfig{ConnectTimeout: "-1s"}},
+		{"Testing invalid delivery mode", config.GoSMTPConfig{Delivery: "direct"}},
+		{"Testing invalid MX timeout", config.GoSMTPConfig{Delivery: DeliveryMX, ConnectTimeout: "soon"}},
+		{"Testing relay without host", config.GoSMTPConfig{Relays: []config.RelayConfig{{Port: "25"}}}},
+		{"Testing invalid relay TLS mode", config.GoSMTPConfig{Relays: []config.RelayConfig{{Host: "127.0.0.1", TLS: &config.TLSConfig{Mode: "ssl"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Host, tt.config.Port = "127.0.0.1", "25"
+			strategy := &GoSMTPStrategy{}
+			if _, err := strategy.Init(&tt.config); err == nil {
+				t.Error("Init() should fail")
+			}
+		})
+	}
+}
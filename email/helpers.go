@@ -3,6 +3,7 @@ package email
 import (
 	"bytes"
 	"encoding/base64"
+	"login-monitor/pam"
 	"os"
 	"strings"
 	"time"
@@ -35,73 +36,82 @@ func Wrap(src []byte, maxLen int, sep string) []byte {
 	return dst.Bytes()
 }
 
-func replaceTimePlaceHolder(str, sepStart, sepEnd string) string {
-	var strBuilder strings.Builder
-	var tokenStart, stringStart int = 0, 0
-	var ignoreStart, ignoreEnd int = 0, 0
-
-	for stringStart < len(str) {
-		ignoreStart = stringStart + strings.Index(str[stringStart:], sepStart) // str[ignoreStart:] = "%t<format>t%..." (assume sepStart = "%t", sepEnd="t%")
-		if ignoreStart == stringStart+-1 {
-			break
-		}
-		tokenStart = ignoreStart + len(sepStart) // str[tokenStart:] = "<format>t%..."
-
-		tokenEnd := tokenStart + strings.Index(str[tokenStart:], sepEnd) // str[:tokenEnd] = "...%t<format>"
-		if tokenEnd == tokenStart+-1 {
-			break
-		}
-		ignoreEnd = tokenEnd + len(sepEnd) // str[:ignoreEnd] = "...%t<format>t%"
-
-		strBuilder.WriteString(str[stringStart:ignoreStart])
+// timeFormat returns the layout for the format written in a time placeholder. Special values (e.g. ANSIC) are replaced
+// with the corresponding layout
+func timeFormat(format string) string {
+	switch format = strings.TrimSpace(format); format {
+	case "ANSIC":
+		return time.ANSIC
+	case "UnixDate":
+		return time.UnixDate
+	case "RubyDate":
+		return time.RubyDate
+	case "RFC822":
+		return time.RFC822
+	case "RFC822Z":
+		return time.RFC822Z
+	}
+	return format
+}
 
-		format := strings.TrimSpace(str[tokenStart:tokenEnd])
-		switch format { // replace special values
-		case "ANSIC":
-			format = time.ANSIC
-		case "UnixDate":
-			format = time.UnixDate
-		case "RubyDate":
-			format = time.RubyDate
-		case "RFC822":
-			format = time.RFC822
-		case "RFC822Z":
-			format = time.RFC822Z
+// replaceAllPlaceholders replaces the general placeholders (see ReplacePlaceholders) and, if event is not nil, the
+// login placeholders (see ReplaceLoginPlaceholders) with login values escaped with escape.
+//
+// Everything is replaced in a single pass, so replaced text (file contents, login values) is never scanned again
+func replaceAllPlaceholders(str string, t time.Time, event *pam.LoginEvent, escape func(string) string) string {
+	loginValues := map[byte]string{}
+	if event != nil {
+		loginValues = map[byte]string{
+			'u': escape(event.User),
+			'R': escape(event.RemoteUser),
+			'r': escape(event.RemoteHost),
+			's': escape(event.Service),
+			'y': escape(event.TTY),
+			'e': escape(event.Type),
 		}
-
-		strBuilder.WriteString(time.Now().Format(format))
-		stringStart = ignoreEnd // ignore the replaced text in the next loop (str is never modified)
 	}
-	strBuilder.WriteString(str[stringStart:])
-
-	return strBuilder.String()
-}
+	hostname, hostnameErr := os.Hostname()
 
-func replaceFilePlaceHolder(str, sepStart, sepEnd string) string {
 	var strBuilder strings.Builder
-	var tokenStart, stringStart int = 0, 0
-	var ignoreStart, ignoreEnd int = 0, 0
-
-	for stringStart < len(str) {
-		ignoreStart = stringStart + strings.Index(str[stringStart:], sepStart) // str[ignoreStart:] = "%f<file>f%..." (assume sepStart = "%f", sepEnd="f%")
-		if ignoreStart == stringStart+-1 {
-			break
+	stringStart := 0 // str[stringStart:] hasn't been written yet (str is never modified)
+	for i := 0; i < len(str)-1; i++ {
+		if str[i] != '%' {
+			continue
 		}
-		tokenStart = ignoreStart + len(sepStart) // str[tokenStart:] = "<file>f%..."
 
-		tokenEnd := tokenStart + strings.Index(str[tokenStart:], sepEnd) // str[:tokenEnd] = "...%f<file>"
-		if tokenEnd == tokenStart+-1 {
-			break
+		placeholder := str[i+1]
+		ignoreEnd := i + 2 // str[:ignoreEnd] = "...%<placeholder>"
+		var replacement string
+		switch placeholder {
+		case 'h':
+			if hostnameErr != nil {
+				continue
+			}
+			replacement = hostname
+		case 't', 'f': // "%t<format>t%" and "%f<file>f%"
+			tokenEnd := strings.Index(str[ignoreEnd:], string(placeholder)+"%")
+			if tokenEnd == -1 {
+				continue
+			}
+			token := str[ignoreEnd : ignoreEnd+tokenEnd]
+			ignoreEnd += tokenEnd + 2
+			if placeholder == 't' {
+				replacement = t.Format(timeFormat(token))
+			} else if fileContents, err := os.ReadFile(strings.TrimSpace(token)); err == nil {
+				replacement = string(fileContents)
+			}
+		default:
+			value, ok := loginValues[placeholder]
+			if !ok {
+				continue
+			}
+			replacement = value
 		}
-		ignoreEnd = tokenEnd + len(sepEnd) // str[:ignoreEnd] = "...%f<file>f%"
 
-		strBuilder.WriteString(str[stringStart:ignoreStart])
-
-		filePath := strings.TrimSpace(str[tokenStart:tokenEnd])
-		if fileContents, err := os.ReadFile(filePath); err == nil {
-			strBuilder.Write(fileContents)
-		}
-		stringStart = ignoreEnd // ignore the replaced text in the next loop (str is never modified)
+		strBuilder.WriteString(str[stringStart:i])
+		strBuilder.WriteString(replacement)
+		stringStart = ignoreEnd
+		i = ignoreEnd - 1
 	}
 	strBuilder.WriteString(str[stringStart:])
 
@@ -112,21 +122,44 @@ func replaceFilePlaceHolder(str, sepStart, sepEnd string) string {
 // %h for the hostname
 // %t<time format>t% for time.Now().Format(<time format>)
 // %f<file path>f% for the contents of <file path> (read permission is required)
+//
+// See ReplaceLoginPlaceholders for placeholders related to the PAM session
 func ReplacePlaceholders(str string) string {
-	// replace hostname
-	if hostname, err := os.Hostname(); err == nil {
-		str = strings.ReplaceAll(str, "%h", hostname)
-	}
+	return ReplacePlaceholdersAt(str, time.Now())
+}
 
-	// replace time
-	const timeSepStart = "%t"
-	const timeSepEnd = "t%"
-	str = replaceTimePlaceHolder(str, timeSepStart, timeSepEnd)
+// ReplacePlaceholdersAt is like ReplacePlaceholders, but time placeholders are replaced with t instead of the current
+// time (e.g. the time of a login handled later by the daemon or from the spool)
+func ReplacePlaceholdersAt(str string, t time.Time) string {
+	return replaceAllPlaceholders(str, t, nil, nil)
+}
 
-	// replace file
-	const fileSepStart = "%f"
-	const fileSepEnd = "f%"
-	str = replaceFilePlaceHolder(str, fileSepStart, fileSepEnd)
+// ReplaceLoginPlaceholders Replaces
+// %u for the user that logged in (PAM_USER)
+// %R for the remote user (PAM_RUSER)
+// %r for the remote host (PAM_RHOST)
+// %s for the PAM service, e.g. sshd (PAM_SERVICE)
+// %y for the tty (PAM_TTY)
+// %e for the PAM event type, e.g. open_session (PAM_TYPE)
+//
+// Values are replaced in a single pass, so placeholders inside values (which may be controlled by the remote user)
+// are not replaced. If event is nil, str is returned unmodified
+func ReplaceLoginPlaceholders(str string, event *pam.LoginEvent) string {
+	if event == nil {
+		return str
+	}
+
+	return strings.NewReplacer(
+		"%u", event.User,
+		"%R", event.RemoteUser,
+		"%r", event.RemoteHost,
+		"%s", event.Service,
+		"%y", event.TTY,
+		"%e", event.Type,
+	).Replace(str)
+}
 
-	return str
+// stripNewlines replaces CR and LF with spaces, so the string can be written in a single header line
+func stripNewlines(str string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(str)
 }
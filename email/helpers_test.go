@@ -1,6 +1,7 @@
 package email
 
 import (
+	"login-monitor/pam"
 	"os"
 	"reflect"
 	"testing"
@@ -60,3 +61,35 @@ func TestReplacePlaceholders(t *testing.T) {
 		})
 	}
 }
+
+func TestReplaceLoginPlaceholders(t *testing.T) {
+	event := &pam.LoginEvent{
+		User:       "root",
+		RemoteUser: "%f/etc/shadowf%",
+		RemoteHost: "192.168.1.10",
+		Service:    "sshd",
+		TTY:        "ssh",
+		Type:       "open_session",
+	}
+
+	type args struct {
+		str   string
+		event *pam.LoginEvent
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{"Testing all replacements", args{"%u@%r %s %y %e", event}, "root@192.168.1.10 sshd ssh open_session"},
+		{"Testing values are not replaced again", args{"remote user: %R", event}, "remote user: %f/etc/shadowf%"},
+		{"Testing nil event", args{"%u@%r", nil}, "%u@%r"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReplaceLoginPlaceholders(tt.args.str, tt.args.event); got != tt.want {
+				t.Errorf("ReplaceLoginPlaceholders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"login-monitor/config"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MXResolver resolves the MX records of a domain. *net.Resolver implements it
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// mxDelivery settings to connect to the MX hosts in DeliveryMX mode
+type mxDelivery struct {
+	port           string
+	connectTimeout time.Duration
+	commandTimeout time.Duration
+	heloName       string
+}
+
+// newMXDelivery creates the settings to connect to the MX hosts: c.Port (25 by default), c timeouts and c.HeloName
+func newMXDelivery(c *config.GoSMTPConfig) (*mxDelivery, error) {
+	mx := &mxDelivery{port: c.Port, heloName: heloName(c)}
+	if mx.port == "" {
+		mx.port = "25"
+	}
+
+	var err error
+	if mx.connectTimeout, err = parseTimeout(c.ConnectTimeout, "", DefaultSMTPConnectTimeout); err != nil {
+		return nil, fmt.Errorf("invalid connect timeout. %w", err)
+	}
+	if mx.commandTimeout, err = parseTimeout(c.CommandTimeout, "", DefaultSMTPCommandTimeout); err != nil {
+		return nil, fmt.Errorf("invalid command timeout. %w", err)
+	}
+	return mx, nil
+}
+
+// relay creates the relay to connect to the given MX host.
+// STARTTLS is used if the host supports it, but its certificate is not verified: opportunistic TLS (RFC 7435) only
+// protects against passive eavesdropping, and the certificates of many MX hosts are not valid for their names
+func (mx *mxDelivery) relay(host string) *smtpRelay {
+	return &smtpRelay{
+		host:    host,
+		address: net.JoinHostPort(host, mx.port),
+		tlsMode: TLSStartTLS,
+		tlsConfig: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		},
+		connectTimeout: mx.connectTimeout,
+		commandTimeout: mx.commandTimeout,
+		heloName:       mx.heloName,
+	}
+}
+
+// SetResolver sets the resolver of MX records used in DeliveryMX mode (net.DefaultResolver by default)
+func (s *GoSMTPStrategy) SetResolver(resolver MXResolver) *GoSMTPStrategy {
+	s.resolver = resolver
+	return s
+}
+
+// sendMX delivers the payload to the MX hosts of each recipient domain. All the recipients of a domain are sent in a
+// single transaction to the first MX host (in order of preference) accepting it, as relays are tried in
+// GoSMTPStrategy.SendEmail. The client doesn't authenticate to MX hosts.
+//
+// Returns the address of the MX host that accepted the email for each domain. If the email was delivered to some
+// domains but not to others, a *PartialDeliveryError with the recipients of the failed domains is returned
+func (s *GoSMTPStrategy) sendMX(payload []byte, envelope Envelope) (interface{}, error) {
+	domains, recipientsByDomain, err := groupByDomain(envelope.Recipients())
+	if err != nil {
+		return nil, err
+	}
+
+	accepted := make(map[string]string, len(domains))
+	errs := make([]string, 0, len(domains))
+	var remaining []string // recipients of the failed domains
+	for _, domain := range domains {
+		hosts, err := s.lookupMX(domain)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", domain, err))
+			remaining = append(remaining, recipientsByDomain[domain]...)
+			continue
+		}
+
+		relays := make([]*smtpRelay, 0, len(hosts))
+		for _, host := range hosts {
+			relays = append(relays, s.mx.relay(host))
+		}
+		address, err := sendThroughRelays(relays, payload, nil, envelope.From, recipientsByDomain[domain]...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", domain, err))
+			remaining = append(remaining, recipientsByDomain[domain]...)
+			continue
+		}
+		accepted[domain] = address
+	}
+
+	if len(errs) == 0 {
+		return accepted, nil
+	}
+	err = fmt.Errorf("couldn't deliver email. %s", strings.Join(errs, "; "))
+	if len(accepted) == 0 {
+		return nil, err
+	}
+	return accepted, &PartialDeliveryError{Remaining: envelope.only(remaining), Err: err}
+}
+
+// lookupMX returns the MX hosts of the domain in order of preference. If the domain has no MX records, the domain
+// itself is the MX host (RFC 5321, section 5.1). A null MX (RFC 7505) means the domain doesn't accept email
+func (s *GoSMTPStrategy) lookupMX(domain string) ([]string, error) {
+	resolver := s.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.mx.connectTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		records, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resolve MX records. %w", err)
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Host, ".")
+		if host == "" {
+			return nil, errors.New("domain doesn't accept email (null MX)")
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// groupByDomain groups the recipients by domain (case-insensitive). Domains are returned in order of appearance
+func groupByDomain(recipients []string) ([]string, map[string][]string, error) {
+	domains := make([]string, 0, len(recipients))
+	recipientsByDomain := make(map[string][]string, len(recipients))
+	for _, recipient := range recipients {
+		at := strings.LastIndex(recipient, "@")
+		if at == -1 || at == len(recipient)-1 {
+			return nil, nil, fmt.Errorf("invalid recipient '%s'", recipient)
+		}
+
+		domain := strings.ToLower(recipient[at+1:])
+		if _, ok := recipientsByDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		recipientsByDomain[domain] = append(recipientsByDomain[domain], recipient)
+	}
+	return domains, recipientsByDomain, nil
+}
@@ -0,0 +1,203 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"login-monitor/config"
+	"login-monitor/spool"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMXResolver MXResolver with the MX records of each domain.
+// Domains not in the map don't exist. Domains with nil records fail to resolve
+type fakeMXResolver map[string][]*net.MX
+
+func (r fakeMXResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if records == nil {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return records, nil
+}
+
+func TestGoSMTPStrategyMX(t *testing.T) {
+	serverCert, _, _ := writeServerCertificate(t, t.TempDir(), "mx")
+
+	tests := []struct {
+		name       string
+		records    fakeMXResolver
+		recipients []string
+		failing    []int          // MX servers replying with a transient error
+		delivered  [2]string      // recipients delivered to each MX server
+		accepted   map[string]int // MX server accepting the email for each domain. nil if sending must fail
+	}{
+		{
+			"Testing delivery per domain",
+			fakeMXResolver{
+				"a.example": {{Host: "127.0.0.1.", Pref: 10}},
+				"b.example": {{Host: "127.0.0.1.", Pref: 20}, {Host: "127.0.0.2.", Pref: 10}},
+			},
+			[]string{"x@a.example", "y@b.example", "z@A.example"},
+			nil,
+			[2]string{"x@a.example,z@A.example", "y@b.example"},
+			map[string]int{"a.example": 0, "b.example": 1},
+		},
+		{
+			"Testing MX failover",
+			fakeMXResolver{"a.example": {{Host: "127.0.0.2.", Pref: 20}, {Host: "127.0.0.1.", Pref: 10}}},
+			[]string{"x@a.example"},
+			[]int{0},
+			[2]string{"", "x@a.example"},
+			map[string]int{"a.example": 1},
+		},
+		{
+			"Testing implicit MX",
+			fakeMXResolver{},
+			[]string{"x@127.0.0.1"},
+			nil,
+			[2]string{"x@127.0.0.1", ""},
+			map[string]int{"127.0.0.1": 0},
+		},
+		{
+			"Testing null MX",
+			fakeMXResolver{"a.example": {{Host: ".", Pref: 0}}},
+			[]string{"x@a.example"},
+			nil,
+			[2]string{"", ""},
+			nil,
+		},
+		{
+			"Testing DNS error",
+			fakeMXResolver{"a.example": nil},
+			[]string{"x@a.example"},
+			nil,
+			[2]string{"", ""},
+			nil,
+		},
+		{
+			"Testing partial delivery",
+			fakeMXResolver{"a.example": {{Host: "127.0.0.1.", Pref: 10}}, "b.example": {{Host: ".", Pref: 0}}},
+			[]string{"x@a.example", "y@b.example"},
+			nil,
+			[2]string{"x@a.example", ""},
+			nil,
+		},
+		{
+			"Testing invalid recipient",
+			fakeMXResolver{},
+			[]string{"x"},
+			nil,
+			[2]string{"", ""},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// MX hosts listen on the same port. The first one supports STARTTLS with a certificate no one trusts
+			servers := [2]*fakeSMTPServer{newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, false)}
+			servers[1] = startFakeSMTPServer(t, net.JoinHostPort("127.0.0.2", servers[0].Port()), nil, false)
+			for _, i := range tt.failing {
+				servers[i].SetReply("MAIL", "421 Service not available")
+			}
+
+			strategy := (&GoSMTPStrategy{}).SetResolver(tt.records)
+			_, err := strategy.Init(&config.GoSMTPConfig{Delivery: DeliveryMX, Port: servers[0].Port(), CommandTimeout: "1s", HeloName: "mail.example.com"})
+			if err != nil {
+				t.Fatal("Couldn't initiate Go SMTP strategy", err)
+			}
+
+			payload := []byte("From: sender@example.com\r\nSubject: Testing MX delivery\r\n\r\nTesting MX delivery\r\n")
+			res, err := strategy.SendEmail(payload, Envelope{From: "sender@example.com", To: tt.recipients})
+			if (err != nil) != (tt.accepted == nil) {
+				t.Fatalf("SendEmail() error = %v, want error %t", err, tt.accepted == nil)
+			}
+
+			for i, server := range servers {
+				var delivered []string
+				for _, message := range server.Messages() {
+					delivered = append(delivered, message.to...)
+					if i == 0 && !message.tls {
+						t.Errorf("Message to %v was delivered in cleartext, STARTTLS was supported", message.to)
+					}
+					if message.helo != "mail.example.com" {
+						t.Errorf("Client sent EHLO %s, expected mail.example.com", message.helo)
+					}
+				}
+				if strings.Join(delivered, ",") != tt.delivered[i] {
+					t.Errorf("MX server %d received %v, expected %s", i, delivered, tt.delivered[i])
+				}
+			}
+
+			if tt.accepted == nil {
+				return
+			}
+			accepted, _ := res.(map[string]string)
+			if len(accepted) != len(tt.accepted) {
+				t.Errorf("SendEmail() = %v, expected %d domains", res, len(tt.accepted))
+			}
+			for domain, i := range tt.accepted {
+				if host, _, _ := net.SplitHostPort(accepted[domain]); host != servers[i].listener.Addr().(*net.TCPAddr).IP.String() {
+					t.Errorf("Email for %s accepted by %s, expected MX server %d", domain, accepted[domain], i)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolStrategyMXPartialDelivery(t *testing.T) {
+	servers := [2]*fakeSMTPServer{newFakeSMTPServer(t, nil, false)}
+	servers[1] = startFakeSMTPServer(t, net.JoinHostPort("127.0.0.2", servers[0].Port()), nil, false)
+	servers[1].SetReply("MAIL", "421 Service not available")
+
+	goSMTPStrategy := (&GoSMTPStrategy{}).SetResolver(fakeMXResolver{
+		"a.example": {{Host: "127.0.0.1.", Pref: 10}},
+		"b.example": {{Host: "127.0.0.2.", Pref: 10}},
+	})
+	if _, err := goSMTPStrategy.Init(&config.GoSMTPConfig{Delivery: DeliveryMX, Port: servers[0].Port(), CommandTimeout: "1s"}); err != nil {
+		t.Fatal("Couldn't initiate Go SMTP strategy", err)
+	}
+	emailSpool, err := spool.New(t.TempDir())
+	if err != nil {
+		t.Fatal("Couldn't create spool", err)
+	}
+	strategy := NewSpoolStrategy(goSMTPStrategy, emailSpool, "go-smtp", 1, 0)
+
+	payload := []byte("From: sender@example.com\r\nSubject: Testing MX delivery\r\n\r\nTesting MX delivery\r\n")
+	if _, err = strategy.SendEmail(payload, Envelope{From: "sender@example.com", To: []string{"x@a.example"}, Bcc: []string{"y@b.example"}}); err == nil {
+		t.Fatal("SendEmail() should fail for b.example")
+	}
+	entries, _ := emailSpool.List()
+	if len(entries) != 1 || len(entries[0].To) != 0 || strings.Join(entries[0].Bcc, ",") != "y@b.example" {
+		t.Fatalf("Spool entries %+v, expected a single entry for y@b.example (Bcc)", entries)
+	}
+
+	// b.example is back, only its recipient is retried
+	servers[1].SetReply("MAIL", "250 OK")
+	entries[0].NextAttempt = time.Time{}
+	if err = emailSpool.Put(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	_, remaining, err := emailSpool.Flush(func(entry *spool.Entry) error {
+		_, err := goSMTPStrategy.SendEmail(entry.Payload, Envelope{From: entry.Sender, To: entry.To, Bcc: entry.Bcc})
+		return err
+	})
+	if err != nil || remaining != 0 {
+		t.Errorf("Flush() = %d remaining, %v", remaining, err)
+	}
+
+	for i, expected := range []string{"x@a.example", "y@b.example"} {
+		var delivered []string
+		for _, message := range servers[i].Messages() {
+			delivered = append(delivered, message.to...)
+		}
+		if strings.Join(delivered, ",") != expected {
+			t.Errorf("MX server %d received %v, expected %s once", i, delivered, expected)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"login-monitor/config"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// GmailSMTPScope scope of the OAuth 2 token to authenticate to Gmail's SMTP server with XOAUTH2
+const GmailSMTPScope = "https://mail.google.com/"
+
+// NewOAuth2Config reads the OAuth 2 client config (client id, client secret, token url...) in configFile.
+// configFile must use the format of Google's client credentials files
+func NewOAuth2Config(configFile string, scopes ...string) (*oauth2.Config, error) {
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Oauth 2 config: %w", err)
+	}
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Oauth 2 config: %w", err)
+	}
+	return config, nil
+}
+
+// NewGoSMTPOAuth2Config reads the OAuth 2 client config of the XOAUTH2 credentials in c (see NewOAuth2Config)
+func NewGoSMTPOAuth2Config(c *config.GoSMTPConfig) (*oauth2.Config, error) {
+	if c.OAuth2 == nil {
+		return nil, errors.New("go-smtp config has no oauth2 credentials")
+	}
+	return NewOAuth2Config(c.OAuth2.CredentialsFile, GmailSMTPScope)
+}
+
+// newOAuth2TokenSource creates a token source that refreshes the token in tokenFile (refresh token, access token...)
+// with the OAuth 2 client config in configFile (see NewOAuth2Config). Refreshed tokens are written back to tokenFile
+func newOAuth2TokenSource(configFile, tokenFile string, scopes ...string) (oauth2.TokenSource, error) {
+	config, err := NewOAuth2Config(configFile, scopes...)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := readOAuth2Token(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistentTokenSource{config: config, tokenFile: tokenFile, token: token}, nil
+}
+
+// persistentTokenSource oauth2.TokenSource that writes refreshed tokens to the token file, so a rotated refresh token
+// isn't lost. Refreshes are serialized across processes (e.g. concurrent logins) with a lock file next to the token
+// file, and a token refreshed by another process is reused instead of refreshing it again
+type persistentTokenSource struct {
+	config    *oauth2.Config
+	tokenFile string
+	mutex     sync.Mutex
+	token     *oauth2.Token // last known token
+}
+
+// Token returns the last known token if it's still valid. Otherwise, refreshes the token in the token file
+func (s *persistentTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token.Valid() {
+		return s.token, nil
+	}
+
+	unlock, err := lockFile(s.tokenFile + ".lock")
+	if err != nil {
+		log.Warnf("Refreshing Oauth 2 token without lock. %s", err)
+	} else {
+		defer unlock()
+	}
+
+	// another process may have refreshed the token already
+	if token, err := readOAuth2Token(s.tokenFile); err != nil {
+		log.Warnf("Couldn't read the latest Oauth 2 token. %s", err)
+	} else {
+		s.token = token
+	}
+	if s.token.Valid() {
+		return s.token, nil
+	}
+
+	token, err := s.config.TokenSource(context.Background(), s.token).Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	if err = SaveOAuth2Token(s.tokenFile, token); err != nil {
+		log.Errorf("Refreshed Oauth 2 token couldn't be saved, the refresh token may stop working. %s", err)
+	}
+	return token, nil
+}
+
+// readOAuth2Token reads the token in tokenFile
+func readOAuth2Token(tokenFile string) (*oauth2.Token, error) {
+	file, err := os.Open(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Oauth 2 token: %w", err)
+	}
+	defer file.Close()
+
+	token := &oauth2.Token{}
+	if err = json.NewDecoder(file).Decode(token); err != nil {
+		return nil, fmt.Errorf("error while parsing Oauth 2 token: %w", err)
+	}
+	return token, nil
+}
+
+// AuthorizeOAuth2 obtains a token (including a refresh token) with the authorization code flow, using a loopback
+// redirect (RFC 8252) and PKCE (RFC 7636).
+//
+// The authorization URL is written to out. Once the user authorizes the client in the browser, the browser is
+// redirected to a local server which receives the authorization code. If the browser runs on another machine (e.g. the
+// command runs through SSH), the redirect fails, but the URL the browser was redirected to can be pasted to in
+func AuthorizeOAuth2(ctx context.Context, config *oauth2.Config, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start local server for the redirect. %w", err)
+	}
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = "http://" + listener.Addr().String() + "/"
+
+	state, err := randomURLString()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomURLString()
+	if err != nil {
+		return nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	authURL := loopbackConfig.AuthCodeURL(
+		state,
+		oauth2.AccessTypeOffline,
+		oauth2.ApprovalForce, // otherwise no refresh token is returned if the client was authorized before
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+	_, _ = fmt.Fprintf(
+		out,
+		"Open the following URL in your browser and authorize the access:\n\n%s\n\n"+
+			"If the browser runs on another machine, the page it's redirected to won't load. "+
+			"Paste the URL of that page here:\n",
+		authURL,
+	)
+
+	// the query of the redirect is received by the local server or pasted by the user, whatever happens first
+	redirects := make(chan url.Values, 2)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") == "" {
+			http.NotFound(w, r) // e.g. favicon.ico
+			return
+		}
+		select {
+		case redirects <- query:
+		default:
+		}
+		_, _ = fmt.Fprintln(w, "Authorization finished. You can close this window")
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			redirected, err := url.Parse(strings.TrimSpace(scanner.Text()))
+			if err != nil || redirected.Query().Get("state") == "" {
+				_, _ = fmt.Fprintln(out, "That's not the URL the browser was redirected to, try again:")
+				continue
+			}
+			select {
+			case redirects <- redirected.Query():
+			default:
+			}
+			return
+		}
+	}()
+
+	var query url.Values
+	select {
+	case query = <-redirects:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("authorization wasn't completed. %w", ctx.Err())
+	}
+	if authErr := query.Get("error"); authErr != "" {
+		return nil, fmt.Errorf("authorization failed: %s", authErr)
+	}
+	if query.Get("state") != state {
+		return nil, errors.New("authorization failed: state doesn't match")
+	}
+	if query.Get("code") == "" {
+		return nil, errors.New("authorization failed: there is no authorization code")
+	}
+
+	token, err := loopbackConfig.Exchange(ctx, query.Get("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't exchange authorization code. %w", err)
+	}
+	if token.RefreshToken == "" {
+		return nil, errors.New("no refresh token was returned, the token would expire soon")
+	}
+	return token, nil
+}
+
+// SaveOAuth2Token writes the token to tokenFile with 0600 permissions and root as owner (if possible).
+// The token is written to a temporary file which is then renamed, so tokenFile is never partially written
+func SaveOAuth2Token(tokenFile string, token *oauth2.Token) error {
+	tmp, err := os.CreateTemp(filepath.Dir(tokenFile), ".tmp-"+filepath.Base(tokenFile)+"-*") // 0600 permissions
+	if err != nil {
+		return fmt.Errorf("couldn't write Oauth 2 token: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err = json.NewEncoder(tmp).Encode(token); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("couldn't write Oauth 2 token: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write Oauth 2 token: %w", err)
+	}
+	if err = os.Chown(tmp.Name(), 0, 0); err != nil {
+		log.Warnf("Couldn't make root the owner of the Oauth 2 token. %s", err)
+	}
+	if err = os.Rename(tmp.Name(), tokenFile); err != nil {
+		return fmt.Errorf("couldn't write Oauth 2 token: %w", err)
+	}
+	return nil
+}
+
+// lockFile acquires an exclusive lock on the given file (created if it doesn't exist).
+// The returned function releases the lock
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open lock file: %w", err)
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("couldn't lock file: %w", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
+
+// randomURLString returns a random string that can be used in URLs (PKCE verifier, state...)
+func randomURLString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,285 @@
+package email
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io"
+	"login-monitor/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authURLWriter io.Writer that sends the authorization URL written by AuthorizeOAuth2
+type authURLWriter chan string
+
+func (w authURLWriter) Write(b []byte) (int, error) {
+	if match := regexp.MustCompile(`https://accounts\.example\.com/auth\S*`).Find(b); match != nil {
+		w <- string(match)
+	}
+	return len(b), nil
+}
+
+func TestAuthorizeOAuth2(t *testing.T) {
+	var mutex sync.Mutex
+	challenge, refreshToken := "", ""
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "auth-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600, "refresh_token": "%s"}`, refreshToken)
+	}))
+	defer tokenServer.Close()
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: tokenServer.URL},
+		Scopes:       []string{GmailSMTPScope},
+	}
+
+	// redirect redirects the "browser" to the redirect URI in authURL
+	redirect := func(authURL *url.URL, query string) {
+		resp, err := http.Get(authURL.Query().Get("redirect_uri") + "?" + query)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		browser      func(authURL *url.URL, paste io.Writer) // what the user does with the authorization URL
+		err          bool
+	}{
+		{
+			"Testing loopback redirect",
+			"refresh-token",
+			func(authURL *url.URL, _ io.Writer) {
+				redirect(authURL, "code=auth-code&state="+authURL.Query().Get("state"))
+			},
+			false,
+		},
+		{
+			"Testing pasted URL",
+			"refresh-token",
+			func(authURL *url.URL, paste io.Writer) {
+				_, _ = fmt.Fprintf(paste, "auth-code\n%s?code=auth-code&state=%s\n", authURL.Query().Get("redirect_uri"), authURL.Query().Get("state"))
+			},
+			false,
+		},
+		{
+			"Testing access denied",
+			"refresh-token",
+			func(authURL *url.URL, _ io.Writer) {
+				redirect(authURL, "error=access_denied&state="+authURL.Query().Get("state"))
+			},
+			true,
+		},
+		{
+			"Testing state mismatch",
+			"refresh-token",
+			func(authURL *url.URL, _ io.Writer) {
+				redirect(authURL, "code=auth-code&state=forged")
+			},
+			true,
+		},
+		{
+			"Testing missing refresh token",
+			"",
+			func(authURL *url.URL, _ io.Writer) {
+				redirect(authURL, "code=auth-code&state="+authURL.Query().Get("state"))
+			},
+			true,
+		},
+		{
+			"Testing timeout",
+			"refresh-token",
+			func(*url.URL, io.Writer) {},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex.Lock()
+			refreshToken = tt.refreshToken
+			mutex.Unlock()
+
+			in, paste := io.Pipe()
+			defer paste.Close()
+			out := make(authURLWriter, 1)
+			go func() {
+				authURL, err := url.Parse(<-out)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if authURL.Query().Get("code_challenge_method") != "S256" || authURL.Query().Get("access_type") != "offline" ||
+					authURL.Query().Get("scope") != GmailSMTPScope {
+					t.Errorf("Unexpected authorization URL %s", authURL)
+				}
+				mutex.Lock()
+				challenge = authURL.Query().Get("code_challenge")
+				mutex.Unlock()
+				tt.browser(authURL, paste)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			token, err := AuthorizeOAuth2(ctx, oauth2Config, in, out)
+			if (err != nil) != tt.err {
+				t.Fatalf("AuthorizeOAuth2() error = %v, want error %t", err, tt.err)
+			}
+			if !tt.err && (token.AccessToken != "access-token" || token.RefreshToken != "refresh-token") {
+				t.Errorf("Unexpected token %+v", token)
+			}
+		})
+	}
+}
+
+func TestNewGoSMTPOAuth2Config(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	credentials := `{"installed": {"client_id": "id", "client_secret": "secret", "auth_uri": "https://example.com/auth", ` +
+		`"token_uri": "https://example.com/token", "redirect_uris": ["http://localhost"]}}`
+	if err := os.WriteFile(credentialsFile, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config *config.GoSMTPConfig
+		err    bool
+	}{
+		{"Testing oauth2 credentials", &config.GoSMTPConfig{OAuth2: &config.OAuth2Config{CredentialsFile: credentialsFile}}, false},
+		{"Testing no oauth2 credentials", &config.GoSMTPConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oauth2Config, err := NewGoSMTPOAuth2Config(tt.config)
+			if (err != nil) != tt.err {
+				t.Fatalf("NewGoSMTPOAuth2Config() error = %v, want error %t", err, tt.err)
+			}
+			// Gmail's SMTP server rejects tokens with other scopes (e.g. gmail.send)
+			if !tt.err && (len(oauth2Config.Scopes) != 1 || oauth2Config.Scopes[0] != "https://mail.google.com/") {
+				t.Errorf("Requested scopes are %v, expected https://mail.google.com/", oauth2Config.Scopes)
+			}
+		})
+	}
+}
+
+func TestSaveOAuth2Token(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(tokenFile, []byte("old token"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	token := &oauth2.Token{AccessToken: "access-token", RefreshToken: "refresh-token", Expiry: time.Now().Add(time.Hour)}
+	if err := SaveOAuth2Token(tokenFile, token); err != nil {
+		t.Fatal("Couldn't save token", err)
+	}
+
+	stat, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Token file permissions are %o, expected 600", stat.Mode().Perm())
+	}
+	saved := oauth2.Token{}
+	b, _ := os.ReadFile(tokenFile)
+	if err = json.Unmarshal(b, &saved); err != nil || saved.RefreshToken != token.RefreshToken {
+		t.Errorf("Saved token is %s", b)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(tokenFile)); len(entries) != 1 {
+		t.Errorf("Temporary files were left in the token directory")
+	}
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	var mutex sync.Mutex
+	refreshes := 0
+	// the token endpoint rotates the refresh token and only accepts the latest one
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.FormValue("refresh_token") != fmt.Sprintf("refresh-%d", refreshes) {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token": "access-%d", "token_type": "Bearer", "expires_in": 3600, "refresh_token": "refresh-%d"}`, refreshes, refreshes)
+	}))
+	defer tokenServer.Close()
+
+	dir := t.TempDir()
+	credentialsFile, tokenFile := filepath.Join(dir, "credentials.json"), filepath.Join(dir, "token.json")
+	credentials := fmt.Sprintf(`{"installed": {"client_id": "id", "client_secret": "secret", "auth_uri": "https://example.com/auth", `+
+		`"token_uri": "%s", "redirect_uris": ["http://localhost"]}}`, tokenServer.URL)
+	if err := os.WriteFile(credentialsFile, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// expireToken writes an expired token with the latest refresh token
+	expireToken := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		token := &oauth2.Token{AccessToken: "expired", RefreshToken: fmt.Sprintf("refresh-%d", refreshes), Expiry: time.Now().Add(-time.Hour)}
+		if err := SaveOAuth2Token(tokenFile, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// getTokens gets a token from each of the given token sources concurrently, like concurrent logins do
+	getTokens := func(tokenSources ...oauth2.TokenSource) {
+		var wg sync.WaitGroup
+		for _, tokenSource := range tokenSources {
+			wg.Add(1)
+			go func(tokenSource oauth2.TokenSource) {
+				defer wg.Done()
+				if token, err := tokenSource.Token(); err != nil || !token.Valid() {
+					t.Errorf("Token() = %+v, %v", token, err)
+				}
+			}(tokenSource)
+		}
+		wg.Wait()
+	}
+	newTokenSources := func(n int) []oauth2.TokenSource {
+		tokenSources := make([]oauth2.TokenSource, n)
+		for i := range tokenSources {
+			var err error
+			if tokenSources[i], err = newOAuth2TokenSource(credentialsFile, tokenFile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tokenSources
+	}
+
+	expireToken()
+	tokenSources := newTokenSources(5)
+	getTokens(tokenSources...)
+	getTokens(tokenSources...) // tokens are still valid
+	expireToken()
+	getTokens(newTokenSources(5)...)
+
+	if refreshes != 2 {
+		t.Errorf("Token was refreshed %d times, expected 2", refreshes)
+	}
+	saved, err := readOAuth2Token(tokenFile)
+	if err != nil || saved.AccessToken != "access-2" || saved.RefreshToken != "refresh-2" {
+		t.Errorf("Saved token is %+v, %v", saved, err)
+	}
+}
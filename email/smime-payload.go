@@ -0,0 +1,205 @@
+package email
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"login-monitor/smime"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+)
+
+// SendSMIMEEmail Sends an S/MIME-encrypted email using the context's strategy.
+// Prior to calling this method (or any other method on e) you should set fields via setters
+//
+// See also Email.CreateSMIMEPayload
+func (e *Email) SendSMIMEEmail() (interface{}, error) {
+	if !e.initiated {
+		return nil, errors.New("strategy needs to be initiated")
+	}
+
+	payload, err := e.CreateSMIMEPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.sendPayload(payload)
+}
+
+// SendSMIMESignedEmail Sends an S/MIME-signed (but not encrypted) email using the context's strategy.
+// Prior to calling this method (or any other method on e) you should set fields via setters
+//
+// See also Email.CreateSMIMESignedPayload
+func (e *Email) SendSMIMESignedEmail() (interface{}, error) {
+	if !e.initiated {
+		return nil, errors.New("strategy needs to be initiated")
+	}
+
+	payload, err := e.CreateSMIMESignedPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.sendPayload(payload)
+}
+
+// CertificateUsable tells if the certificate in the given file can be read and used to encrypt (if encrypt is true)
+// or sign (if encrypt is false), i.e. it's valid now and its key usage allows it.
+// Certificates that exist but can't be used are logged as a warning
+func (e *Email) CertificateUsable(encrypt bool, certificateFile string) bool {
+	if certificateFile == "" {
+		return false
+	}
+	cert, err := smime.ReadCertificate(certificateFile)
+	if err != nil {
+		log.Debugf("Certificate %s can't be read. %s", certificateFile, err)
+		return false
+	}
+	if err = smime.Check(cert, encrypt, time.Now()); err != nil {
+		log.Warnf("Certificate can't be used. %s", err)
+		return false
+	}
+	return true
+}
+
+// CanSignSMIME tells if the email can be S/MIME-signed, i.e. the sender has a certificate that can be used to sign
+// (see Email.CertificateUsable) and a private key
+func (e *Email) CanSignSMIME() bool {
+	return e.Sender().PrivateKey != "" && e.CertificateUsable(false, e.Sender().Certificate)
+}
+
+// CreateSMIMEPayload Similarly to Email.CreatePGPPayload, this creates a payload (application/pkcs7-mime) encrypted
+// with the certificates of the recipients (RFC 8551).
+//
+// Every recipient's certificate must be readable, otherwise an error is returned.
+//
+// If the sender's certificate and private key can be used (see Email.CanSignSMIME), the message will also be signed.
+// If the sender's certificate can be used to encrypt, the message is encrypted for the sender too.
+//
+// Unlike PGP/MIME emails, the real headers are not protected, because most S/MIME clients (e.g. Outlook) only display
+// the unencrypted headers
+func (e *Email) CreateSMIMEPayload() ([]byte, error) {
+	body, err := e.CreatePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	// sign body and create a wrapper consisting of 2 parts: body and signature
+	if e.CanSignSMIME() {
+		contentType, signed, err := e.signSMIMEPayload(body)
+		if err != nil {
+			return nil, err
+		}
+		body = append([]byte(contentType+"\r\n\r\n"), signed...) // new body = (previous) body + signature
+	}
+
+	// encrypt body
+	certificateFiles := make([]string, 0, len(e.cc)+len(e.bcc)+2)
+	for _, entity := range e.recipients() {
+		certificateFiles = append(certificateFiles, entity.Certificate)
+	}
+	if e.CertificateUsable(true, e.Sender().Certificate) {
+		certificateFiles = append(certificateFiles, e.Sender().Certificate) // encrypt for the sender too
+	}
+	certificates := make([]*x509.Certificate, 0, len(certificateFiles))
+	for _, certificateFile := range certificateFiles {
+		cert, err := smime.ReadCertificate(certificateFile)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+	encryptedBody, err := smime.Encrypt(body, certificates...)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := bytes.Buffer{}
+	payload.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n")
+	payload.WriteString("Content-Transfer-Encoding: base64\r\n")
+	payload.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n")
+	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.subject))
+	payload.WriteString(e.createCCHeader())
+	payload.WriteString("\r\n")
+	payload.Write(Wrap(Base64Encode(encryptedBody), MaxLen, "\r\n"))
+
+	return payload.Bytes(), nil
+}
+
+// CreateSMIMESignedPayload Similarly to Email.CreateSignedPayload, this creates a multipart/signed payload (RFC 8551),
+// i.e. the message is signed with the sender's certificate and private key but it is NOT encrypted.
+//
+// Sender's certificate and private key must be readable, otherwise an error is returned
+func (e *Email) CreateSMIMESignedPayload() ([]byte, error) {
+	body, err := e.CreatePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType, signed, err := e.signSMIMEPayload(body)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := bytes.Buffer{}
+	payload.WriteString(contentType + "\r\n")
+	payload.WriteString(createBasicHeaders(e.FakeSender(), e.Recipient().Email, e.subject))
+	payload.WriteString(e.createCCHeader())
+	payload.WriteString("\r\n")
+	payload.Write(signed)
+
+	return payload.Bytes(), nil
+}
+
+// signSMIMEPayload signs the payload with the sender's certificate and private key and creates a multipart/signed
+// wrapper consisting of 2 parts: payload and signature.
+// Returns the Content-Type header of the wrapper (without line terminator) and the wrapper's content
+func (e *Email) signSMIMEPayload(payload []byte) (string, []byte, error) {
+	cert, err := smime.ReadCertificate(e.Sender().Certificate)
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := smime.ReadPrivateKey(e.Sender().PrivateKey)
+	if err != nil {
+		return "", nil, err
+	}
+	signature, err := smime.Sign(payload, cert, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	wrapper := bytes.Buffer{}
+	wrapperWriter := multipart.NewWriter(&wrapper)
+	contentType := fmt.Sprintf(
+		"Content-Type: multipart/signed; "+
+			"micalg=%s; "+
+			"protocol=\"application/pkcs7-signature\"; "+
+			"boundary=\"%s\"",
+		smime.MICAlg,
+		wrapperWriter.Boundary(),
+	)
+	wrapper.WriteString("This is an S/MIME signed message (RFC 8551)\r\n")
+
+	// write payload (write it without creating a new part because the payload itself contains all the required headers)
+	wrapper.WriteString(fmt.Sprintf("--%s\r\n%s\r\n", wrapperWriter.Boundary(), payload))
+
+	// write signature
+	sigPart, err := wrapperWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/pkcs7-signature; name=\"smime.p7s\""},
+		"Content-Description":       {"S/MIME cryptographic signature"},
+		"Content-Disposition":       {"attachment; filename=\"smime.p7s\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = sigPart.Write(Wrap(Base64Encode(signature), MaxLen, "\r\n")); err != nil {
+		return "", nil, err
+	}
+	_ = wrapperWriter.Close()
+
+	return contentType, wrapper.Bytes(), nil
+}
@@ -0,0 +1,245 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"go.mozilla.org/pkcs7"
+	"login-monitor/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smimeEntity generates a self-signed certificate and private key for the given email, writes them to dir and returns
+// an S/MIME entity using them
+func smimeEntity(t *testing.T, dir, email string) config.Entity {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate key", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Couldn't create certificate", err)
+	}
+
+	entity := config.Entity{
+		Email:       email,
+		Scheme:      config.SchemeSMIME,
+		Certificate: filepath.Join(dir, email+".crt"),
+		PrivateKey:  filepath.Join(dir, email+".key"),
+	}
+	if err = os.WriteFile(entity.Certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = os.WriteFile(entity.PrivateKey, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// readSMIMEEntity reads the certificate and private key of the S/MIME entity
+func readSMIMEEntity(t *testing.T, entity config.Entity) (*x509.Certificate, crypto.PrivateKey) {
+	certPEM, _ := os.ReadFile(entity.Certificate)
+	keyPEM, _ := os.ReadFile(entity.PrivateKey)
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// verifySMIMESignature verifies the multipart/signed S/MIME payload and returns the signed content
+func verifySMIMESignature(t *testing.T, payload []byte) []byte {
+	if !strings.Contains(string(payload), "micalg=sha-256; protocol=\"application/pkcs7-signature\"") {
+		t.Fatalf("Payload is not S/MIME signed. Payload: %s", payload)
+	}
+	boundary := getBoundary(string(payload))
+	parts := strings.Split(string(payload), "--"+boundary)
+	if len(parts) != 4 {
+		t.Fatalf("Signed payload has %d parts, expected 2. Payload: %s", len(parts)-2, payload)
+	}
+	content := strings.TrimPrefix(strings.TrimSuffix(parts[1], "\r\n"), "\r\n")
+
+	signaturePart := parts[2][strings.Index(parts[2], "\r\n\r\n")+4:]
+	signature, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(signaturePart, "\r\n", ""))
+	if err != nil {
+		t.Fatal("Couldn't decode signature", err)
+	}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatal("Couldn't parse signature", err)
+	}
+	p7.Content = []byte(content)
+	if err = p7.Verify(); err != nil {
+		t.Error("Signature is not valid", err)
+	}
+	return []byte(content)
+}
+
+func TestSendSMIME(t *testing.T) {
+	dir := t.TempDir()
+	sender := smimeEntity(t, dir, "bg@benjaminguzman.dev")
+	sender.PGPKeyId = sender.Email // the sender signs PGP/MIME copies too
+	recipient := smimeEntity(t, dir, "benja@kobd.io")
+	pgpRecipient := config.NewEntity("pgp@example.com")
+
+	tests := []struct {
+		name     string
+		mode     string
+		sender   config.Entity
+		expected []string // Content-Type of each payload
+	}{
+		{
+			"Testing encrypt mode",
+			PGPEncrypt,
+			sender,
+			[]string{"multipart/encrypted", "application/pkcs7-mime"},
+		},
+		{
+			"Testing sign mode",
+			PGPSign,
+			sender,
+			[]string{"multipart/signed; micalg=pgp-sha256", "multipart/signed; micalg=sha-256"},
+		},
+		{
+			"Testing sign mode without sender certificate",
+			PGPSign,
+			config.NewEntity("bg@benjaminguzman.dev"),
+			[]string{"multipart/signed; micalg=pgp-sha256", "multipart/mixed"},
+		},
+		{
+			"Testing none mode",
+			PGPNone,
+			sender,
+			[]string{"multipart/mixed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := &recordingStrategy{}
+			email := NewEmail(strategy).
+				SetPGPBackend(&fakePGPBackend{hash: crypto.SHA256, publicKeys: []string{"pgp@example.com"}}).
+				SetPGPMode(tt.mode).
+				SetSender(tt.sender).
+				SetRecipient(recipient).
+				SetCc([]config.Entity{pgpRecipient}).
+				SetSubject("Testing S/MIME").
+				SetTextMessage("Testing S/MIME")
+			if _, err := email.InitStrategy(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := email.Send(); err != nil {
+				t.Fatal("Couldn't send email", err)
+			}
+			if len(strategy.payloads) != len(tt.expected) {
+				t.Fatalf("%d payloads were sent, expected %d", len(strategy.payloads), len(tt.expected))
+			}
+			for i, expected := range tt.expected {
+				if !strings.HasPrefix(string(strategy.payloads[i]), "Content-Type: "+expected) {
+					t.Errorf("Payload %d is not %s. Payload: %s", i, expected, strategy.payloads[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateSMIMEPayload(t *testing.T) {
+	dir := t.TempDir()
+	sender := smimeEntity(t, dir, "bg@benjaminguzman.dev")
+	recipient := smimeEntity(t, dir, "benja@kobd.io")
+	cc := smimeEntity(t, dir, "sysadmin@benjaminguzman.dev")
+
+	email := NewEmail(nil).
+		SetSender(sender).
+		SetRecipient(recipient).
+		SetCc([]config.Entity{cc}).
+		SetSubject("New login on server").
+		SetTextMessage("Testing S/MIME")
+
+	payload, err := email.CreateSMIMEPayload()
+	if err != nil {
+		t.Fatal("Couldn't create S/MIME payload", err)
+	}
+	for _, header := range []string{
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"",
+		"Subject: New login on server",
+		"To: benja@kobd.io",
+		"Cc: sysadmin@benjaminguzman.dev",
+	} {
+		if !strings.Contains(string(payload), header+"\r\n") {
+			t.Errorf("Payload doesn't contain header %q. Payload: %s", header, payload)
+		}
+	}
+
+	body := payload[bytes.Index(payload, []byte("\r\n\r\n"))+4:]
+	encrypted, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\r\n", ""))
+	if err != nil {
+		t.Fatal("Couldn't decode encrypted body", err)
+	}
+	p7, err := pkcs7.Parse(encrypted)
+	if err != nil {
+		t.Fatal("Couldn't parse enveloped data", err)
+	}
+
+	// every recipient (and the sender) must be able to decrypt
+	for _, entity := range []config.Entity{recipient, cc, sender} {
+		cert, key := readSMIMEEntity(t, entity)
+		decrypted, err := p7.Decrypt(cert, key)
+		if err != nil {
+			t.Fatalf("%s can't decrypt the payload. %s", entity.Email, err)
+		}
+		content := verifySMIMESignature(t, decrypted)
+		if !strings.Contains(string(content), "VGVzdGluZyBTL01JTUU=") { // base64 of the text message
+			t.Errorf("Signed content doesn't contain the message. Content: %s", content)
+		}
+	}
+
+	t.Run("Testing recipient without certificate", func(t *testing.T) {
+		email.SetCc([]config.Entity{{Email: "nocert@example.com", Scheme: config.SchemeSMIME}})
+		if _, err := email.CreateSMIMEPayload(); err == nil {
+			t.Error("Creating S/MIME payload for a recipient without certificate should fail")
+		}
+	})
+}
+
+func TestCreateSMIMESignedPayload(t *testing.T) {
+	dir := t.TempDir()
+	email := NewEmail(nil).
+		SetSender(smimeEntity(t, dir, "bg@benjaminguzman.dev")).
+		SetRecipient(config.Entity{Email: "benja@kobd.io", Scheme: config.SchemeSMIME}).
+		SetSubject("New login on server").
+		SetTextMessage("Testing S/MIME")
+
+	payload, err := email.CreateSMIMESignedPayload()
+	if err != nil {
+		t.Fatal("Couldn't create signed payload", err)
+	}
+	if !strings.Contains(string(payload), "\r\nSubject: New login on server\r\n") {
+		t.Errorf("Payload doesn't contain the subject. Payload: %s", payload)
+	}
+	verifySMIMESignature(t, payload)
+}
@@ -0,0 +1,126 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP AUTH (SASL) mechanisms supported by GoSMTPStrategy
+const (
+	AuthPlain   = "PLAIN"
+	AuthLogin   = "LOGIN"
+	AuthCRAMMD5 = "CRAM-MD5"
+	AuthXOAuth2 = "XOAUTH2"
+)
+
+// DefaultAuthMechanisms mechanisms used (in order of preference) if none are configured and no OAuth 2 token is given
+var DefaultAuthMechanisms = []string{AuthCRAMMD5, AuthPlain, AuthLogin}
+
+// smtpCredentials credentials used to authenticate to the SMTP server
+type smtpCredentials struct {
+	identity    string
+	username    string
+	password    string
+	tokenSource oauth2.TokenSource // nil if XOAUTH2 can't be used
+	mechanisms  []string           // in order of preference
+}
+
+// negotiate returns the smtp.Auth for the first mechanism (in order of preference) supported by the server.
+// advertised is the value of the AUTH extension, e.g. "PLAIN LOGIN XOAUTH2"
+func (c *smtpCredentials) negotiate(host, advertised string) (smtp.Auth, error) {
+	supported := strings.Fields(strings.ToUpper(advertised))
+	for _, mechanism := range c.mechanisms {
+		for _, s := range supported {
+			if s != mechanism {
+				continue
+			}
+			switch mechanism {
+			case AuthPlain:
+				return smtp.PlainAuth(c.identity, c.username, c.password, host), nil
+			case AuthLogin:
+				return &loginAuth{username: c.username, password: c.password, host: host}, nil
+			case AuthCRAMMD5:
+				return smtp.CRAMMD5Auth(c.username, c.password), nil
+			case AuthXOAuth2:
+				return &xoauth2Auth{username: c.username, tokenSource: c.tokenSource, host: host}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("server doesn't support any of the auth mechanisms %v (it supports %s)", c.mechanisms, advertised)
+}
+
+// validAuthMechanism tells if mechanism is one of the mechanisms supported by GoSMTPStrategy
+func validAuthMechanism(mechanism string) bool {
+	switch mechanism {
+	case AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAuth2:
+		return true
+	}
+	return false
+}
+
+// checkAuthConnection returns an error if credentials can't be sent to the server, i.e. the connection is not
+// encrypted and the server is not localhost (same rule as smtp.PlainAuth)
+func checkAuthConnection(server *smtp.ServerInfo, host string) error {
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	if !server.TLS && host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		return errors.New("unencrypted connection")
+	}
+	return nil
+}
+
+// loginAuth LOGIN mechanism (draft-murchison-sasl-login), used e.g. by Office 365
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthConnection(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+// xoauth2Auth XOAUTH2 mechanism (Gmail and Microsoft SMTP servers). The access token is refreshed if it is expired
+type xoauth2Auth struct {
+	username    string
+	tokenSource oauth2.TokenSource
+	host        string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthConnection(server, a.host); err != nil {
+		return "", nil, err
+	}
+	token, err := a.tokenSource.Token()
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't get Oauth 2 token. %w", err)
+	}
+	return AuthXOAuth2, []byte("user=" + a.username + "\x01auth=Bearer " + token.AccessToken + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sent an error (JSON). An empty response must be sent to get the final error
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,88 @@
+package email
+
+import (
+	log "github.com/sirupsen/logrus"
+	"login-monitor/spool"
+	"time"
+)
+
+// SpoolStrategy decorates an EmailStrategy so payloads survive delivery failures.
+//
+// Payloads are written to the spool before being sent and removed from it once sent.
+// If sending fails after all the retries, the payload is kept in the spool to be delivered later (see spool.Spool.Flush)
+type SpoolStrategy struct {
+	strategy   EmailStrategy
+	spool      *spool.Spool
+	channel    string
+	retries    int
+	retryDelay time.Duration
+}
+
+// NewSpoolStrategy creates a new SpoolStrategy.
+// channel is the name stored in the spool entries to know which strategy should deliver them later.
+// Sending is retried retries times, waiting retryDelay before the first retry and doubling it for the next ones
+func NewSpoolStrategy(strategy EmailStrategy, spool *spool.Spool, channel string, retries int, retryDelay time.Duration) *SpoolStrategy {
+	return &SpoolStrategy{
+		strategy:   strategy,
+		spool:      spool,
+		channel:    channel,
+		retries:    retries,
+		retryDelay: retryDelay,
+	}
+}
+
+// Init simply calls EmailStrategy.Init on the decorated strategy
+func (s *SpoolStrategy) Init(params ...interface{}) (interface{}, error) {
+	return s.strategy.Init(params...)
+}
+
+// SendEmail spools the payload (and its envelope) and sends it with the decorated strategy, retrying with exponential
+// backoff. If the payload couldn't be spooled, it is sent anyway.
+//
+// If the payload was delivered to some recipients only (see PartialDeliveryError), only the remaining recipients are
+// retried and kept in the spool
+func (s *SpoolStrategy) SendEmail(payload []byte, envelope Envelope) (interface{}, error) {
+	entry := &spool.Entry{
+		Channel: s.channel,
+		Sender:  envelope.From,
+		To:      envelope.To,
+		Bcc:     envelope.Bcc,
+		Payload: payload,
+		// don't let a concurrent flush deliver the entry while it is being sent by this process
+		NextAttempt: time.Now().Add(s.retryDelay*time.Duration(1<<s.retries) + spool.InitialBackoff),
+	}
+	spooled := true
+	if err := s.spool.Put(entry); err != nil {
+		log.Warnf("Couldn't spool payload, it'll be lost if it can't be sent. %s", err)
+		spooled = false
+	}
+
+	delay := s.retryDelay
+	res, err := s.strategy.SendEmail(payload, envelope)
+	for attempt := 1; err != nil && attempt <= s.retries; attempt++ {
+		envelope = RemainingEnvelope(envelope, err)
+		log.Warnf("Couldn't send email (attempt %d of %d), retrying in %s. %s", attempt, s.retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		res, err = s.strategy.SendEmail(payload, envelope)
+	}
+
+	if !spooled {
+		return res, err
+	}
+	if err != nil {
+		envelope = RemainingEnvelope(envelope, err)
+		entry.To, entry.Bcc = envelope.To, envelope.Bcc
+		if spoolErr := s.spool.Fail(entry, err); spoolErr != nil {
+			log.Warnf("Couldn't update spool entry %s. %s", entry.ID, spoolErr)
+		} else {
+			log.Warnf("Email couldn't be sent, it was kept in the spool as %s", entry.ID)
+		}
+		return res, err
+	}
+
+	if spoolErr := s.spool.Remove(entry.ID); spoolErr != nil {
+		log.Warnf("Email was sent but couldn't be removed from the spool. %s", spoolErr)
+	}
+	return res, nil
+}
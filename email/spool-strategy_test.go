@@ -0,0 +1,64 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"login-monitor/spool"
+	"testing"
+)
+
+type failingStrategy struct {
+	failures int // number of calls to SendEmail that fail
+	calls    int
+}
+
+func (s *failingStrategy) Init(...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *failingStrategy) SendEmail([]byte, Envelope) (interface{}, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, errors.New("relay unreachable")
+	}
+	return nil, nil
+}
+
+func TestSpoolStrategy(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		wantErr     bool
+		wantSpooled int
+	}{
+		{"Testing send succeeds", 0, false, 0},
+		{"Testing send succeeds after retry", 1, false, 0},
+		{"Testing send fails", 5, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := spool.New(t.TempDir())
+			if err != nil {
+				t.Fatal("Couldn't create spool", err)
+			}
+
+			inner := &failingStrategy{failures: tt.failures}
+			strategy := NewSpoolStrategy(inner, s, "go-smtp", 1, 0)
+			if _, err = strategy.SendEmail([]byte("payload"), Envelope{From: "sender@example.com", To: []string{"a@example.com"}, Bcc: []string{"b@example.com"}}); (err != nil) != tt.wantErr {
+				t.Errorf("SendEmail() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			entries, _ := s.List()
+			if len(entries) != tt.wantSpooled {
+				t.Fatalf("Expected %d spooled entries, got %d", tt.wantSpooled, len(entries))
+			}
+			if tt.wantSpooled > 0 {
+				entry := entries[0]
+				if entry.Channel != "go-smtp" || entry.Sender != "sender@example.com" || fmt.Sprint(entry.To, entry.Bcc) != "[a@example.com] [b@example.com]" ||
+					string(entry.Payload) != "payload" || entry.Attempts != 1 {
+					t.Errorf("Unexpected spool entry %+v", entry)
+				}
+			}
+		})
+	}
+}
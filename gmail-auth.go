@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	configmodule "login-monitor/config"
+	emailmodule "login-monitor/email"
+	"os"
+	"strings"
+	"time"
+)
+
+// gmailAuthTimeout time the user has to authorize the access in the browser
+const gmailAuthTimeout = 10 * time.Minute
+
+// gmailAuth obtains the OAuth 2 token of the first channel that uses one (see gmailAuthConfig and
+// emailmodule.AuthorizeOAuth2) and writes it to the channel's token file
+func gmailAuth(channels []configmodule.ChannelConfig, credentialsFile, tokenFile string) error {
+	oauth2Config, tokenFile, err := gmailAuthConfig(channels, credentialsFile, tokenFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gmailAuthTimeout)
+	defer cancel()
+	token, err := emailmodule.AuthorizeOAuth2(ctx, oauth2Config, os.Stdin, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	if err = emailmodule.SaveOAuth2Token(tokenFile, token); err != nil {
+		return err
+	}
+	fmt.Printf("Token was written to %s\n", tokenFile)
+	return nil
+}
+
+// gmailAuthConfig returns the OAuth 2 client config and the token file of the first gmail-oauth2 channel (gmail.send
+// scope) or go-smtp channel with oauth2 credentials (scope of Gmail's SMTP server, see emailmodule.GmailSMTPScope).
+// If there is no such channel, the given files are used with the gmail.send scope
+func gmailAuthConfig(channels []configmodule.ChannelConfig, credentialsFile, tokenFile string) (*oauth2.Config, string, error) {
+	for _, channel := range channels {
+		switch strings.TrimSpace(strings.ToLower(channel.Strategy)) {
+		case "gmail-oauth2":
+			oauth2Config, err := emailmodule.NewOAuth2Config(channel.Config, gmail.GmailSendScope)
+			return oauth2Config, channel.Token, err
+		case "go-smtp":
+			goSMTPConfig := configmodule.GoSMTPConfig{}
+			if err := readJSONConfig(channel.Config, &goSMTPConfig); err != nil {
+				return nil, "", err
+			}
+			if goSMTPConfig.OAuth2 != nil {
+				oauth2Config, err := emailmodule.NewGoSMTPOAuth2Config(&goSMTPConfig)
+				return oauth2Config, goSMTPConfig.OAuth2.TokenFile, err
+			}
+		}
+	}
+
+	oauth2Config, err := emailmodule.NewOAuth2Config(credentialsFile, gmail.GmailSendScope)
+	return oauth2Config, tokenFile, err
+}
@@ -4,11 +4,12 @@ go 1.16
 
 require (
 	cloud.google.com/go/compute v1.6.0 // indirect
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/emersion/go-msgauth v0.7.0
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	golang.org/x/net v0.0.0-20220412020605-290c469a71a5 // indirect
+	github.com/sirupsen/logrus v1.8.1
+	go.mozilla.org/pkcs7 v0.9.0
 	golang.org/x/oauth2 v0.0.0-20220411215720-9780585627b5
-	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
 	golang.org/x/xerrors v0.0.0-20220411194840-2f41105eb62f // indirect
 	google.golang.org/api v0.74.0
 	google.golang.org/genproto v0.0.0-20220414192740-2d67ff6cf2b4 // indirect
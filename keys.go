@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	configmodule "login-monitor/config"
+	emailmodule "login-monitor/email"
+	"login-monitor/notify"
+	"login-monitor/pgp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExpiryWarningDays = 14
+	keyCheckInterval         = 24 * time.Hour // interval between key checks in daemon mode
+	keyWarningSeverity       = "warning"
+)
+
+// checkKeys checks the validity of the PGP keys of the sender (private key) and the recipients (public keys),
+// including the recipients of every severity.
+// If any key is expired, revoked, can't be used or expires soon (see config.PGPConfig), a warning notification is
+// sent through the configured channels
+func checkKeys(config configmodule.EmailConfig) error {
+	backend, err := newPGPBackend(config.PGP)
+	if err != nil {
+		return fmt.Errorf("error while initiating pgp backend. %w", err)
+	}
+
+	warningDays := defaultExpiryWarningDays
+	if config.PGP.ExpiryWarningDays != nil {
+		warningDays = *config.PGP.ExpiryWarningDays
+	}
+
+	problems := keyProblems(backend, config, time.Duration(warningDays)*24*time.Hour, time.Now())
+	if len(problems) == 0 {
+		log.Infoln("PGP keys are valid")
+		return nil
+	}
+	for _, problem := range problems {
+		log.Warnln(problem)
+	}
+
+	subject := "PGP key problems on %h"
+	text := "The following PGP keys need your attention:\n\n- " + strings.Join(problems, "\n- ") + "\n"
+	newEmail := func() *emailmodule.Email {
+		return emailmodule.NewEmail(nil).
+			SetPGPBackend(backend).
+			InitFromConfig(&config).
+			SetSubject(subject).
+			SetTextMessage(text).
+			SetHtmlMessage("").
+			SetAttachments(nil)
+	}
+
+	email := newEmail()
+	return notifyChannels(config, newEmail, &notify.Notification{
+		Severity:    keyWarningSeverity,
+		Subject:     email.Subject(),
+		TextMessage: email.TextMessage(),
+	})
+}
+
+// keyProblems returns a description of each key that can't be used or expires within warning
+func keyProblems(backend pgp.Backend, config configmodule.EmailConfig, warning time.Duration, now time.Time) []string {
+	problems := make([]string, 0)
+	checked := make(map[string]bool)
+	check := func(public bool, entity configmodule.Entity) {
+		key := fmt.Sprintf("%t %s", public, entity.PGPKeyId)
+		if entity.PGPKeyId == "" || checked[key] {
+			return
+		}
+		checked[key] = true
+
+		info, err := backend.KeyInfo(public, entity.PGPKeyId)
+		if err != nil {
+			if entity.Encryption == configmodule.EncryptionRequire {
+				problems = append(problems, fmt.Sprintf("Key %s is required to encrypt emails for %s but it doesn't exist", entity.PGPKeyId, entity.Email))
+			} else {
+				log.Debugf("PGP key %s doesn't exist. %s", entity.PGPKeyId, err)
+			}
+			return
+		}
+
+		if err = info.Check(public, now); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s). It can't be used", capitalize(err.Error()), entity.Email))
+		} else if info.ExpiresWithin(warning, now) {
+			problems = append(problems, fmt.Sprintf(
+				"Key %s (%s) expires on %s",
+				entity.PGPKeyId,
+				entity.Email,
+				info.Expires.Format(time.RFC1123Z),
+			))
+		}
+	}
+
+	check(false, config.Sender)
+	recipients := append([]configmodule.Entity{config.Recipient}, config.Cc...)
+	recipients = append(recipients, config.Bcc...)
+	for _, severityConfig := range config.Severities {
+		recipients = append(recipients, severityConfig.Recipient)
+		recipients = append(recipients, severityConfig.Cc...)
+	}
+	for _, recipient := range recipients {
+		check(true, recipient)
+	}
+	return problems
+}
+
+// capitalize returns str with its first letter in upper case
+func capitalize(str string) string {
+	if str == "" {
+		return str
+	}
+	return strings.ToUpper(str[:1]) + str[1:]
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	configmodule "login-monitor/config"
+	"login-monitor/daemon"
 	emailmodule "login-monitor/email"
+	"login-monitor/notify"
+	"login-monitor/pam"
+	"login-monitor/rules"
+	"login-monitor/spool"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func configFlags(configPath, logLevel, strategy, gmailOAuth2Config, gmailOAuth2Token, goSMTPConfig *string) {
+func configFlags(configPath, logLevel, strategy, gmailOAuth2Config, gmailOAuth2Token, gmailServiceAccountConfig, goSMTPConfig, webhookConfig *string) {
 	flag.StringVar(
 		configPath,
 		"config",
@@ -29,7 +37,8 @@ func configFlags(configPath, logLevel, strategy, gmailOAuth2Config, gmailOAuth2T
 		strategy,
 		"strategy",
 		"gmail-oauth2",
-		"Strategy to use. Valid values are: gmail-oauth2, go-smtp",
+		"Strategy to use. Valid values are: gmail-oauth2, gmail-service-account, go-smtp, webhook. "+
+			"Ignored if channels are given in the config file",
 	)
 
 	// gmail-oauth2 config
@@ -46,6 +55,14 @@ func configFlags(configPath, logLevel, strategy, gmailOAuth2Config, gmailOAuth2T
 		"Token file for the gmail-oauth2 strategy",
 	)
 
+	// gmail-service-account config
+	flag.StringVar(
+		gmailServiceAccountConfig,
+		"gmail-service-account-config",
+		"service-account.json",
+		"Service account credentials file for the gmail-service-account strategy",
+	)
+
 	// go-smtp config
 	flag.StringVar(
 		goSMTPConfig,
@@ -53,6 +70,14 @@ func configFlags(configPath, logLevel, strategy, gmailOAuth2Config, gmailOAuth2T
 		"go-smtp-config.json",
 		"Config file for go-smtp strategy",
 	)
+
+	// webhook config
+	flag.StringVar(
+		webhookConfig,
+		"webhook-config",
+		"webhook-config.json",
+		"Config file for webhook strategy",
+	)
 }
 
 // ensures permissions for the executable that started the process are set to 500 (r-x --- ---)
@@ -116,9 +141,26 @@ func stringDefault(str, def string) string {
 func main() {
 	var configFile, logLevel, strategy string      // general configuration
 	var gmailOAuth2Config, gmailOAuth2Token string // gmail-oauth2 strategy config
+	var gmailServiceAccountConfig string           // gmail-service-account strategy config
 	var goSMTPConfig string                        // go-smtp strategy config
-	configFlags(&configFile, &logLevel, &strategy, &gmailOAuth2Config, &gmailOAuth2Token, &goSMTPConfig)
-	flag.Parse()
+	var webhookConfig string                       // webhook strategy config
+	configFlags(
+		&configFile,
+		&logLevel,
+		&strategy,
+		&gmailOAuth2Config,
+		&gmailOAuth2Token,
+		&gmailServiceAccountConfig,
+		&goSMTPConfig,
+		&webhookConfig,
+	)
+
+	// the first argument may be a command, e.g. login-monitor flush -config config.json
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	_ = flag.CommandLine.Parse(args) // flag.ExitOnError is used, so the error is always nil
 
 	if err := checkPermissions(); err != nil {
 		fmt.Println("Error while checking permissions.", err)
@@ -126,75 +168,295 @@ func main() {
 
 	setLogLevel(logLevel)
 
-	configReader, err := os.Open(configFile)
-	if err != nil {
-		log.Fatalf("Error while reading config file '%s'. %s", configFile, err)
+	config := configmodule.EmailConfig{}
+	if err := readJSONConfig(configFile, &config); err != nil {
+		// gmail-auth may be run before the config file is written, the OAuth 2 files can be given as flags
+		if command != "gmail-auth" || !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Error while reading config file '%s'. %s", configFile, err)
+		}
 	}
-	defer configReader.Close()
 
-	var email *emailmodule.Email
+	channelsConfig := config.Channels
+	if len(channelsConfig) == 0 {
+		// use the strategy given in the command line
+		switch strings.TrimSpace(strings.ToLower(strategy)) {
+		case "go-smtp", "gmail-oauth2", "gmail-service-account", "webhook":
+		default:
+			log.Warnf("%s is not recognized as a valid strategy. Using default gmail-oauth2 strategy", strategy)
+			strategy = "gmail-oauth2"
+		}
+		channelsConfig = []configmodule.ChannelConfig{{Strategy: strategy, Required: true}}
+	}
 
-selectStrategy:
-	switch strings.TrimSpace(strings.ToLower(strategy)) {
-	case "go-smtp":
-		// read go-smtp config
-		smtpConfigF, err := os.Open(goSMTPConfig)
-		if err != nil {
-			log.Fatalf("Couldn't read file %s: %s", goSMTPConfig, err)
+	// channels without config files use the ones given in the command line
+	for i := range channelsConfig {
+		channel := &channelsConfig[i]
+		switch strings.TrimSpace(strings.ToLower(channel.Strategy)) {
+		case "go-smtp":
+			channel.Config = stringDefault(channel.Config, goSMTPConfig)
+		case "webhook":
+			channel.Config = stringDefault(channel.Config, webhookConfig)
+		case "gmail-oauth2":
+			channel.Config = stringDefault(channel.Config, gmailOAuth2Config)
+			channel.Token = stringDefault(channel.Token, gmailOAuth2Token)
+		case "gmail-service-account":
+			channel.Config = stringDefault(channel.Config, gmailServiceAccountConfig)
+			channel.Impersonate = stringDefault(channel.Impersonate, config.Sender.Email)
 		}
-		defer smtpConfigF.Close()
-		smtpConfig := configmodule.GoSMTPConfig{}
-		err = json.NewDecoder(smtpConfigF).Decode(&smtpConfig)
-		if err != nil {
-			log.Fatalf("Error while parsing JSON config %s: %s", goSMTPConfig, err)
+	}
+	config.Channels = channelsConfig
+
+	switch command {
+	case "":
+		event := pam.NewLoginEventFromEnv()
+		if config.Daemon.Enabled && handToDaemon(event, config) {
+			return
+		}
+		if err := handleLogin(event, config); err != nil {
+			log.Fatalf("Error while sending notification. Config file: '%s'. %s", configFile, err)
+		}
+	case "flush":
+		if err := flushSpool(config); err != nil {
+			log.Fatalf("Error while flushing spool. Config file: '%s'. %s", configFile, err)
+		}
+	case "daemon":
+		if err := runDaemon(config); err != nil {
+			log.Fatalf("Error while running daemon. Config file: '%s'. %s", configFile, err)
+		}
+	case "check-keys":
+		if err := checkKeys(config); err != nil {
+			log.Fatalf("Error while checking PGP keys. Config file: '%s'. %s", configFile, err)
 		}
+	case "gmail-auth":
+		if err := gmailAuth(config.Channels, gmailOAuth2Config, gmailOAuth2Token); err != nil {
+			log.Fatalf("Error while obtaining Gmail Oauth 2 token. %s", err)
+		}
+	default:
+		log.Fatalf("%s is not recognized as a valid command. Valid commands are: flush, daemon, check-keys, gmail-auth", command)
+	}
+}
 
-		email = emailmodule.NewEmail(&emailmodule.GoSMTPStrategy{})
-		_, err = email.InitStrategy(
-			smtpConfig.Identity,
-			smtpConfig.Username,
-			smtpConfig.Password,
-			stringDefault(smtpConfig.Host, "127.0.0.1"),
-			stringDefault(smtpConfig.Port, "25"),
-		)
-		if err != nil {
-			log.Fatalf(
-				"Error while initiating go-smtp strategy. Config file: '%s'. %s",
-				goSMTPConfig,
-				err,
-			)
-		}
-	case "gmail-oauth2":
-		email = emailmodule.NewEmail(&emailmodule.GmailOAuth2Strategy{})
-		_, err = email.InitStrategy(gmailOAuth2Config, gmailOAuth2Token)
+// handToDaemon hands the login event to the daemon or, if the daemon is not reachable, to the spool
+// (the daemon handles spooled events when it flushes the spool).
+// Returns false if the event couldn't be handed to any of them, i.e. it must be handled by this process
+func handToDaemon(event *pam.LoginEvent, config configmodule.EmailConfig) bool {
+	socket := stringDefault(config.Daemon.Socket, daemon.DefaultSocket)
+	timeout := daemon.DefaultTimeout
+	if config.Daemon.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.Daemon.Timeout); err != nil {
+			log.Warnf("Invalid daemon timeout '%s'. Using default %s. %s", config.Daemon.Timeout, daemon.DefaultTimeout, err)
+			timeout = daemon.DefaultTimeout
+		}
+	}
+
+	err := daemon.Send(socket, event, timeout)
+	if err == nil {
+		log.Debugln("Login event handed to daemon")
+		return true
+	}
+	log.Warnf("Couldn't hand login event to daemon, spooling it. %s", err)
+
+	emailSpool := openSpool(config.Spool)
+	if emailSpool == nil {
+		return false
+	}
+	if err = emailSpool.Put(&spool.Entry{Event: event}); err != nil {
+		log.Warnf("Couldn't spool login event. %s", err)
+		return false
+	}
+	return true
+}
+
+// runDaemon listens for login events on the daemon socket, periodically flushes the spool and checks the PGP keys
+// (once a day) until SIGINT or SIGTERM is received
+func runDaemon(config configmodule.EmailConfig) error {
+	flushInterval := time.Minute
+	if config.Daemon.FlushInterval != "" {
+		var err error
+		if flushInterval, err = time.ParseDuration(config.Daemon.FlushInterval); err != nil {
+			return fmt.Errorf("invalid flush interval '%s'. %w", config.Daemon.FlushInterval, err)
+		}
+	}
+
+	server := daemon.NewServer(stringDefault(config.Daemon.Socket, daemon.DefaultSocket), func(event *pam.LoginEvent) error {
+		return handleLogin(event, config)
+	})
+	if err := server.Listen(); err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	checkKeysTicker := time.NewTicker(keyCheckInterval)
+	defer checkKeysTicker.Stop()
+	go func() {
+		if err := checkKeys(config); err != nil {
+			log.Errorf("Error while checking PGP keys. %s", err)
+		}
+	}()
+
+	log.Infof("Daemon listening on %s", stringDefault(config.Daemon.Socket, daemon.DefaultSocket))
+	for {
+		select {
+		case <-ticker.C:
+			if err := flushSpool(config); err != nil {
+				log.Errorf("Error while flushing spool. %s", err)
+			}
+		case <-checkKeysTicker.C:
+			if err := checkKeys(config); err != nil {
+				log.Errorf("Error while checking PGP keys. %s", err)
+			}
+		case sig := <-signals:
+			log.Infof("Received %s, waiting for in-flight events to be handled", sig)
+			return server.Close()
+		case err := <-serveErr:
+			_ = server.Close()
+			return err
+		}
+	}
+}
+
+// handleLogin evaluates the rules for the login event and sends the notification through the configured channels.
+// An error is returned if any required channel fails
+func handleLogin(event *pam.LoginEvent, config configmodule.EmailConfig) error {
+	log.Debugf("Login event: %+v", event)
+
+	config, send := config.ForEvent(event.Type)
+	if !send {
+		log.Infof("Event type '%s' is configured to be skipped. No email will be sent", event.Type)
+		return nil
+	}
+
+	rulesEngine, err := rules.NewEngine(config.Rules)
+	if err != nil {
+		return fmt.Errorf("error while reading rules. %w", err)
+	}
+	decision := rulesEngine.Evaluate(event)
+	if decision.Action == rules.Ignore {
+		log.Infof("Login ignored by rule '%s'. No email will be sent", decision.Rule)
+		return nil
+	}
+	log.Debugf("Login severity is '%s' (rule '%s')", decision.Severity, decision.Rule)
+	config = config.ForSeverity(decision.Severity)
+
+	pgpBackend, err := newPGPBackend(config.PGP)
+	if err != nil {
+		return fmt.Errorf("error while initiating pgp backend. %w", err)
+	}
+
+	newEmail := func() *emailmodule.Email {
+		return emailmodule.NewEmail(nil).SetLoginEvent(event).SetPGPBackend(pgpBackend).InitFromConfig(&config)
+	}
+
+	email := newEmail()
+	notification := &notify.Notification{
+		Event:       event,
+		Severity:    decision.Severity,
+		Rule:        decision.Rule,
+		Subject:     email.Subject(),
+		TextMessage: email.TextMessage(),
+	}
+	return notifyChannels(config, newEmail, notification)
+}
+
+// notifyChannels sends the notification through the configured channels.
+// Email channels send the email returned by newEmail. An error is returned if any required channel fails
+func notifyChannels(
+	config configmodule.EmailConfig,
+	newEmail func() *emailmodule.Email,
+	notification *notify.Notification,
+) error {
+	emailSpool := openSpool(config.Spool)
+
+	channels := make([]notify.Channel, 0, len(config.Channels))
+	failedRequired := make([]string, 0)
+	for _, channelConfig := range config.Channels {
+		name := channelName(channelConfig)
+		notifier, err := newNotifier(channelConfig, newEmail, emailSpool, config.Spool)
 		if err != nil {
-			log.Fatalf(
-				"Error while initiating gmail-oauth2 strategy. Config file: '%s', token file: '%s'. %s",
-				gmailOAuth2Config,
-				gmailOAuth2Token,
-				err,
-			)
+			if channelConfig.Required {
+				log.Errorf("Error while initiating required channel '%s'. %s", name, err)
+				failedRequired = append(failedRequired, name)
+			} else {
+				log.Warnf("Error while initiating best-effort channel '%s'. %s", name, err)
+			}
+			continue
 		}
-	default:
-		log.Warnf("%s is not recognized as a valid strategy. Using default gmail-oauth2 strategy", strategy)
-		strategy = "gmail-oauth2"
-		goto selectStrategy
+		channels = append(channels, notify.Channel{Name: name, Notifier: notifier, Required: channelConfig.Required})
 	}
 
-	config := configmodule.EmailConfig{}
-	err = json.NewDecoder(configReader).Decode(&config)
-	email.InitFromConfig(&config)
+	if _, err := notify.Dispatch(channels, notification); err != nil {
+		return err
+	}
+
+	if len(failedRequired) > 0 {
+		return fmt.Errorf("required channel(s) couldn't be initiated: %s", strings.Join(failedRequired, ", "))
+	}
+	return nil
+}
+
+// flushSpool tries to deliver the emails in the spool through the channels they were spooled for
+// and handles the login events that couldn't be handed to the daemon
+func flushSpool(config configmodule.EmailConfig) error {
+	emailSpool, err := spool.New(stringDefault(config.Spool.Dir, spool.DefaultDir))
 	if err != nil {
-		log.Fatalf("Error while decoding config file '%s'. %s", configFile, err)
+		return err
 	}
 
-	if email.IsPGPCandidate() {
-		if _, err := email.SendPGPEmail(); err != nil {
-			log.Fatalf("Error while sending PGP email. Config file: '%s'. %s", configFile, err)
+	strategies := map[string]emailmodule.EmailStrategy{}
+	delivered, remaining, err := emailSpool.Flush(func(entry *spool.Entry) error {
+		if entry.Event != nil {
+			// emails that can't be sent are spooled on their own, so the event is never handled twice
+			if err := handleLogin(entry.Event, config); err != nil {
+				log.Errorf("Error while handling spooled login event %s. %s", entry.ID, err)
+			}
+			return nil
 		}
-	} else {
-		if _, err := email.SendEmail(); err != nil {
-			log.Fatalf("Error while sending plain text email. Config file: '%s'. %s", configFile, err)
+
+		strategy, ok := strategies[entry.Channel]
+		if !ok {
+			channelConfig, found := findChannel(config.Channels, entry.Channel)
+			if !found {
+				return fmt.Errorf("channel '%s' is not configured", entry.Channel)
+			}
+
+			newStrategy, params, err := newEmailStrategy(channelConfig)
+			if err != nil {
+				return err
+			}
+			if _, err = newStrategy.Init(params...); err != nil {
+				return fmt.Errorf("error while initiating channel '%s'. %w", entry.Channel, err)
+			}
+			strategies[entry.Channel], strategy = newStrategy, newStrategy
+		}
+
+		envelope := emailmodule.Envelope{From: entry.Sender, To: entry.To, Bcc: entry.Bcc}
+		if len(envelope.To) == 0 && len(envelope.Bcc) == 0 { // entry spooled by an older version
+			legacyEnvelope, err := emailmodule.ParseEnvelope(entry.Payload, entry.Sender)
+			if err != nil {
+				return err
+			}
+			envelope = legacyEnvelope
 		}
+		_, err := strategy.SendEmail(entry.Payload, envelope)
+		if err != nil { // the entry is rescheduled with the recipients the email wasn't delivered to
+			envelope = emailmodule.RemainingEnvelope(envelope, err)
+			entry.To, entry.Bcc = envelope.To, envelope.Bcc
+		}
+		return err
+	})
+	if delivered > 0 || remaining > 0 {
+		log.Infof("%d spool entries delivered, %d entries remaining in the spool", delivered, remaining)
 	}
+	return err
 }
@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+// Channel a notifier with a failure policy
+type Channel struct {
+	Name     string
+	Notifier Notifier
+	Required bool // if true, a failure in this channel makes Dispatch return an error
+}
+
+// Result result of sending a notification through a channel
+type Result struct {
+	Channel  *Channel
+	Response interface{}
+	Err      error
+}
+
+// DispatchError error returned by Dispatch when at least one required channel failed
+type DispatchError struct {
+	Failed []Result // results of the required channels that failed
+}
+
+func (e *DispatchError) Error() string {
+	msgs := make([]string, 0, len(e.Failed))
+	for _, result := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("channel '%s': %s", result.Channel.Name, result.Err))
+	}
+	return "required channel(s) failed. " + strings.Join(msgs, "; ")
+}
+
+// Dispatch sends the notification through all the channels concurrently and waits for all of them to finish.
+//
+// Failures of best-effort (not required) channels are only logged.
+// If any required channel fails, a *DispatchError is returned
+func Dispatch(channels []Channel, notification *Notification) ([]Result, error) {
+	results := make([]Result, len(channels))
+
+	var wg sync.WaitGroup
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			channel := &channels[i]
+			log.Debugf("Sending notification through channel '%s'", channel.Name)
+			res, err := channel.Notifier.Notify(notification)
+			results[i] = Result{Channel: channel, Response: res, Err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []Result
+	for _, result := range results {
+		if result.Err == nil {
+			log.Debugf("Done sending notification through channel '%s'", result.Channel.Name)
+			continue
+		}
+		if result.Channel.Required {
+			failed = append(failed, result)
+		} else {
+			log.Warnf("Couldn't send notification through best-effort channel '%s'. %s", result.Channel.Name, result.Err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, &DispatchError{Failed: failed}
+	}
+	return results, nil
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"errors"
+	"login-monitor/pam"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeNotifier struct {
+	err   error
+	calls int32
+}
+
+func (n *fakeNotifier) Init(...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (n *fakeNotifier) Notify(*Notification) (interface{}, error) {
+	atomic.AddInt32(&n.calls, 1)
+	time.Sleep(10 * time.Millisecond)
+	return nil, n.err
+}
+
+func TestDispatch(t *testing.T) {
+	failure := errors.New("relay unreachable")
+
+	tests := []struct {
+		name       string
+		channels   []Channel
+		wantErr    bool
+		wantFailed int
+	}{
+		{
+			"Testing all channels succeed",
+			[]Channel{{"smtp", &fakeNotifier{}, true}, {"webhook", &fakeNotifier{}, true}},
+			false,
+			0,
+		},
+		{
+			"Testing best-effort channel fails",
+			[]Channel{{"smtp", &fakeNotifier{}, true}, {"webhook", &fakeNotifier{err: failure}, false}},
+			false,
+			0,
+		},
+		{
+			"Testing required channel fails",
+			[]Channel{{"smtp", &fakeNotifier{err: failure}, true}, {"webhook", &fakeNotifier{err: failure}, false}, {"file", &fakeNotifier{}, true}},
+			true,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Dispatch(tt.channels, &Notification{Event: &pam.LoginEvent{}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Dispatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var dispatchErr *DispatchError
+				if !errors.As(err, &dispatchErr) || len(dispatchErr.Failed) != tt.wantFailed {
+					t.Errorf("Dispatch() should return a DispatchError with %d failed channels, got %v", tt.wantFailed, err)
+				}
+			}
+			if len(results) != len(tt.channels) {
+				t.Errorf("Dispatch() returned %d results, want %d", len(results), len(tt.channels))
+			}
+			for _, channel := range tt.channels {
+				if calls := channel.Notifier.(*fakeNotifier).calls; calls != 1 {
+					t.Errorf("Channel '%s' was called %d times, want 1", channel.Name, calls)
+				}
+			}
+		})
+	}
+}
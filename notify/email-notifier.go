@@ -0,0 +1,27 @@
+package notify
+
+import (
+	"login-monitor/email"
+)
+
+// EmailNotifier sends notifications as emails with the given email.Email (and its strategy).
+//
+// The contents of the email are taken from the email.Email, not from the Notification
+type EmailNotifier struct {
+	email *email.Email
+}
+
+// NewEmailNotifier creates a new EmailNotifier for the given email
+func NewEmailNotifier(email *email.Email) *EmailNotifier {
+	return &EmailNotifier{email: email}
+}
+
+// Init simply calls email.Email.InitStrategy with the given params
+func (n *EmailNotifier) Init(params ...interface{}) (interface{}, error) {
+	return n.email.InitStrategy(params...)
+}
+
+// Notify sends the email. The email is PGP-encrypted and/or signed according to its PGP mode (see email.Email.Send)
+func (n *EmailNotifier) Notify(*Notification) (interface{}, error) {
+	return n.email.Send()
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileNotifier appends notifications to a local file as JSON lines
+type FileNotifier struct {
+	path string
+}
+
+// Init initiates the file notifier (required by other methods)
+// 1st param: path to the log file. It is created if it doesn't exist
+// Returns nothing
+func (n *FileNotifier) Init(params ...interface{}) (interface{}, error) {
+	if len(params) == 0 || fmt.Sprint(params[0]) == "" {
+		return nil, errors.New("log file path is required")
+	}
+	n.path = fmt.Sprint(params[0])
+	return nil, nil
+}
+
+// Notify appends the notification to the file as a single JSON line. Returns nothing but an error, if any.
+func (n *FileNotifier) Notify(notification *Notification) (interface{}, error) {
+	if n.path == "" {
+		return nil, errors.New("notifier needs to be initiated")
+	}
+
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open log file: %w", err)
+	}
+	defer file.Close()
+
+	// a single write call with O_APPEND keeps lines from concurrent logins from being interleaved
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("couldn't write to log file: %w", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"login-monitor/pam"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logins.log")
+
+	notifier := &FileNotifier{}
+	if _, err := notifier.Init(path); err != nil {
+		t.Fatal("Couldn't initiate file notifier", err)
+	}
+	for _, user := range []string{"root", "benja"} {
+		if _, err := notifier.Notify(&Notification{Event: &pam.LoginEvent{User: user}}); err != nil {
+			t.Fatal("Couldn't notify", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Couldn't open log file", err)
+	}
+	defer file.Close()
+
+	var users []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var notification Notification
+		if err := json.Unmarshal(scanner.Bytes(), &notification); err != nil {
+			t.Fatal("Couldn't decode line", err)
+		}
+		users = append(users, notification.Event.User)
+	}
+	if len(users) != 2 || users[0] != "root" || users[1] != "benja" {
+		t.Errorf("Expected notifications for root and benja, got %v", users)
+	}
+}
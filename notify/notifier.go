@@ -0,0 +1,25 @@
+package notify
+
+import (
+	"login-monitor/pam"
+)
+
+// Notification data about a login to be notified
+type Notification struct {
+	Event       *pam.LoginEvent `json:"event"`
+	Severity    string          `json:"severity"`       // severity assigned by the rules, e.g. info
+	Rule        string          `json:"rule,omitempty"` // name of the rule that matched (if any)
+	Subject     string          `json:"subject"`        // subject with placeholders replaced
+	TextMessage string          `json:"textMessage"`    // text message with placeholders replaced
+}
+
+// Notifier sends notifications about logins through a channel (email, webhook...).
+//
+// Notifier is the generic version of email.EmailStrategy, i.e. it is not tied to email payloads
+type Notifier interface {
+	// Init initialize the notifier. Read config files, credentials, etc..
+	Init(...interface{}) (interface{}, error)
+
+	// Notify sends the given notification
+	Notify(notification *Notification) (interface{}, error)
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"login-monitor/config"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SignatureHeader header containing the HMAC-SHA256 signature of the body, e.g. sha256=<hex encoded signature>
+const SignatureHeader = "X-Login-Monitor-Signature"
+
+// DefaultWebhookTimeout timeout used if none is configured
+const DefaultWebhookTimeout = 10 * time.Second
+
+// WebhookNotifier POSTs notifications as JSON to a URL
+type WebhookNotifier struct {
+	url     string
+	headers map[string]string
+	secret  []byte
+	client  *http.Client
+}
+
+// Init initiates the webhook notifier (required by other methods)
+// 1st param: *config.WebhookConfig
+// Returns nothing
+func (n *WebhookNotifier) Init(params ...interface{}) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, errors.New("webhook config is required")
+	}
+	webhookConfig, ok := params[0].(*config.WebhookConfig)
+	if !ok {
+		return nil, fmt.Errorf("webhook config must be a *config.WebhookConfig, got %T", params[0])
+	}
+	if webhookConfig.URL == "" {
+		return nil, errors.New("webhook url is required")
+	}
+
+	timeout := DefaultWebhookTimeout
+	if webhookConfig.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(webhookConfig.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid webhook timeout '%s'. %w", webhookConfig.Timeout, err)
+		}
+	}
+
+	secret := webhookConfig.Secret
+	if secret == "" && webhookConfig.SecretFile != "" {
+		contents, err := os.ReadFile(webhookConfig.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading webhook secret: %w", err)
+		}
+		secret = strings.TrimSpace(string(contents))
+	}
+
+	n.url = webhookConfig.URL
+	n.headers = webhookConfig.Headers
+	n.secret = []byte(secret)
+	n.client = &http.Client{Timeout: timeout}
+
+	return nil, nil
+}
+
+// Notify POSTs the notification as JSON. If a secret is configured, the body is signed and the signature
+// is sent in the SignatureHeader header.
+// Returns the HTTP status code. Any status code other than 2xx is considered an error
+func (n *WebhookNotifier) Notify(notification *Notification) (interface{}, error) {
+	if n.client == nil {
+		return nil, errors.New("notifier needs to be initiated")
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "login-monitor")
+	for name, value := range n.headers {
+		req.Header.Set(name, value)
+	}
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(body, n.secret))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't send webhook: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using the given secret
+func Sign(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
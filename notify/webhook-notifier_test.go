@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"login-monitor/config"
+	"login-monitor/pam"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	const secret = "s3cr3t"
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Method != http.MethodPost {
+			t.Errorf("Expected POST, got %s", r.Method)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected JSON content type, got %s", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Custom header was not sent")
+		}
+		expectedSignature := "sha256=" + Sign(body, []byte(secret))
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(expectedSignature)) {
+			t.Errorf("Invalid signature %s, want %s", r.Header.Get(SignatureHeader), expectedSignature)
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error("Couldn't decode body", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{}
+	_, err := notifier.Init(&config.WebhookConfig{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Secret:  secret,
+	})
+	if err != nil {
+		t.Fatal("Couldn't initiate webhook notifier", err)
+	}
+
+	notification := &Notification{
+		Event:    &pam.LoginEvent{User: "root", RemoteHost: "192.168.1.10", Service: "sshd", Type: pam.OpenSession},
+		Severity: "critical",
+		Subject:  "New login on server",
+	}
+	status, err := notifier.Notify(notification)
+	if err != nil {
+		t.Fatal("Couldn't notify", err)
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %v", http.StatusNoContent, status)
+	}
+	if received.Event == nil || received.Event.User != "root" || received.Severity != "critical" || received.Subject != notification.Subject {
+		t.Errorf("Notification was not received correctly. Got %+v", received)
+	}
+}
+
+func TestWebhookNotifyErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		config config.WebhookConfig
+	}{
+		{"Testing error status", config.WebhookConfig{URL: server.URL}},
+		{"Testing timeout", config.WebhookConfig{URL: server.URL + "/slow", Timeout: "50ms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &WebhookNotifier{}
+			if _, err := notifier.Init(&tt.config); err != nil {
+				t.Fatal("Couldn't initiate webhook notifier", err)
+			}
+			if _, err := notifier.Notify(&Notification{Event: &pam.LoginEvent{}}); err == nil {
+				t.Error("Notify() should return an error")
+			}
+		})
+	}
+}
+
+func TestWebhookInitInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []interface{}
+	}{
+		{"Testing no config", nil},
+		{"Testing wrong config type", []interface{}{"https://example.com"}},
+		{"Testing missing url", []interface{}{&config.WebhookConfig{}}},
+		{"Testing invalid timeout", []interface{}{&config.WebhookConfig{URL: "https://example.com", Timeout: "10"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := (&WebhookNotifier{}).Init(tt.params...); err == nil {
+				t.Error("Init() should return an error")
+			}
+		})
+	}
+}
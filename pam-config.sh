@@ -21,6 +21,7 @@ for arg in "$@" ; do
       echo ""
       echo "Options:"
       echo "--required: Tells PAM to disallow user login if login-monitor executable fails (use for production)"
+      echo "            login-monitor fails only if a channel marked as required in the config file fails"
       echo "--optional: Tells PAM to allow user to login even if login-monitor executable fails (use for testing)"
       echo "--config-path: Path to the file to be modified."
       echo "               Example of config files: /etc/pam.d/sshd, /etc/pam.d/common-auth."
@@ -0,0 +1,50 @@
+package pam
+
+import (
+	"os"
+	"time"
+)
+
+// PAM event types (values of PAM_TYPE)
+const (
+	OpenSession  = "open_session"
+	CloseSession = "close_session"
+	Auth         = "auth"
+	Account      = "account"
+	Password     = "password"
+)
+
+// LoginEvent holds the context of the PAM session that triggered the execution of the program.
+//
+// When the program runs under pam_exec, PAM items are exported as environment variables (see pam_exec(8)).
+// If the program is not run by pam_exec, all the PAM fields will be empty
+type LoginEvent struct {
+	User       string    `json:"user"`       // PAM_USER, the user that logged in, e.g. root
+	RemoteUser string    `json:"remoteUser"` // PAM_RUSER, the user on the remote host (usually empty for sshd)
+	RemoteHost string    `json:"remoteHost"` // PAM_RHOST, the remote host the user logged in from, e.g. 192.168.1.10
+	Service    string    `json:"service"`    // PAM_SERVICE, the service that invoked PAM, e.g. sshd
+	TTY        string    `json:"tty"`        // PAM_TTY, the terminal the user logged in on, e.g. ssh or /dev/pts/0
+	Type       string    `json:"type"`       // PAM_TYPE, the PAM module type, e.g. open_session
+	Hostname   string    `json:"hostname"`   // local hostname
+	Time       time.Time `json:"time"`       // time the event was created
+}
+
+// NewLoginEventFromEnv creates a new LoginEvent from the environment variables exported by pam_exec
+func NewLoginEventFromEnv() *LoginEvent {
+	return NewLoginEvent(os.Getenv)
+}
+
+// NewLoginEvent creates a new LoginEvent reading PAM items with the given function (e.g. os.Getenv)
+func NewLoginEvent(getenv func(string) string) *LoginEvent {
+	hostname, _ := os.Hostname()
+	return &LoginEvent{
+		User:       getenv("PAM_USER"),
+		RemoteUser: getenv("PAM_RUSER"),
+		RemoteHost: getenv("PAM_RHOST"),
+		Service:    getenv("PAM_SERVICE"),
+		TTY:        getenv("PAM_TTY"),
+		Type:       getenv("PAM_TYPE"),
+		Hostname:   hostname,
+		Time:       time.Now(),
+	}
+}
@@ -0,0 +1,23 @@
+package pam
+
+import "testing"
+
+func TestNewLoginEvent(t *testing.T) {
+	env := map[string]string{
+		"PAM_USER":    "root",
+		"PAM_RUSER":   "benja",
+		"PAM_RHOST":   "192.168.1.10",
+		"PAM_SERVICE": "sshd",
+		"PAM_TTY":     "ssh",
+		"PAM_TYPE":    "open_session",
+	}
+	event := NewLoginEvent(func(key string) string { return env[key] })
+
+	if event.User != "root" || event.RemoteUser != "benja" || event.RemoteHost != "192.168.1.10" ||
+		event.Service != "sshd" || event.TTY != "ssh" || event.Type != "open_session" {
+		t.Errorf("PAM items were not read correctly. Got %+v", event)
+	}
+	if event.Time.IsZero() {
+		t.Error("Event time should be set")
+	}
+}
@@ -0,0 +1,24 @@
+package pgp
+
+import "crypto"
+
+// Backend OpenPGP implementation used to encrypt and sign emails.
+//
+// Keys are referenced by ids, which can be key ids (e.g. 0x7ADE4B572836C909), fingerprints or emails
+type Backend interface {
+	// Encrypt encrypts data with the public keys of the given recipients. The output is ASCII armored.
+	// An error is returned if the public key of any recipient doesn't exist
+	Encrypt(data []byte, recipients ...string) ([]byte, error)
+
+	// Sign creates an ASCII armored detached signature of data with the private key of signer.
+	// passphraseFile is the path to the private key's passphrase (it can be empty if the key is not protected).
+	// Returns the signature and the hash used to create it (see MICAlg)
+	Sign(data []byte, signer, passphraseFile string) ([]byte, crypto.Hash, error)
+
+	// KeyExists tells whether the public/private key exists for ANY of the given ids
+	KeyExists(public bool, ids ...string) bool
+
+	// KeyInfo returns the validity of the public/private key for the given id.
+	// An error is returned if the key doesn't exist
+	KeyInfo(public bool, id string) (*KeyInfo, error)
+}
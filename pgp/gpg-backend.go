@@ -0,0 +1,190 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// GPGBackend Backend implementation executing the gpg binary.
+// IMPORTANT: This requires gpg installed on the system. Keys are read from the keyring of the user running the process
+type GPGBackend struct {
+	lookup *KeyLookup // nil if keys are not looked up
+
+	// imported fingerprints of the retrieved keys imported for each id ("" if no key could be imported).
+	// It's guarded by mutex, as the backend may be shared by concurrent channels
+	imported map[string]string
+	mutex    sync.Mutex
+}
+
+// SetKeyLookup sets the KeyLookup used to retrieve public keys. Retrieved keys are imported into the keyring and
+// used by their fingerprint, so a stale key for the same id that's still in the keyring (e.g. after the recipient
+// rotated their key) is never used
+func (b *GPGBackend) SetKeyLookup(lookup *KeyLookup) *GPGBackend {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lookup = lookup
+	b.imported = make(map[string]string)
+	return b
+}
+
+// Encrypt Encrypt the given data using gpg and the public keys for the given recipients
+func (b *GPGBackend) Encrypt(data []byte, recipients ...string) ([]byte, error) {
+	gpgArgs := []string{"--batch", "--pinentry-mode", "loopback", "--encrypt", "--armor", "--trust-model", "always"}
+	for _, recipient := range b.importKeys(recipients...) {
+		gpgArgs = append(gpgArgs, "--recipient", recipient)
+	}
+
+	log.Debugln("Encrypting data. Executing gpg", gpgArgs)
+	encrypted, stderr, err := runGPG(data, gpgArgs...)
+	if err != nil { // if recipient's key doesn't exist, this will return an error
+		return nil, fmt.Errorf("error while encrypting PGP message, pgp stderr: \"%s\". %w", stderr, err)
+	}
+	return encrypted, nil
+}
+
+// Sign signs the given data and returns the signature.
+// The hash is the one gpg chose for the signer's key, which is read from the gpg status output
+func (b *GPGBackend) Sign(data []byte, signer, passphraseFile string) ([]byte, crypto.Hash, error) {
+	gpgArgs := []string{
+		"--batch",
+		"--status-fd", "2",
+		"--pinentry-mode", "loopback",
+		"--armor",
+		"--trust-model", "always",
+		"--detach-sig",
+		"--local-user", signer,
+	}
+	if passphraseFile != "" {
+		gpgArgs = append(gpgArgs, "--passphrase-file", passphraseFile)
+	}
+
+	log.Debugln("Signing data. Executing gpg", gpgArgs)
+	signature, stderr, err := runGPG(data, gpgArgs...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while signing PGP message, pgp stderr: \"%s\". %w", stderr, err)
+	}
+	hash, err := parseSigCreated(stderr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't determine the hash used to sign PGP message. %w", err)
+	}
+	return signature, hash, nil
+}
+
+// KeyExists Tells whether the public/private exists in the gpg keyring for ANY of the ids given.
+func (b *GPGBackend) KeyExists(public bool, ids ...string) bool {
+	if public {
+		ids = b.importKeys(ids...)
+	}
+	gpgArgs := []string{"--list-public-keys", "--batch", "--with-colons"} // with-colons is actually not needed (for now)
+	if !public {
+		gpgArgs[0] = "--list-secret-keys"
+	}
+	gpgArgs = append(gpgArgs, ids...)
+
+	if err := exec.Command("gpg", gpgArgs...).Run(); err != nil { // key doesn't exist
+		return false
+	}
+	return true
+}
+
+// KeyInfo returns the validity of the public/private key for the given id, as listed by gpg
+func (b *GPGBackend) KeyInfo(public bool, id string) (*KeyInfo, error) {
+	listArg, gpgID := "--list-public-keys", id
+	if public {
+		gpgID = b.importKeys(id)[0]
+	} else {
+		listArg = "--list-secret-keys"
+	}
+
+	output, stderr, err := runGPG(nil, "--batch", "--with-colons", "--fixed-list-mode", listArg, gpgID)
+	if err != nil {
+		return nil, fmt.Errorf("key for %s doesn't exist, gpg stderr: \"%s\". %w", id, stderr, err)
+	}
+	info := bestKeyInfo(parseColonsKeyInfo(output, id, public, time.Now()), public, time.Now())
+	if info == nil {
+		return nil, fmt.Errorf("key for %s doesn't exist", id)
+	}
+	return info, nil
+}
+
+// importKeys retrieves the keys for the given ids with the key lookup (if any) and imports them into the keyring.
+// Keys are imported only once.
+//
+// Returns the ids gpg must be given instead of the given ids: the fingerprint of the imported key or, if no key was
+// imported, the id itself
+func (b *GPGBackend) importKeys(ids ...string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lookup == nil {
+		return ids
+	}
+
+	gpgIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		fingerprint, ok := b.imported[id]
+		if !ok && id != "" {
+			fingerprint = b.importKey(id)
+			b.imported[id] = fingerprint
+		}
+		if fingerprint == "" {
+			fingerprint = id
+		}
+		gpgIDs = append(gpgIDs, fingerprint)
+	}
+	return gpgIDs
+}
+
+// importKey retrieves the keys for the given id with the key lookup and imports them into the keyring.
+// Returns the fingerprint of the key to use (see bestKey), or an empty string if the keys couldn't be imported
+func (b *GPGBackend) importKey(id string) string {
+	keys, err := b.lookup.Lookup(id)
+	if err != nil {
+		log.Debugf("Couldn't look up key for %s, using keyring. %s", id, err)
+		return ""
+	}
+	serialized := bytes.Buffer{}
+	for _, key := range keys {
+		if err = key.Serialize(&serialized); err != nil {
+			log.Warnf("Couldn't serialize key for %s. %s", id, err)
+			return ""
+		}
+	}
+
+	log.Debugln("Importing key for", id)
+	if _, stderr, err := runGPG(serialized.Bytes(), "--batch", "--import"); err != nil {
+		log.Warnf("Couldn't import key for %s, gpg stderr: \"%s\". %s", id, stderr, err)
+		return ""
+	}
+	return fmt.Sprintf("%X", bestKey(keys, id, time.Now()).PrimaryKey.Fingerprint)
+}
+
+// runGPG executes gpg with the given args writing data to its stdin. Returns stdout and stderr
+func runGPG(data []byte, args ...string) ([]byte, []byte, error) {
+	cmd := exec.Command("gpg", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		defer stdin.Close() // we need to close it, otherwise gpg will keep reading from it and block the thread
+		_, _ = stdin.Write(data)
+	}()
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, stderr.Bytes(), err
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
@@ -0,0 +1,226 @@
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyInfo validity of a key
+type KeyInfo struct {
+	ID          string    // id the key was requested with
+	Fingerprint string    // fingerprint of the primary key
+	Expires     time.Time // time the key stops being usable to encrypt (public keys) or sign (private keys). Zero if it doesn't expire
+	Revoked     bool
+	CanEncrypt  bool // the key (or any of its subkeys) can be used to encrypt
+	CanSign     bool // the key (or any of its subkeys) can be used to sign
+}
+
+// Expired tells if the key is expired at the given time
+func (k *KeyInfo) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// ExpiresWithin tells if the key expires within d from the given time (or it is already expired)
+func (k *KeyInfo) ExpiresWithin(d time.Duration, now time.Time) bool {
+	return !k.Expires.IsZero() && now.Add(d).After(k.Expires)
+}
+
+// Check returns an error telling why the key can't be used to encrypt (public is true) or sign at the given time.
+// nil is returned if the key can be used
+func (k *KeyInfo) Check(public bool, now time.Time) error {
+	switch {
+	case k.Revoked:
+		return fmt.Errorf("key %s is revoked", k.ID)
+	case k.Expired(now):
+		return fmt.Errorf("key %s expired on %s", k.ID, k.Expires.Format(time.RFC1123Z))
+	case public && !k.CanEncrypt:
+		return fmt.Errorf("key %s can't be used to encrypt", k.ID)
+	case !public && !k.CanSign:
+		return fmt.Errorf("key %s can't be used to sign", k.ID)
+	}
+	return nil
+}
+
+// newKeyInfo returns the validity of the key at the given time
+func newKeyInfo(key *openpgp.Entity, id string, public bool, now time.Time) *KeyInfo {
+	info := &KeyInfo{
+		ID:          id,
+		Fingerprint: fmt.Sprintf("%X", key.PrimaryKey.Fingerprint),
+		Revoked:     key.Revoked(now),
+	}
+	selfSignature, _ := key.PrimarySelfSignature()
+	if selfSignature == nil { // key can't be used at all
+		return info
+	}
+	info.Expires = keyExpiry(key.PrimaryKey, selfSignature)
+
+	encryptionKey, canEncrypt := key.EncryptionKey(now)
+	signingKey, canSign := key.SigningKey(now)
+	info.CanEncrypt, info.CanSign = canEncrypt, canSign
+
+	usableKey, usable := encryptionKey, canEncrypt
+	if !public {
+		usableKey, usable = signingKey, canSign
+	}
+	if usable {
+		info.Expires = earliest(info.Expires, keyExpiry(usableKey.PublicKey, usableKey.SelfSignature))
+		return info
+	}
+	if info.Revoked || info.Expired(now) {
+		return info
+	}
+
+	// primary key is valid, but the subkeys with the required capability may be expired
+	var lastExpiry time.Time
+	for _, subkey := range key.Subkeys {
+		if subkey.Sig == nil || !subkey.Sig.FlagsValid ||
+			(public && !subkey.Sig.FlagEncryptCommunications) || (!public && !subkey.Sig.FlagSign) {
+			continue
+		}
+		if expiry := keyExpiry(subkey.PublicKey, subkey.Sig); !expiry.IsZero() && expiry.After(lastExpiry) {
+			lastExpiry = expiry
+		}
+	}
+	if !lastExpiry.IsZero() && !now.Before(lastExpiry) {
+		info.Expires = lastExpiry
+	}
+	return info
+}
+
+// keyExpiry returns the expiration time of the key given its self-signature. Zero if the key doesn't expire
+func keyExpiry(key *packet.PublicKey, selfSignature *packet.Signature) time.Time {
+	if selfSignature == nil || selfSignature.KeyLifetimeSecs == nil || *selfSignature.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return key.CreationTime.Add(time.Duration(*selfSignature.KeyLifetimeSecs) * time.Second)
+}
+
+// earliest returns the earliest of the given times. Zero times (no expiration) are ignored
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// parseColonsKeyInfo parses the output of gpg --list-keys --with-colons (or --list-secret-keys) and returns the
+// validity of each key. See https://github.com/gpg/gnupg/blob/master/doc/DETAILS
+func parseColonsKeyInfo(output []byte, id string, public bool, now time.Time) []*KeyInfo {
+	infos := make([]*KeyInfo, 0, 1)
+	var info *KeyInfo
+	var subkeyExpires, subkeyLastExpiry time.Time // expiration of the usable subkeys and of the last expired subkey
+	var hasUsableSubkey bool
+
+	finish := func() {
+		if info == nil {
+			return
+		}
+		if hasUsableSubkey {
+			info.Expires = earliest(info.Expires, subkeyExpires)
+		} else if !subkeyLastExpiry.IsZero() && !info.Revoked && !info.Expired(now) {
+			info.Expires = subkeyLastExpiry
+		}
+		infos = append(infos, info)
+	}
+
+	capability := "e"
+	if !public {
+		capability = "s"
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if fields[0] == "fpr" && len(fields) > 9 && info != nil && info.Fingerprint == "" {
+			info.Fingerprint = fields[9] // first fpr record after the primary key is its fingerprint
+			continue
+		}
+		if len(fields) < 12 {
+			continue
+		}
+
+		validity, expires, capabilities := fields[1], parseColonsTime(fields[6]), fields[11]
+		switch fields[0] {
+		case "pub", "sec":
+			finish()
+			info = &KeyInfo{
+				ID:         id,
+				Expires:    expires,
+				Revoked:    validity == "r",
+				CanEncrypt: strings.Contains(capabilities, "E"),
+				CanSign:    strings.Contains(capabilities, "S"),
+			}
+			subkeyExpires, subkeyLastExpiry, hasUsableSubkey = time.Time{}, time.Time{}, false
+		case "sub", "ssb":
+			if info == nil || !strings.Contains(capabilities, capability) || validity == "r" {
+				continue
+			}
+			if validity == "e" || (!expires.IsZero() && !now.Before(expires)) {
+				if expires.After(subkeyLastExpiry) {
+					subkeyLastExpiry = expires
+				}
+				continue
+			}
+			// the usable subkey that expires last is the one that will be used
+			if !hasUsableSubkey || (!subkeyExpires.IsZero() && (expires.IsZero() || expires.After(subkeyExpires))) {
+				subkeyExpires = expires
+			}
+			hasUsableSubkey = true
+		}
+	}
+	finish()
+	return infos
+}
+
+// parseColonsTime parses a timestamp in the gpg colons format (seconds since epoch or ISO 8601).
+// Zero is returned if the timestamp is empty or invalid
+func parseColonsTime(timestamp string) time.Time {
+	if timestamp == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(seconds, 0)
+	}
+	if t, err := time.Parse("20060102T150405", timestamp); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// bestKeyInfo returns the first key that can be used, or the first key if none can be used.
+// nil is returned if there are no keys
+func bestKeyInfo(infos []*KeyInfo, public bool, now time.Time) *KeyInfo {
+	for _, info := range infos {
+		if info.Check(public, now) == nil {
+			return info
+		}
+	}
+	if len(infos) > 0 {
+		return infos[0]
+	}
+	return nil
+}
+
+// bestKey returns the newest key (by creation time) that can be used to encrypt, or the first key if none can be
+// used (so the caller can tell why). nil is returned if there are no keys
+func bestKey(keys openpgp.EntityList, id string, now time.Time) *openpgp.Entity {
+	var best *openpgp.Entity
+	for _, key := range keys {
+		if newKeyInfo(key, id, true, now).Check(true, now) != nil {
+			continue
+		}
+		if best == nil || key.PrimaryKey.CreationTime.After(best.PrimaryKey.CreationTime) {
+			best = key
+		}
+	}
+	if best == nil && len(keys) > 0 {
+		return keys[0]
+	}
+	return best
+}
@@ -0,0 +1,166 @@
+package pgp
+
+import (
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"testing"
+	"time"
+)
+
+func TestKeyInfoCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		info   KeyInfo
+		public bool
+		err    bool
+	}{
+		{"Testing valid key", KeyInfo{CanEncrypt: true, CanSign: true}, true, false},
+		{"Testing valid expiring key", KeyInfo{Expires: now.Add(time.Hour), CanEncrypt: true}, true, false},
+		{"Testing expired key", KeyInfo{Expires: now.Add(-time.Hour), CanEncrypt: true}, true, true},
+		{"Testing revoked key", KeyInfo{Revoked: true, CanEncrypt: true}, true, true},
+		{"Testing key that can't encrypt", KeyInfo{CanSign: true}, true, true},
+		{"Testing key that can't sign", KeyInfo{CanEncrypt: true}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.info.Check(tt.public, now); (err != nil) != tt.err {
+				t.Errorf("Check() error = %v, want error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseColonsKeyInfo(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	past, soon, later := now.Add(-24*time.Hour).Unix(), now.Add(24*time.Hour).Unix(), now.Add(48*time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		output  string
+		public  bool
+		expires int64 // 0 if the key doesn't expire
+		err     bool  // KeyInfo.Check must return an error
+	}{
+		{
+			"Testing valid key",
+			"tru::1:1650000000:0:3:1:5\n" +
+				"pub:u:255:22:7ADE4B572836C909:1650000000:::u:::scESC:::::ed25519:::0:\n" +
+				"fpr:::::::::8A3B7ADE4B572836C9098A3B7ADE4B572836C909:\n" +
+				"uid:u::::1650000000::HASH::Benjamin <bg@benjaminguzman.dev>::::::::::0:\n" +
+				"sub:u:255:18:1111111111111111:1650000000::::::e:::::cv25519::\n",
+			true,
+			0,
+			false,
+		},
+		{
+			"Testing subkey expiring before the primary key",
+			fmt.Sprintf("pub:u:255:22:7ADE4B572836C909:1650000000:%d::u:::scESC::::::::0:\n"+
+				"sub:u:255:18:1111111111111111:1650000000:%d:::::e::::::\n", later, soon),
+			true,
+			soon,
+			false,
+		},
+		{
+			"Testing rotated subkey",
+			fmt.Sprintf("pub:u:255:22:7ADE4B572836C909:1650000000:::u:::scESC::::::::0:\n"+
+				"sub:e:255:18:1111111111111111:1650000000:%d:::::e::::::\n"+
+				"sub:u:255:18:2222222222222222:1650000000:%d:::::e::::::\n", past, later),
+			true,
+			later,
+			false,
+		},
+		{
+			"Testing expired subkey",
+			fmt.Sprintf("pub:u:255:22:7ADE4B572836C909:1650000000:::u:::scSC::::::::0:\n"+
+				"sub:e:255:18:1111111111111111:1650000000:%d:::::e::::::\n", past),
+			true,
+			past,
+			true,
+		},
+		{
+			"Testing expired key",
+			fmt.Sprintf("pub:e:255:22:7ADE4B572836C909:1650000000:%d::u:::sc::::::::0:\n", past),
+			true,
+			past,
+			true,
+		},
+		{
+			"Testing revoked key",
+			"pub:r:255:22:7ADE4B572836C909:1650000000:::u:::sc::::::::0:\n",
+			true,
+			0,
+			true,
+		},
+		{
+			"Testing secret key",
+			fmt.Sprintf("sec:u:255:22:7ADE4B572836C909:1650000000:%d::u:::scESC:::+:::ed25519:::0:\n"+
+				"ssb:u:255:18:1111111111111111:1650000000::::::e:::+:::cv25519::\n", soon),
+			false,
+			soon,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infos := parseColonsKeyInfo([]byte(tt.output), "bg@benjaminguzman.dev", tt.public, now)
+			if len(infos) != 1 {
+				t.Fatalf("Expected 1 key, got %d", len(infos))
+			}
+			info := infos[0]
+			if (tt.expires == 0 && !info.Expires.IsZero()) || (tt.expires != 0 && info.Expires.Unix() != tt.expires) {
+				t.Errorf("Expires = %s, want %d", info.Expires, tt.expires)
+			}
+			if err := info.Check(tt.public, now); (err != nil) != tt.err {
+				t.Errorf("Check() error = %v, want error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNativeKeyInfo(t *testing.T) {
+	now := time.Now()
+	newKey := func(created time.Time, lifetime uint32) *openpgp.Entity {
+		key, err := openpgp.NewEntity("Test", "", "test@example.com", &packet.Config{
+			Time:            func() time.Time { return created },
+			KeyLifetimeSecs: lifetime,
+		})
+		if err != nil {
+			t.Fatal("Couldn't generate key", err)
+		}
+		return key
+	}
+
+	revoked := newKey(now.Add(-time.Hour), 0)
+	// the revocation must not be newer than now, otherwise the key is not revoked yet at now
+	revocationTime := &packet.Config{Time: func() time.Time { return now.Add(-time.Minute) }}
+	if err := revoked.RevokeKey(packet.NoReason, "", revocationTime); err != nil {
+		t.Fatal("Couldn't revoke key", err)
+	}
+
+	tests := []struct {
+		name     string
+		key      *openpgp.Entity
+		expiring bool // key expires within 7 days
+		err      bool // KeyInfo.Check must return an error
+	}{
+		{"Testing valid key", newKey(now.Add(-time.Hour), 0), false, false},
+		{"Testing expiring key", newKey(now.Add(-time.Hour), 3*24*3600), true, false},
+		{"Testing expired key", newKey(now.Add(-48*time.Hour), 3600), true, true},
+		{"Testing revoked key", revoked, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, public := range []bool{true, false} {
+				info := newKeyInfo(tt.key, "test@example.com", public, now)
+				if info.ExpiresWithin(7*24*time.Hour, now) != tt.expiring {
+					t.Errorf("ExpiresWithin() = %t, want %t (public %t)", !tt.expiring, tt.expiring, public)
+				}
+				if err := info.Check(public, now); (err != nil) != tt.err {
+					t.Errorf("Check() error = %v, want error %t (public %t)", err, tt.err, public)
+				}
+			}
+		})
+	}
+}
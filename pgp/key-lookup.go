@@ -0,0 +1,252 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeyCacheFile default path for the cache of the keys retrieved by KeyLookup
+const DefaultKeyCacheFile = "/var/cache/login-monitor/keys.json"
+
+// DefaultKeyCacheTTL default time the keys retrieved by KeyLookup are cached
+const DefaultKeyCacheTTL = 24 * time.Hour
+
+// DefaultKeyLookupTimeout default timeout for each request made by KeyLookup
+const DefaultKeyLookupTimeout = 10 * time.Second
+
+// zbase32Alphabet alphabet used to encode the local part of emails for WKD
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// KeyLookup retrieves public keys through Web Key Directory (WKD, only for emails) and/or an HKP keyserver.
+// Retrieved keys are cached in a file, so keys are not requested on every login
+type KeyLookup struct {
+	wkd       bool
+	keyserver string // e.g. https://keys.openpgp.org. Empty if no keyserver is used
+	cacheFile string
+	ttl       time.Duration
+	client    *http.Client
+
+	// wkdURLs returns the WKD URLs (advanced and direct methods) for the given email parts
+	wkdURLs func(domain, localPart, hash string) []string
+
+	mutex sync.Mutex
+}
+
+// cachedKey key retrieved by KeyLookup
+type cachedKey struct {
+	Key       []byte    `json:"key"` // key as returned by WKD or the keyserver (binary or armored)
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// NewKeyLookup creates a new KeyLookup. Keys are looked up through WKD if wkd is true and through the keyserver
+// if it is not empty (WKD is tried first). Keys are cached in cacheFile for ttl
+func NewKeyLookup(wkd bool, keyserver, cacheFile string, ttl, timeout time.Duration) *KeyLookup {
+	return &KeyLookup{
+		wkd:       wkd,
+		keyserver: strings.TrimRight(keyserver, "/"),
+		cacheFile: cacheFile,
+		ttl:       ttl,
+		client:    &http.Client{Timeout: timeout},
+		wkdURLs:   wkdURLs,
+	}
+}
+
+// Lookup returns the public keys for the given id (email or key id).
+// The cached keys are returned if they are not older than the cache TTL. Otherwise, the keys are requested and
+// cached. If the request fails, the cached keys (if any) are returned regardless of their age
+func (l *KeyLookup) Lookup(id string) (openpgp.EntityList, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	id = strings.ToLower(strings.TrimSpace(id))
+	cache := l.readCache()
+	cached, isCached := cache[id]
+	if isCached && time.Since(cached.FetchedAt) < l.ttl {
+		if keys, err := parseKeys(cached.Key, id); err == nil {
+			return keys, nil
+		}
+	}
+
+	raw, keys, err := l.fetch(id)
+	if err != nil {
+		if isCached {
+			log.Warnf("Couldn't retrieve key for %s, using cached key. %s", id, err)
+			return parseKeys(cached.Key, id)
+		}
+		return nil, err
+	}
+
+	cache[id] = cachedKey{Key: raw, FetchedAt: time.Now()}
+	if err = l.writeCache(cache); err != nil {
+		log.Warnf("Couldn't write key cache. %s", err)
+	}
+	return keys, nil
+}
+
+// fetch requests the keys for id through WKD and then through the keyserver
+func (l *KeyLookup) fetch(id string) ([]byte, openpgp.EntityList, error) {
+	errs := make([]string, 0, 2)
+
+	if at := strings.LastIndex(id, "@"); l.wkd && at > 0 {
+		localPart, domain := id[:at], id[at+1:]
+		for _, wkdURL := range l.wkdURLs(domain, localPart, wkdHash(localPart)) {
+			raw, keys, err := l.get(wkdURL, id)
+			if err == nil {
+				return raw, keys, nil
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if l.keyserver != "" {
+		search := id
+		if !strings.Contains(id, "@") && !strings.HasPrefix(id, "0x") {
+			search = "0x" + id
+		}
+		query := url.Values{"op": {"get"}, "options": {"mr"}, "search": {search}}
+		raw, keys, err := l.get(l.keyserver+"/pks/lookup?"+query.Encode(), id)
+		if err == nil {
+			return raw, keys, nil
+		}
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("no key lookup method for %s", id)
+	}
+	return nil, nil, fmt.Errorf("couldn't retrieve key for %s. %s", id, strings.Join(errs, "; "))
+}
+
+// get requests the keys at the given URL. The keys must match id
+func (l *KeyLookup) get(keyURL, id string) ([]byte, openpgp.EntityList, error) {
+	res, err := l.client.Get(keyURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s responded with status %s", keyURL, res.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := parseKeys(raw, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key from %s. %w", keyURL, err)
+	}
+	return raw, keys, nil
+}
+
+func (l *KeyLookup) readCache() map[string]cachedKey {
+	cache := make(map[string]cachedKey)
+	data, err := os.ReadFile(l.cacheFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Couldn't read key cache. %s", err)
+		}
+		return cache
+	}
+	if err = json.Unmarshal(data, &cache); err != nil {
+		log.Warnf("Couldn't parse key cache. %s", err)
+	}
+	return cache
+}
+
+// writeCache writes the cache to a temporary file which is then renamed, so readers never see a partial cache
+func (l *KeyLookup) writeCache(cache map[string]cachedKey) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(l.cacheFile), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.cacheFile), ".tmp-"+filepath.Base(l.cacheFile)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if rename succeeded
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.cacheFile)
+}
+
+// parseKeys parses the binary or armored keys and returns the ones matching id (see matchesKey)
+func parseKeys(raw []byte, id string) (openpgp.EntityList, error) {
+	var keys openpgp.EntityList
+	var err error
+	if bytes.Contains(raw, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make(openpgp.EntityList, 0, len(keys))
+	for _, key := range keys {
+		if matchesKey(key, id) {
+			matching = append(matching, key)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("key doesn't match %s", id)
+	}
+	return matching, nil
+}
+
+// wkdURLs returns the URLs for the advanced and direct WKD methods.
+// See https://datatracker.ietf.org/doc/draft-koch-openpgp-webkey-service/
+func wkdURLs(domain, localPart, hash string) []string {
+	query := "?l=" + url.QueryEscape(localPart)
+	return []string{
+		fmt.Sprintf("https://openpgpkey.%s/.well-known/openpgpkey/%s/hu/%s%s", domain, domain, hash, query),
+		fmt.Sprintf("https://%s/.well-known/openpgpkey/hu/%s%s", domain, hash, query),
+	}
+}
+
+// wkdHash returns the z-base-32 encoded SHA-1 hash of the (lowercase) local part of an email, as used by WKD
+func wkdHash(localPart string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(localPart)))
+
+	encoded := strings.Builder{}
+	var buffer, bits uint
+	for _, b := range sum {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			encoded.WriteByte(zbase32Alphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		encoded.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&31])
+	}
+	return encoded.String()
+}
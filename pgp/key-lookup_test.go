@@ -0,0 +1,333 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWKDHash(t *testing.T) {
+	// test vector from the WKD draft (Joe.Doe@Example.ORG)
+	if hash := wkdHash("Joe.Doe"); hash != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("wkdHash() = %s, want iy9q119eutrkn8s1mk4r39qejnbu3n5q", hash)
+	}
+}
+
+// keyServer serves keys through WKD (direct method) and HKP. It counts the requests made
+type keyServer struct {
+	*httptest.Server
+	wkdKeys  map[string][]byte // WKD hash -> binary key
+	hkpKeys  map[string][]byte // search -> armored key
+	requests int
+	down     bool // if true, every request fails
+}
+
+func newKeyServer() *keyServer {
+	s := &keyServer{wkdKeys: map[string][]byte{}, hkpKeys: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests++
+		if s.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var key []byte
+		if strings.HasPrefix(r.URL.Path, "/.well-known/openpgpkey/hu/") {
+			key = s.wkdKeys[strings.TrimPrefix(r.URL.Path, "/.well-known/openpgpkey/hu/")]
+		} else if r.URL.Path == "/pks/lookup" && r.URL.Query().Get("op") == "get" {
+			key = s.hkpKeys[r.URL.Query().Get("search")]
+		}
+		if key == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(key)
+	}))
+	return s
+}
+
+// newTestKeyLookup creates a KeyLookup whose WKD requests are sent to the key server
+func newTestKeyLookup(server *keyServer, wkd bool, keyserver, cacheFile string, ttl time.Duration) *KeyLookup {
+	lookup := NewKeyLookup(wkd, keyserver, cacheFile, ttl, time.Second)
+	lookup.wkdURLs = func(_, localPart, hash string) []string {
+		return []string{fmt.Sprintf("%s/.well-known/openpgpkey/hu/%s?l=%s", server.URL, hash, localPart)}
+	}
+	return lookup
+}
+
+func TestKeyLookup(t *testing.T) {
+	dir := t.TempDir()
+	wkdKey := writeKey(t, dir, "wkd@example.com", false, crypto.SHA256)
+	hkpKey := writeKey(t, dir, "hkp@example.com", false, crypto.SHA256)
+
+	server := newKeyServer()
+	defer server.Close()
+	binary := bytes.Buffer{}
+	_ = wkdKey.Serialize(&binary)
+	server.wkdKeys[wkdHash("wkd")] = binary.Bytes()
+	server.wkdKeys[wkdHash("impostor")] = binary.Bytes() // key doesn't match the email
+	armored, _ := os.ReadFile(filepath.Join(dir, "hkp@example.com.asc"))
+	server.hkpKeys["hkp@example.com"] = armored
+	server.hkpKeys[fmt.Sprintf("0x%016x", hkpKey.PrimaryKey.KeyId)] = armored
+
+	tests := []struct {
+		name     string
+		wkd      bool
+		id       string
+		expected uint64 // expected key id (0 if the lookup must fail)
+	}{
+		{"Testing WKD", true, "wkd@example.com", wkdKey.PrimaryKey.KeyId},
+		{"Testing WKD case insensitive", true, "WKD@example.com", wkdKey.PrimaryKey.KeyId},
+		{"Testing key not matching the email", true, "impostor@example.com", 0},
+		{"Testing HKP by email", false, "hkp@example.com", hkpKey.PrimaryKey.KeyId},
+		{"Testing HKP by key id", false, fmt.Sprintf("0x%016X", hkpKey.PrimaryKey.KeyId), hkpKey.PrimaryKey.KeyId},
+		{"Testing HKP after WKD", true, "hkp@example.com", hkpKey.PrimaryKey.KeyId},
+		{"Testing unknown key", true, "other@example.com", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := newTestKeyLookup(server, tt.wkd, server.URL, filepath.Join(t.TempDir(), "keys.json"), time.Hour)
+			keys, err := lookup.Lookup(tt.id)
+			if tt.expected == 0 {
+				if err == nil {
+					t.Errorf("Lookup() should return an error, got %d keys", len(keys))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Couldn't look up key", err)
+			}
+			if keys[0].PrimaryKey.KeyId != tt.expected {
+				t.Errorf("Lookup() returned key %X, want %X", keys[0].PrimaryKey.KeyId, tt.expected)
+			}
+		})
+	}
+}
+
+func TestKeyLookupCache(t *testing.T) {
+	dir := t.TempDir()
+	key := writeKey(t, dir, "wkd@example.com", false, crypto.SHA256)
+	server := newKeyServer()
+	defer server.Close()
+	binary := bytes.Buffer{}
+	_ = key.Serialize(&binary)
+	server.wkdKeys[wkdHash("wkd")] = binary.Bytes()
+	cacheFile := filepath.Join(dir, "cache", "keys.json")
+
+	lookup := newTestKeyLookup(server, true, "", cacheFile, time.Hour)
+	if _, err := lookup.Lookup("wkd@example.com"); err != nil {
+		t.Fatal("Couldn't look up key", err)
+	}
+	if stat, err := os.Stat(cacheFile); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Key cache was not written with 0600 permissions. %v", err)
+	}
+
+	// fresh cached key, no request is made (even by another KeyLookup using the same cache)
+	requests := server.requests
+	lookup = newTestKeyLookup(server, true, "", cacheFile, time.Hour)
+	if _, err := lookup.Lookup("wkd@example.com"); err != nil {
+		t.Fatal("Couldn't look up cached key", err)
+	}
+	if server.requests != requests {
+		t.Error("Fresh cached key was requested again")
+	}
+
+	// expired cached key is requested again
+	lookup = newTestKeyLookup(server, true, "", cacheFile, 0)
+	if _, err := lookup.Lookup("wkd@example.com"); err != nil {
+		t.Fatal("Couldn't look up expired key", err)
+	}
+	if server.requests == requests {
+		t.Error("Expired cached key was not requested again")
+	}
+
+	// expired cached key is used if the request fails
+	server.down = true
+	if _, err := lookup.Lookup("wkd@example.com"); err != nil {
+		t.Error("Expired cached key should be used if the request fails", err)
+	}
+	if _, err := lookup.Lookup("other@example.com"); err == nil {
+		t.Error("Lookup() should return an error for keys that are not cached if the request fails")
+	}
+}
+
+func TestNativeBackendKeyLookup(t *testing.T) {
+	dir := t.TempDir()
+	staleKey := writeKey(t, dir, "recipient@example.com", false, crypto.SHA256)
+	server := newKeyServer()
+	defer server.Close()
+
+	backend, err := NewNativeBackend([]string{filepath.Join(dir, "recipient@example.com.asc")}, "")
+	if err != nil {
+		t.Fatal("Couldn't create native backend", err)
+	}
+	backend.SetKeyLookup(newTestKeyLookup(server, true, "", filepath.Join(dir, "keys.json"), time.Hour))
+
+	// lookup fails, key file is used
+	if key := backend.findPublicKey("recipient@example.com"); key == nil || key.PrimaryKey.KeyId != staleKey.PrimaryKey.KeyId {
+		t.Error("Key file should be used if the lookup fails")
+	}
+
+	// rotated key is retrieved
+	rotatedKey := writeKey(t, t.TempDir(), "recipient@example.com", false, crypto.SHA256)
+	binary := bytes.Buffer{}
+	_ = rotatedKey.Serialize(&binary)
+	server.wkdKeys[wkdHash("recipient")] = binary.Bytes()
+	if key := backend.findPublicKey("recipient@example.com"); key == nil || key.PrimaryKey.KeyId != rotatedKey.PrimaryKey.KeyId {
+		t.Error("Retrieved key should take precedence over the key file")
+	}
+	if _, err = backend.Encrypt([]byte("New login on server"), "recipient@example.com"); err != nil {
+		t.Error("Couldn't encrypt with retrieved key", err)
+	}
+}
+
+func TestGPGBackendKeyLookup(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	dir := t.TempDir()
+	gnupgHome := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gnupgHome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", gnupgHome)
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+
+	// the keyring still has the key the recipient rotated
+	writeKey(t, dir, "recipient@example.com", false, crypto.SHA256)
+	stale, _ := os.ReadFile(filepath.Join(dir, "recipient@example.com.asc"))
+	if _, stderr, err := runGPG(stale, "--batch", "--import"); err != nil {
+		t.Fatalf("Couldn't import stale key. %s %s", stderr, err)
+	}
+	server := newKeyServer()
+	defer server.Close()
+	rotatedKey := writeKey(t, t.TempDir(), "recipient@example.com", false, crypto.SHA256)
+	binary := bytes.Buffer{}
+	_ = rotatedKey.Serialize(&binary)
+	server.wkdKeys[wkdHash("recipient")] = binary.Bytes()
+
+	backend := (&GPGBackend{}).SetKeyLookup(newTestKeyLookup(server, true, "", filepath.Join(dir, "keys.json"), time.Hour))
+
+	// channels share the backend, so keys are checked concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := backend.KeyInfo(true, "recipient@example.com")
+			if err != nil {
+				t.Error("Couldn't get key info", err)
+				return
+			}
+			if info.Fingerprint != fmt.Sprintf("%X", rotatedKey.PrimaryKey.Fingerprint) {
+				t.Errorf("KeyInfo() returned key %s, want the rotated key", info.Fingerprint)
+			}
+		}()
+	}
+	wg.Wait()
+
+	encrypted, err := backend.Encrypt([]byte("New login on server"), "recipient@example.com")
+	if err != nil {
+		t.Fatal("Couldn't encrypt with retrieved key", err)
+	}
+	block, err := armor.Decode(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal("Encrypted message is not armored", err)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		t.Fatal("Couldn't read encrypted key packet", err)
+	}
+	if encryptedKey, ok := p.(*packet.EncryptedKey); !ok || encryptedKey.KeyId != rotatedKey.Subkeys[0].PublicKey.KeyId {
+		t.Errorf("Message is not encrypted for the rotated key. First packet: %+v", p)
+	}
+}
+
+func TestKeyLookupUsableKey(t *testing.T) {
+	now := time.Now()
+	// newKey generates a key for recipient@example.com created at the given time that expires after lifetime
+	newKey := func(created time.Time, lifetime time.Duration) *openpgp.Entity {
+		config := &packet.Config{Time: func() time.Time { return created }, KeyLifetimeSecs: uint32(lifetime.Seconds())}
+		key, err := openpgp.NewEntity("Test", "", "recipient@example.com", config)
+		if err != nil {
+			t.Fatal("Couldn't generate key", err)
+		}
+		return key
+	}
+	expiredKey := newKey(now.Add(-time.Hour), time.Minute) // newest key, but expired
+	oldKey := newKey(now.Add(-3*time.Hour), 0)
+	validKey := newKey(now.Add(-2*time.Hour), 0)
+
+	// the keyserver returns the expired key first
+	server := newKeyServer()
+	defer server.Close()
+	armored := bytes.Buffer{}
+	w, _ := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	for _, key := range []*openpgp.Entity{expiredKey, oldKey, validKey} {
+		if err := key.Serialize(w); err != nil {
+			t.Fatal("Couldn't serialize key", err)
+		}
+	}
+	_ = w.Close()
+	server.hkpKeys["recipient@example.com"] = armored.Bytes()
+
+	tests := []struct {
+		name        string
+		fingerprint func(t *testing.T, lookup *KeyLookup) string // fingerprint of the key the backend uses
+	}{
+		{
+			"Testing native backend",
+			func(t *testing.T, lookup *KeyLookup) string {
+				backend, err := NewNativeBackend(nil, "")
+				if err != nil {
+					t.Fatal("Couldn't create native backend", err)
+				}
+				backend.SetKeyLookup(lookup)
+				if key := backend.findPublicKey("recipient@example.com"); key != nil {
+					return fmt.Sprintf("%X", key.PrimaryKey.Fingerprint)
+				}
+				return ""
+			},
+		},
+		{
+			"Testing gpg backend",
+			func(t *testing.T, lookup *KeyLookup) string {
+				if _, err := exec.LookPath("gpg"); err != nil {
+					t.Skip("gpg is not installed")
+				}
+				gnupgHome := filepath.Join(t.TempDir(), "gnupg")
+				if err := os.Mkdir(gnupgHome, 0700); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("GNUPGHOME", gnupgHome)
+				defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+
+				info, err := (&GPGBackend{}).SetKeyLookup(lookup).KeyInfo(true, "recipient@example.com")
+				if err != nil {
+					t.Fatal("Couldn't get key info", err)
+				}
+				return info.Fingerprint
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := newTestKeyLookup(server, false, server.URL, filepath.Join(t.TempDir(), "keys.json"), time.Hour)
+			if fingerprint := tt.fingerprint(t, lookup); fingerprint != fmt.Sprintf("%X", validKey.PrimaryKey.Fingerprint) {
+				t.Errorf("Backend uses key %s, want the newest valid key %X", fingerprint, validKey.PrimaryKey.Fingerprint)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hashes OpenPGP hash algorithm ids (RFC 4880, section 9.4) and their micalg names (RFC 3156, section 5)
+var hashes = map[byte]struct {
+	hash   crypto.Hash
+	micalg string
+}{
+	1:  {crypto.MD5, "pgp-md5"},
+	2:  {crypto.SHA1, "pgp-sha1"},
+	3:  {crypto.RIPEMD160, "pgp-ripemd160"},
+	8:  {crypto.SHA256, "pgp-sha256"},
+	9:  {crypto.SHA384, "pgp-sha384"},
+	10: {crypto.SHA512, "pgp-sha512"},
+	11: {crypto.SHA224, "pgp-sha224"},
+	12: {crypto.SHA3_256, "pgp-sha3-256"},
+	14: {crypto.SHA3_512, "pgp-sha3-512"},
+}
+
+// MICAlg returns the micalg parameter of a multipart/signed PGP/MIME message for a signature made with the given hash,
+// e.g. pgp-sha256. An empty string is returned if the hash is not used by OpenPGP
+func MICAlg(hash crypto.Hash) string {
+	for _, h := range hashes {
+		if h.hash == hash {
+			return h.micalg
+		}
+	}
+	return ""
+}
+
+// hashFromId returns the hash for the given OpenPGP hash algorithm id
+func hashFromId(id byte) (crypto.Hash, bool) {
+	h, ok := hashes[id]
+	return h.hash, ok
+}
+
+// parseSigCreated returns the hash used to create a signature from the status output of gpg (see --status-fd).
+// The status line looks like this: [GNUPG:] SIG_CREATED <type> <pk_algo> <hash_algo> <class> <timestamp> <keyfpr>
+func parseSigCreated(status []byte) (crypto.Hash, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "[GNUPG:]" || fields[1] != "SIG_CREATED" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(fields[4], 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hash algorithm in gpg status '%s'", scanner.Text())
+		}
+		hash, ok := hashFromId(byte(id))
+		if !ok {
+			return 0, fmt.Errorf("unknown hash algorithm %d in gpg status", id)
+		}
+		return hash, nil
+	}
+	return 0, fmt.Errorf("gpg status doesn't contain SIG_CREATED")
+}
@@ -0,0 +1,71 @@
+package pgp
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestMICAlg(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     crypto.Hash
+		expected string
+	}{
+		{"Testing SHA-256", crypto.SHA256, "pgp-sha256"},
+		{"Testing SHA-512", crypto.SHA512, "pgp-sha512"},
+		{"Testing SHA-1", crypto.SHA1, "pgp-sha1"},
+		{"Testing SHA-384", crypto.SHA384, "pgp-sha384"},
+		{"Testing hash not used by OpenPGP", crypto.BLAKE2b_256, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MICAlg(tt.hash); got != tt.expected {
+				t.Errorf("MICAlg() = %s, want %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseSigCreated(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		expected crypto.Hash
+		err      bool
+	}{
+		{
+			"Testing SHA-256 key",
+			"[GNUPG:] KEY_CONSIDERED 7ADE4B572836C909 0\n" +
+				"[GNUPG:] BEGIN_SIGNING H8\n" +
+				"[GNUPG:] SIG_CREATED D 1 8 00 1650000000 7ADE4B572836C9097ADE4B572836C9097ADE4B57\n",
+			crypto.SHA256,
+			false,
+		},
+		{
+			"Testing SHA-512 key",
+			"[GNUPG:] BEGIN_SIGNING H10\n[GNUPG:] SIG_CREATED D 22 10 00 1650000000 7ADE4B572836C909\n",
+			crypto.SHA512,
+			false,
+		},
+		{
+			"Testing SHA-1 key",
+			"gpg: using \"bg@benjaminguzman.dev\" as default secret key for signing\n" +
+				"[GNUPG:] SIG_CREATED D 17 2 00 1650000000 7ADE4B572836C909\n",
+			crypto.SHA1,
+			false,
+		},
+		{"Testing unknown hash", "[GNUPG:] SIG_CREATED D 1 99 00 1650000000 7ADE4B572836C909\n", 0, true},
+		{"Testing no SIG_CREATED", "[GNUPG:] KEY_CONSIDERED 7ADE4B572836C909 0\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := parseSigCreated([]byte(tt.status))
+			if (err != nil) != tt.err {
+				t.Fatalf("parseSigCreated() error = %v, want error %t", err, tt.err)
+			}
+			if hash != tt.expected {
+				t.Errorf("parseSigCreated() = %s, want %s", hash, tt.expected)
+			}
+		})
+	}
+}
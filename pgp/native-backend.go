@@ -0,0 +1,267 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NativeBackend Backend implementation using ProtonMail's OpenPGP implementation (pure Go).
+// Keys are read from armored key files, i.e. the gpg keyring is not used
+type NativeBackend struct {
+	publicKeys openpgp.EntityList
+	signingKey *openpgp.Entity // nil if no signing key was given
+	lookup     *KeyLookup      // nil if keys are not looked up
+
+	// decryptMutex guards the decryption of the signing key, as the backend may be shared by concurrent channels
+	decryptMutex sync.Mutex
+}
+
+// NewNativeBackend creates a new NativeBackend with the public keys in the given armored key files and
+// the private key in the given armored signing key file (it can be empty if messages shouldn't be signed).
+//
+// The public key of the signing key is added to the public keys, so messages can be encrypted for the sender too
+func NewNativeBackend(publicKeyFiles []string, signingKeyFile string) (*NativeBackend, error) {
+	b := &NativeBackend{}
+	for _, file := range publicKeyFiles {
+		keys, err := readArmoredKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		b.publicKeys = append(b.publicKeys, keys...)
+	}
+
+	if signingKeyFile != "" {
+		keys, err := readArmoredKeyFile(signingKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key.PrivateKey != nil {
+				b.signingKey = key
+				break
+			}
+		}
+		if b.signingKey == nil {
+			return nil, fmt.Errorf("signing key file %s doesn't contain a private key", signingKeyFile)
+		}
+		b.publicKeys = append(b.publicKeys, b.signingKey)
+	}
+
+	return b, nil
+}
+
+// SetKeyLookup sets the KeyLookup used to retrieve public keys.
+// Retrieved keys take precedence over the keys in the public key files, which are used if the lookup fails
+func (b *NativeBackend) SetKeyLookup(lookup *KeyLookup) *NativeBackend {
+	b.lookup = lookup
+	return b
+}
+
+// Encrypt encrypts data with the public keys of the given recipients
+func (b *NativeBackend) Encrypt(data []byte, recipients ...string) ([]byte, error) {
+	to := make([]*openpgp.Entity, 0, len(recipients))
+	for _, recipient := range recipients {
+		key := b.findPublicKey(recipient)
+		if key == nil {
+			return nil, fmt.Errorf("public key for %s doesn't exist", recipient)
+		}
+		to = append(to, key)
+	}
+
+	encrypted := bytes.Buffer{}
+	armorWriter, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(armorWriter, to, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while encrypting PGP message. %w", err)
+	}
+	if _, err = plaintext.Write(data); err != nil {
+		return nil, err
+	}
+	if err = plaintext.Close(); err != nil {
+		return nil, err
+	}
+	if err = armorWriter.Close(); err != nil {
+		return nil, err
+	}
+	encrypted.WriteString("\n")
+
+	return encrypted.Bytes(), nil
+}
+
+// Sign creates a detached signature of data with the signing key. signer must identify the signing key.
+// The hash is the first one in the key's preferences that is supported for signing (SHA-256 if there is none)
+func (b *NativeBackend) Sign(data []byte, signer, passphraseFile string) ([]byte, crypto.Hash, error) {
+	if b.signingKey == nil || !matchesKey(b.signingKey, signer) {
+		return nil, 0, fmt.Errorf("private key for %s doesn't exist", signer)
+	}
+
+	if err := b.decryptSigningKey(passphraseFile); err != nil {
+		return nil, 0, err
+	}
+
+	hash := preferredHash(b.signingKey)
+	signature := bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(&signature, b.signingKey, bytes.NewReader(data), &packet.Config{DefaultHash: hash}); err != nil {
+		return nil, 0, fmt.Errorf("error while signing PGP message. %w", err)
+	}
+	signature.WriteString("\n")
+	return signature.Bytes(), hash, nil
+}
+
+// decryptSigningKey decrypts the signing key (if it's encrypted) with the passphrase in passphraseFile.
+// The key is decrypted only once, even if several goroutines sign at the same time
+func (b *NativeBackend) decryptSigningKey(passphraseFile string) error {
+	b.decryptMutex.Lock()
+	defer b.decryptMutex.Unlock()
+	if !b.signingKey.PrivateKey.Encrypted {
+		return nil
+	}
+
+	if passphraseFile == "" {
+		return errors.New("private key is encrypted but no passphrase file was given")
+	}
+	passphrase, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return fmt.Errorf("error reading private key passphrase: %w", err)
+	}
+	if err = b.signingKey.DecryptPrivateKeys(bytes.TrimRight(passphrase, "\r\n")); err != nil {
+		return fmt.Errorf("couldn't decrypt private key: %w", err)
+	}
+	return nil
+}
+
+// preferredHash returns the first hash in the key's preferences that can be used for signing.
+// If there is none, SHA-256 is returned
+func preferredHash(key *openpgp.Entity) crypto.Hash {
+	selfSignature, _ := key.PrimarySelfSignature()
+	if selfSignature == nil {
+		return crypto.SHA256
+	}
+	for _, id := range selfSignature.PreferredHash {
+		// openpgp.HashIdToHash only knows hashes that can be used for signing (e.g. SHA-1 is not)
+		if hash, ok := openpgp.HashIdToHash(id); ok && hash.Available() {
+			return hash
+		}
+	}
+	return crypto.SHA256
+}
+
+// KeyExists tells whether the public/private key exists for ANY of the given ids
+func (b *NativeBackend) KeyExists(public bool, ids ...string) bool {
+	for _, id := range ids {
+		if public && b.findPublicKey(id) != nil {
+			return true
+		}
+		if !public && b.signingKey != nil && matchesKey(b.signingKey, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// findPublicKey returns the public key for id, retrieved by the key lookup (if any) or from the public key files.
+// nil is returned if there is no such key
+func (b *NativeBackend) findPublicKey(id string) *openpgp.Entity {
+	if b.lookup != nil && strings.TrimSpace(id) != "" {
+		keys, err := b.lookup.Lookup(id)
+		if err == nil {
+			return bestKey(keys, id, time.Now())
+		}
+		log.Debugf("Couldn't look up key for %s, using key files. %s", id, err)
+	}
+	return findKey(b.publicKeys, id)
+}
+
+// KeyInfo returns the validity of the public/private key for the given id
+func (b *NativeBackend) KeyInfo(public bool, id string) (*KeyInfo, error) {
+	var key *openpgp.Entity
+	if public {
+		key = b.findPublicKey(id)
+	} else if b.signingKey != nil && matchesKey(b.signingKey, id) {
+		key = b.signingKey
+	}
+	if key == nil {
+		return nil, fmt.Errorf("key for %s doesn't exist", id)
+	}
+	return newKeyInfo(key, id, public, time.Now()), nil
+}
+
+func readArmoredKeyFile(path string) (openpgp.EntityList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	defer file.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// findKey returns the first key matching id (see matchesKey) or nil if there is no such key
+func findKey(keys openpgp.EntityList, id string) *openpgp.Entity {
+	for _, key := range keys {
+		if matchesKey(key, id) {
+			return key
+		}
+	}
+	return nil
+}
+
+// matchesKey tells if the key is identified by id.
+// id can be a key id (long or short), a fingerprint (with or without the 0x prefix) or an email in the key's identities
+func matchesKey(key *openpgp.Entity, id string) bool {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return false
+	}
+
+	if strings.Contains(id, "@") {
+		for _, identity := range key.Identities {
+			if strings.EqualFold(identity.UserId.Email, id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	hexId := strings.ToUpper(strings.TrimPrefix(strings.TrimPrefix(strings.ReplaceAll(id, " ", ""), "0x"), "0X"))
+	keyIds := []uint64{key.PrimaryKey.KeyId}
+	fingerprints := []string{fmt.Sprintf("%X", key.PrimaryKey.Fingerprint)}
+	for _, subkey := range key.Subkeys {
+		keyIds = append(keyIds, subkey.PublicKey.KeyId)
+		fingerprints = append(fingerprints, fmt.Sprintf("%X", subkey.PublicKey.Fingerprint))
+	}
+
+	for _, fingerprint := range fingerprints {
+		if hexId == fingerprint {
+			return true
+		}
+	}
+	if len(hexId) == 16 || len(hexId) == 8 {
+		if value, err := strconv.ParseUint(hexId, 16, 64); err == nil {
+			for _, keyId := range keyIds {
+				if (len(hexId) == 16 && keyId == value) || (len(hexId) == 8 && uint32(keyId) == uint32(value)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeKey generates a new key for the given email (preferring the given hash) and writes it armored to dir.
+// If private is true, the private key is written, otherwise the public key
+func writeKey(t *testing.T, dir, email string, private bool, hash crypto.Hash) *openpgp.Entity {
+	config := &packet.Config{DefaultHash: hash}
+	if hash == crypto.SHA1 {
+		config = nil // keys can't be generated with SHA-1 preferences, they're set below
+	}
+	entity, err := openpgp.NewEntity("Test", "", email, config)
+	if err != nil {
+		t.Fatal("Couldn't generate key", err)
+	}
+	if hash == crypto.SHA1 { // e.g. an old key
+		for id, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{2} // SHA-1 (RFC 4880, section 9.4)
+			if err = identity.SelfSignature.SignUserId(id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+				t.Fatal("Couldn't sign user id", err)
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+	w, err := armor.Encode(&buf, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if private {
+		err = entity.SerializePrivate(w, nil)
+	} else {
+		err = entity.Serialize(w)
+	}
+	if err != nil {
+		t.Fatal("Couldn't serialize key", err)
+	}
+	_ = w.Close()
+
+	if err = os.WriteFile(filepath.Join(dir, email+".asc"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func TestNativeBackend(t *testing.T) {
+	dir := t.TempDir()
+	recipient := writeKey(t, dir, "recipient@example.com", false, crypto.SHA256)
+	sender := writeKey(t, dir, "sender@example.com", true, crypto.SHA256)
+
+	backend, err := NewNativeBackend(
+		[]string{filepath.Join(dir, "recipient@example.com.asc")},
+		filepath.Join(dir, "sender@example.com.asc"),
+	)
+	if err != nil {
+		t.Fatal("Couldn't create native backend", err)
+	}
+
+	keyExistsTests := []struct {
+		name     string
+		public   bool
+		ids      []string
+		expected bool
+	}{
+		{"Testing public key by email", true, []string{"recipient@example.com"}, true},
+		{"Testing public key by key id", true, []string{fmt.Sprintf("0x%016X", recipient.PrimaryKey.KeyId)}, true},
+		{"Testing public key by fingerprint", true, []string{fmt.Sprintf("%x", recipient.PrimaryKey.Fingerprint)}, true},
+		{"Testing sender public key", true, []string{"sender@example.com"}, true},
+		{"Testing any of the ids", true, []string{"unknown@example.com", "recipient@example.com"}, true},
+		{"Testing unknown public key", true, []string{"unknown@example.com"}, false},
+		{"Testing private key", false, []string{"sender@example.com"}, true},
+		{"Testing private key by key id", false, []string{fmt.Sprintf("%016X", sender.PrimaryKey.KeyId)}, true},
+		{"Testing recipient private key", false, []string{"recipient@example.com"}, false},
+		{"Testing empty id", true, []string{""}, false},
+	}
+	for _, tt := range keyExistsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backend.KeyExists(tt.public, tt.ids...); got != tt.expected {
+				t.Errorf("KeyExists(%t, %v) = %t, want %t", tt.public, tt.ids, got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("Testing encryption", func(t *testing.T) {
+		data := []byte("New login on server")
+		encrypted, err := backend.Encrypt(data, "recipient@example.com", "sender@example.com")
+		if err != nil {
+			t.Fatal("Couldn't encrypt", err)
+		}
+
+		// both the recipient and the sender must be able to decrypt the message
+		for _, key := range []*openpgp.Entity{recipient, sender} {
+			block, err := armor.Decode(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal("Encrypted message is not armored", err)
+			}
+			md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{key}, nil, nil)
+			if err != nil {
+				t.Fatal("Couldn't decrypt message", err)
+			}
+			buf := bytes.Buffer{}
+			if _, err = buf.ReadFrom(md.UnverifiedBody); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("Decrypted message is %q, want %q", buf.Bytes(), data)
+			}
+		}
+
+		if _, err = backend.Encrypt(data, "unknown@example.com"); err == nil {
+			t.Error("Encrypt() should return an error for unknown recipients")
+		}
+	})
+
+	t.Run("Testing signature", func(t *testing.T) {
+		data := []byte("New login on server")
+		signature, hash, err := backend.Sign(data, "sender@example.com", "")
+		if err != nil {
+			t.Fatal("Couldn't sign", err)
+		}
+		if hash != crypto.SHA256 {
+			t.Errorf("Sign() hash = %s, want %s", hash, crypto.SHA256)
+		}
+		if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{sender}, bytes.NewReader(data), bytes.NewReader(signature), nil); err != nil {
+			t.Error("Invalid signature", err)
+		}
+
+		if _, _, err = backend.Sign(data, "recipient@example.com", ""); err == nil {
+			t.Error("Sign() should return an error if the private key doesn't exist")
+		}
+	})
+}
+
+func TestNativeBackendSignHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     crypto.Hash // hash preferred by the key
+		expected crypto.Hash
+	}{
+		{"Testing SHA-1 key", crypto.SHA1, crypto.SHA256}, // SHA-1 is never used for new signatures
+		{"Testing SHA-256 key", crypto.SHA256, crypto.SHA256},
+		{"Testing SHA-384 key", crypto.SHA384, crypto.SHA384},
+		{"Testing SHA-512 key", crypto.SHA512, crypto.SHA512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKey(t, dir, "sender@example.com", true, tt.hash)
+			backend, err := NewNativeBackend(nil, filepath.Join(dir, "sender@example.com.asc"))
+			if err != nil {
+				t.Fatal("Couldn't create native backend", err)
+			}
+
+			signature, hash, err := backend.Sign([]byte("New login on server"), "sender@example.com", "")
+			if err != nil {
+				t.Fatal("Couldn't sign", err)
+			}
+			if hash != tt.expected {
+				t.Errorf("Sign() hash = %s, want %s", hash, tt.expected)
+			}
+
+			// the returned hash must be the one actually used in the signature
+			block, err := armor.Decode(bytes.NewReader(signature))
+			if err != nil {
+				t.Fatal("Signature is not armored", err)
+			}
+			p, err := packet.Read(block.Body)
+			if err != nil {
+				t.Fatal("Couldn't read signature packet", err)
+			}
+			if sig, ok := p.(*packet.Signature); !ok || sig.Hash != hash {
+				t.Errorf("Signature packet %+v doesn't use hash %s", p, hash)
+			}
+		})
+	}
+}
+
+func TestNativeBackendConcurrentSign(t *testing.T) {
+	dir := t.TempDir()
+	entity, err := openpgp.NewEntity("Test", "", "sender@example.com", nil)
+	if err != nil {
+		t.Fatal("Couldn't generate key", err)
+	}
+	if err = entity.EncryptPrivateKeys([]byte("secret"), nil); err != nil {
+		t.Fatal("Couldn't encrypt key", err)
+	}
+	buf := bytes.Buffer{}
+	w, _ := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err = entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal("Couldn't serialize key", err)
+	}
+	_ = w.Close()
+	keyFile, passFile := filepath.Join(dir, "sender.asc"), filepath.Join(dir, "pass")
+	if err = os.WriteFile(keyFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(passFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewNativeBackend(nil, keyFile)
+	if err != nil {
+		t.Fatal("Couldn't create native backend", err)
+	}
+
+	// channels share the backend and sign concurrently, so the key is decrypted by several goroutines
+	data := []byte("New login on server")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signature, _, err := backend.Sign(data, "sender@example.com", passFile)
+			if err != nil {
+				t.Error("Couldn't sign", err)
+				return
+			}
+			keyring := openpgp.EntityList{entity}
+			if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil); err != nil {
+				t.Error("Invalid signature", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewNativeBackendErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "recipient@example.com", false, crypto.SHA256)
+	if err := os.WriteFile(filepath.Join(dir, "invalid.asc"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		publicKeys []string
+		signingKey string
+	}{
+		{"Testing missing key file", []string{filepath.Join(dir, "missing.asc")}, ""},
+		{"Testing invalid key file", []string{filepath.Join(dir, "invalid.asc")}, ""},
+		{"Testing signing key without private key", nil, filepath.Join(dir, "recipient@example.com.asc")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewNativeBackend(tt.publicKeys, tt.signingKey); err == nil {
+				t.Error("NewNativeBackend() should return an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package rules
+
+import (
+	"fmt"
+	"login-monitor/config"
+	"login-monitor/pam"
+	"net"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// Actions a rule can take
+const (
+	Alert  = "alert"  // send the notification
+	Ignore = "ignore" // don't send the notification
+)
+
+// Severities a rule can assign to a login
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Decision result of evaluating the rules for a login event
+type Decision struct {
+	Action   string // Alert or Ignore
+	Severity string // Info, Warning or Critical
+	Rule     string // name of the rule that matched. Empty if no rule matched (i.e. the default action was taken)
+}
+
+// GroupsFunc returns the names and ids of the groups the given user belongs to
+type GroupsFunc func(username string) ([]string, error)
+
+type Engine struct {
+	rules           []rule
+	defaultAction   string
+	defaultSeverity string
+	groupsOf        GroupsFunc
+}
+
+type rule struct {
+	name     string
+	action   string
+	severity string // empty if the rule doesn't assign a severity
+	users    list
+	groups   list
+	hosts    []hostItem
+	services list
+	ttys     list
+	window   *timeWindow
+	weekdays map[time.Weekday]bool
+}
+
+// list of glob patterns. Negated patterns are prefixed with !
+type list []string
+
+type hostItem struct {
+	negated bool
+	network *net.IPNet // nil if the item is a hostname
+	name    string
+}
+
+// timeWindow time-of-day window. Times are expressed as minutes since midnight
+type timeWindow struct {
+	from, to int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// NewEngine creates a new Engine from the given config. An error is returned if the config is not valid
+func NewEngine(c config.RulesConfig) (*Engine, error) {
+	defaultAction, err := parseAction(c.Default, Alert)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action. %w", err)
+	}
+	defaultSeverity, err := parseSeverity(c.DefaultSeverity, Info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default severity. %w", err)
+	}
+
+	engine := &Engine{
+		rules:           make([]rule, 0, len(c.Rules)),
+		defaultAction:   defaultAction,
+		defaultSeverity: defaultSeverity,
+		groupsOf:        lookupGroups,
+	}
+	for i, ruleConfig := range c.Rules {
+		r, err := newRule(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule #%d (%s). %w", i, ruleConfig.Name, err)
+		}
+		engine.rules = append(engine.rules, r)
+	}
+	return engine, nil
+}
+
+// SetGroupsFunc sets the function used to look up the groups of a user. By default, groups are looked up with os/user
+func (e *Engine) SetGroupsFunc(groupsOf GroupsFunc) *Engine {
+	e.groupsOf = groupsOf
+	return e
+}
+
+// Evaluate evaluates the rules in order and returns the decision of the first matching rule.
+// If no rule matches, the default action and severity are returned
+func (e *Engine) Evaluate(event *pam.LoginEvent) Decision {
+	var groups []string
+	groupsLoaded := false
+	loadGroups := func() []string {
+		if !groupsLoaded {
+			groupsLoaded = true
+			if event.User != "" {
+				groups, _ = e.groupsOf(event.User) // if groups can't be looked up, user is treated as not being in any group
+			}
+		}
+		return groups
+	}
+
+	for _, r := range e.rules {
+		if r.matches(event, loadGroups) {
+			severity := r.severity
+			if severity == "" {
+				severity = e.defaultSeverity
+			}
+			return Decision{Action: r.action, Severity: severity, Rule: r.name}
+		}
+	}
+	return Decision{Action: e.defaultAction, Severity: e.defaultSeverity}
+}
+
+func newRule(c config.RuleConfig) (rule, error) {
+	action, err := parseAction(c.Action, "")
+	if err != nil {
+		return rule{}, err
+	}
+	var severity string
+	if c.Severity != "" {
+		if severity, err = parseSeverity(c.Severity, ""); err != nil {
+			return rule{}, err
+		}
+	}
+
+	r := rule{
+		name:     c.Name,
+		action:   action,
+		severity: severity,
+		users:    c.Users,
+		groups:   c.Groups,
+		services: c.Services,
+		ttys:     c.TTYs,
+	}
+	for _, patterns := range [][]string{c.Users, c.Groups, c.Services, c.TTYs} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+				return rule{}, fmt.Errorf("invalid pattern '%s'. %w", pattern, err)
+			}
+		}
+	}
+
+	for _, host := range c.Hosts {
+		r.hosts = append(r.hosts, parseHostItem(host))
+	}
+
+	if c.From != "" || c.To != "" {
+		if r.window, err = parseTimeWindow(c.From, c.To); err != nil {
+			return rule{}, err
+		}
+	}
+
+	if len(c.Weekdays) > 0 {
+		r.weekdays = make(map[time.Weekday]bool, len(c.Weekdays))
+		for _, day := range c.Weekdays {
+			weekday, err := parseWeekday(day)
+			if err != nil {
+				return rule{}, err
+			}
+			r.weekdays[weekday] = true
+		}
+	}
+
+	return r, nil
+}
+
+func parseAction(action, def string) (string, error) {
+	switch strings.TrimSpace(strings.ToLower(action)) {
+	case Alert:
+		return Alert, nil
+	case Ignore:
+		return Ignore, nil
+	case "":
+		if def != "" {
+			return def, nil
+		}
+		return "", fmt.Errorf("action is required. Valid values are: %s, %s", Alert, Ignore)
+	default:
+		return "", fmt.Errorf("%s is not a valid action. Valid values are: %s, %s", action, Alert, Ignore)
+	}
+}
+
+func parseSeverity(severity, def string) (string, error) {
+	switch strings.TrimSpace(strings.ToLower(severity)) {
+	case Info:
+		return Info, nil
+	case Warning:
+		return Warning, nil
+	case Critical:
+		return Critical, nil
+	case "":
+		if def != "" {
+			return def, nil
+		}
+		return "", fmt.Errorf("severity is required. Valid values are: %s, %s, %s", Info, Warning, Critical)
+	default:
+		return "", fmt.Errorf("%s is not a valid severity. Valid values are: %s, %s, %s", severity, Info, Warning, Critical)
+	}
+}
+
+func parseHostItem(host string) hostItem {
+	item := hostItem{}
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "!") {
+		item.negated = true
+		host = host[1:]
+	}
+
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		item.network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		item.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		item.name = strings.ToLower(host)
+	}
+	return item
+}
+
+func parseTimeWindow(from, to string) (*timeWindow, error) {
+	if from == "" || to == "" {
+		return nil, fmt.Errorf("both from and to are required for a time window")
+	}
+	fromTime, err := time.Parse("15:04", from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s'. Expected format is HH:MM. %w", from, err)
+	}
+	toTime, err := time.Parse("15:04", to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s'. Expected format is HH:MM. %w", to, err)
+	}
+	return &timeWindow{
+		from: fromTime.Hour()*60 + fromTime.Minute(),
+		to:   toTime.Hour()*60 + toTime.Minute(),
+	}, nil
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	day = strings.TrimSpace(strings.ToLower(day))
+	if len(day) >= 3 {
+		for name, weekday := range weekdays {
+			if strings.HasPrefix(name, day) {
+				return weekday, nil
+			}
+		}
+	}
+	return time.Sunday, fmt.Errorf("%s is not a valid weekday", day)
+}
+
+func (r *rule) matches(event *pam.LoginEvent, groups func() []string) bool {
+	if len(r.users) > 0 && !r.users.matches(event.User) {
+		return false
+	}
+	if len(r.services) > 0 && !r.services.matches(event.Service) {
+		return false
+	}
+	if len(r.ttys) > 0 && !r.ttys.matches(event.TTY) {
+		return false
+	}
+	if len(r.hosts) > 0 && !matchHost(r.hosts, event.RemoteHost) {
+		return false
+	}
+	if r.window != nil && !r.window.contains(event.Time) {
+		return false
+	}
+	if r.weekdays != nil && !r.weekdays[event.Time.Weekday()] {
+		return false
+	}
+	if len(r.groups) > 0 && !r.groups.matches(groups()...) {
+		return false
+	}
+	return true
+}
+
+// matches tells if the list matches any of the values.
+// The list matches if no negated pattern matches any value and either
+// there are no non-negated patterns or at least one of them matches a value
+func (l list) matches(values ...string) bool {
+	hasPositive, positiveMatch := false, false
+	for _, pattern := range l {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if !negated {
+			hasPositive = true
+		}
+
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				if negated {
+					return false
+				}
+				positiveMatch = true
+			}
+		}
+	}
+	return !hasPositive || positiveMatch
+}
+
+// matchHost similar to list.matches but with host items
+func matchHost(items []hostItem, host string) bool {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(host)
+
+	hasPositive, positiveMatch := false, false
+	for _, item := range items {
+		if !item.negated {
+			hasPositive = true
+		}
+
+		var matched bool
+		if item.network != nil {
+			matched = ip != nil && item.network.Contains(ip)
+		} else if strings.HasPrefix(item.name, "*.") {
+			matched = strings.HasSuffix(host, item.name[1:])
+		} else {
+			matched = host != "" && host == item.name
+		}
+
+		if matched {
+			if item.negated {
+				return false
+			}
+			positiveMatch = true
+		}
+	}
+	return !hasPositive || positiveMatch
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.from <= minutes && minutes < w.to
+	}
+	return minutes >= w.from || minutes < w.to // window wraps midnight, e.g. 22:00 - 06:00
+}
+
+// lookupGroups returns the names and ids of the groups the given user belongs to
+func lookupGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(groupIds)*2)
+	for _, gid := range groupIds {
+		groups = append(groups, gid)
+		if group, err := user.LookupGroupId(gid); err == nil {
+			groups = append(groups, group.Name)
+		}
+	}
+	return groups, nil
+}
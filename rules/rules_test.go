@@ -0,0 +1,179 @@
+package rules
+
+import (
+	"login-monitor/config"
+	"login-monitor/pam"
+	"testing"
+	"time"
+)
+
+func newTestEngine(t *testing.T, c config.RulesConfig) *Engine {
+	engine, err := NewEngine(c)
+	if err != nil {
+		t.Fatal("Couldn't create engine", err)
+	}
+	return engine.SetGroupsFunc(func(username string) ([]string, error) {
+		groups := map[string][]string{
+			"root":  {"0", "root"},
+			"benja": {"1000", "benja", "10", "wheel"},
+		}
+		return groups[username], nil
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	// Wednesday
+	workingHours := time.Date(2022, time.April, 20, 10, 30, 0, 0, time.Local)
+	night := time.Date(2022, time.April, 20, 23, 30, 0, 0, time.Local)
+	// Saturday
+	weekend := time.Date(2022, time.April, 23, 10, 30, 0, 0, time.Local)
+
+	engine := newTestEngine(t, config.RulesConfig{
+		Default: "alert",
+		Rules: []config.RuleConfig{
+			{Name: "ci", Action: "ignore", Users: []string{"ci-*"}, Hosts: []string{"10.0.0.0/8"}},
+			{Name: "bastion", Action: "ignore", Hosts: []string{"192.168.1.10", "*.bastion.example.com"}, Services: []string{"sshd"}},
+			{Name: "root", Action: "alert", Users: []string{"root"}},
+			{
+				Name:     "developers",
+				Action:   "ignore",
+				Groups:   []string{"wheel"},
+				TTYs:     []string{"/dev/pts/*"},
+				From:     "09:00",
+				To:       "18:00",
+				Weekdays: []string{"mon", "tue", "wednesday", "thu", "fri"},
+			},
+			{Name: "not local network", Action: "alert", Hosts: []string{"!192.168.0.0/16"}},
+			{Name: "nights", Action: "ignore", From: "22:00", To: "06:00"},
+		},
+	})
+
+	tests := []struct {
+		name  string
+		event pam.LoginEvent
+		want  Decision
+	}{
+		{
+			"Testing glob and CIDR",
+			pam.LoginEvent{User: "ci-runner", RemoteHost: "10.1.2.3", Time: workingHours},
+			Decision{Action: Ignore, Severity: Info, Rule: "ci"},
+		},
+		{
+			"Testing CIDR doesn't match",
+			pam.LoginEvent{User: "ci-runner", RemoteHost: "192.168.2.3", Time: workingHours},
+			Decision{Action: Alert, Severity: Info, Rule: ""},
+		},
+		{
+			"Testing IP and service",
+			pam.LoginEvent{User: "root", RemoteHost: "192.168.1.10", Service: "sshd", Time: workingHours},
+			Decision{Action: Ignore, Severity: Info, Rule: "bastion"},
+		},
+		{
+			"Testing hostname wildcard",
+			pam.LoginEvent{User: "root", RemoteHost: "B1.Bastion.Example.com", Service: "sshd", Time: workingHours},
+			Decision{Action: Ignore, Severity: Info, Rule: "bastion"},
+		},
+		{
+			"Testing first match wins",
+			pam.LoginEvent{User: "root", RemoteHost: "192.168.1.11", Service: "sshd", Time: night},
+			Decision{Action: Alert, Severity: Info, Rule: "root"},
+		},
+		{
+			"Testing groups, tty, time window and weekday",
+			pam.LoginEvent{User: "benja", RemoteHost: "192.168.1.11", TTY: "/dev/pts/1", Time: workingHours},
+			Decision{Action: Ignore, Severity: Info, Rule: "developers"},
+		},
+		{
+			"Testing weekday doesn't match",
+			pam.LoginEvent{User: "benja", RemoteHost: "192.168.1.11", TTY: "/dev/pts/1", Time: weekend},
+			Decision{Action: Alert, Severity: Info, Rule: ""},
+		},
+		{
+			"Testing negated host",
+			pam.LoginEvent{User: "benja", RemoteHost: "8.8.8.8", TTY: "/dev/pts/1", Time: night},
+			Decision{Action: Alert, Severity: Info, Rule: "not local network"},
+		},
+		{
+			"Testing time window wrapping midnight",
+			pam.LoginEvent{User: "benja", RemoteHost: "192.168.1.11", TTY: "/dev/pts/1", Time: night},
+			Decision{Action: Ignore, Severity: Info, Rule: "nights"},
+		},
+		{
+			"Testing default action",
+			pam.LoginEvent{User: "benja", RemoteHost: "192.168.1.11", TTY: "tty1", Time: workingHours},
+			Decision{Action: Alert, Severity: Info, Rule: ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := engine.Evaluate(&tt.event); got != tt.want {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultAction(t *testing.T) {
+	engine := newTestEngine(t, config.RulesConfig{})
+	if got := engine.Evaluate(&pam.LoginEvent{User: "root"}); got.Action != Alert {
+		t.Errorf("Default action should be %s, got %s", Alert, got.Action)
+	}
+
+	engine = newTestEngine(t, config.RulesConfig{Default: "ignore"})
+	if got := engine.Evaluate(&pam.LoginEvent{User: "root"}); got.Action != Ignore {
+		t.Errorf("Default action should be %s, got %s", Ignore, got.Action)
+	}
+}
+
+func TestNewEngineInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.RulesConfig
+	}{
+		{"Testing invalid default action", config.RulesConfig{Default: "deny"}},
+		{"Testing missing action", config.RulesConfig{Rules: []config.RuleConfig{{Users: []string{"root"}}}}},
+		{"Testing invalid pattern", config.RulesConfig{Rules: []config.RuleConfig{{Action: "alert", Users: []string{"[root"}}}}},
+		{"Testing invalid time", config.RulesConfig{Rules: []config.RuleConfig{{Action: "alert", From: "9am", To: "18:00"}}}},
+		{"Testing incomplete time window", config.RulesConfig{Rules: []config.RuleConfig{{Action: "alert", From: "09:00"}}}},
+		{"Testing invalid weekday", config.RulesConfig{Rules: []config.RuleConfig{{Action: "alert", Weekdays: []string{"mo"}}}}},
+		{"Testing invalid severity", config.RulesConfig{Rules: []config.RuleConfig{{Action: "alert", Severity: "high"}}}},
+		{"Testing invalid default severity", config.RulesConfig{DefaultSeverity: "low"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEngine(tt.config); err == nil {
+				t.Error("NewEngine() should return an error")
+			}
+		})
+	}
+}
+
+func TestEvaluateSeverity(t *testing.T) {
+	engine := newTestEngine(t, config.RulesConfig{
+		DefaultSeverity: "warning",
+		Rules: []config.RuleConfig{
+			{Name: "root from unknown network", Action: "alert", Severity: "critical", Users: []string{"root"}, Hosts: []string{"!10.0.0.0/8"}},
+			{Name: "developers", Action: "alert", Severity: "info", Groups: []string{"wheel"}},
+			{Name: "root", Action: "alert", Users: []string{"root"}},
+		},
+	})
+
+	tests := []struct {
+		name  string
+		event pam.LoginEvent
+		want  string
+	}{
+		{"Testing rule severity", pam.LoginEvent{User: "root", RemoteHost: "8.8.8.8"}, Critical},
+		{"Testing severity with groups", pam.LoginEvent{User: "benja", RemoteHost: "8.8.8.8"}, Info},
+		{"Testing rule without severity", pam.LoginEvent{User: "root", RemoteHost: "10.0.0.1"}, Warning},
+		{"Testing no rule matches", pam.LoginEvent{User: "nobody"}, Warning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := engine.Evaluate(&tt.event); got.Severity != tt.want {
+				t.Errorf("Evaluate() severity = %s, want %s", got.Severity, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package smime
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.mozilla.org/pkcs7"
+	"os"
+	"time"
+)
+
+// MICAlg micalg parameter of multipart/signed S/MIME messages. Messages are always signed with SHA-256
+const MICAlg = "sha-256"
+
+func init() {
+	// the default (DES-CBC) is insecure. AES-CBC is supported by every major client (AES-GCM isn't, e.g. Outlook)
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// ReadCertificate reads the first PEM-encoded X.509 certificate in the given file
+func ReadCertificate(path string) (*x509.Certificate, error) {
+	block, err := readPEM(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate %s: %w", path, err)
+	}
+	return cert, nil
+}
+
+// ReadPrivateKey reads the first PEM-encoded (unencrypted) private key in the given file.
+// PKCS #1, PKCS #8 and SEC 1 (EC) keys are supported
+func ReadPrivateKey(path string) (crypto.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// readPEM returns the first PEM block in the given file with any of the given types
+func readPEM(path string, types ...string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PEM file: %w", err)
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s doesn't contain a PEM block of type %v", path, types)
+		}
+		for _, t := range types {
+			if block.Type == t {
+				return block, nil
+			}
+		}
+	}
+}
+
+// Check returns an error if the certificate can't be used at the given time, i.e. it is not valid yet, it is expired,
+// or its key usage doesn't allow encryption (if encrypt is true) or signing (if encrypt is false)
+func Check(cert *x509.Certificate, encrypt bool, now time.Time) error {
+	subject := cert.Subject.String()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate %s is not valid until %s", subject, cert.NotBefore.Format(time.RFC1123Z))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", subject, cert.NotAfter.Format(time.RFC1123Z))
+	}
+
+	if cert.KeyUsage == 0 { // no key usage extension, any usage is allowed
+		return nil
+	}
+	if encrypt && cert.KeyUsage&x509.KeyUsageKeyEncipherment == 0 {
+		return fmt.Errorf("certificate %s can't be used to encrypt", subject)
+	}
+	if !encrypt && cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("certificate %s can't be used to sign", subject)
+	}
+	return nil
+}
+
+// Encrypt encrypts data for the given recipients (RSA certificates only).
+// Returns the DER-encoded enveloped data (application/pkcs7-mime; smime-type=enveloped-data)
+func Encrypt(data []byte, recipients ...*x509.Certificate) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients to encrypt S/MIME message for")
+	}
+	encrypted, err := pkcs7.Encrypt(data, recipients)
+	if err != nil {
+		return nil, fmt.Errorf("error while encrypting S/MIME message. %w", err)
+	}
+	return encrypted, nil
+}
+
+// Sign creates a detached SHA-256 signature of data with the given certificate and private key.
+// Returns the DER-encoded signed data (application/pkcs7-signature)
+func Sign(data []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(data)
+	if err != nil {
+		return nil, fmt.Errorf("error while signing S/MIME message. %w", err)
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err = signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("error while signing S/MIME message. %w", err)
+	}
+	signedData.Detach()
+
+	signature, err := signedData.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("error while signing S/MIME message. %w", err)
+	}
+	return signature, nil
+}
@@ -0,0 +1,175 @@
+package smime
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate generates a self-signed RSA certificate for the given email (valid until notAfter) and
+// writes it and its (PKCS #8) private key to dir. Returns the paths of the certificate and the private key
+func writeCertificate(t *testing.T, dir, email string, notAfter time.Time) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate key", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Couldn't create certificate", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, email+".crt"), filepath.Join(dir, email+".key")
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestEncryptSign(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "recipient@example.com", time.Now().Add(time.Hour))
+	cert, err := ReadCertificate(certPath)
+	if err != nil {
+		t.Fatal("Couldn't read certificate", err)
+	}
+	key, err := ReadPrivateKey(keyPath)
+	if err != nil {
+		t.Fatal("Couldn't read private key", err)
+	}
+	data := []byte("Content-Type: text/plain\r\n\r\nHello\r\n")
+
+	t.Run("Testing encryption", func(t *testing.T) {
+		encrypted, err := Encrypt(data, cert)
+		if err != nil {
+			t.Fatal("Couldn't encrypt", err)
+		}
+		p7, err := pkcs7.Parse(encrypted)
+		if err != nil {
+			t.Fatal("Couldn't parse enveloped data", err)
+		}
+		decrypted, err := p7.Decrypt(cert, key)
+		if err != nil {
+			t.Fatal("Couldn't decrypt", err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("Decrypted data is %q, expected %q", decrypted, data)
+		}
+	})
+
+	t.Run("Testing detached signature", func(t *testing.T) {
+		signature, err := Sign(data, cert, key)
+		if err != nil {
+			t.Fatal("Couldn't sign", err)
+		}
+		p7, err := pkcs7.Parse(signature)
+		if err != nil {
+			t.Fatal("Couldn't parse signed data", err)
+		}
+		if len(p7.Content) != 0 {
+			t.Error("Signature is not detached")
+		}
+		p7.Content = data
+		if err = p7.Verify(); err != nil {
+			t.Error("Signature is not valid", err)
+		}
+		p7.Content = []byte("tampered")
+		if err = p7.Verify(); err == nil {
+			t.Error("Signature of tampered data is valid")
+		}
+	})
+
+	t.Run("Testing no recipients", func(t *testing.T) {
+		if _, err := Encrypt(data); err == nil {
+			t.Error("Encrypting without recipients should fail")
+		}
+	})
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDer, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"Testing PKCS #1 key", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), false},
+		{"Testing EC key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer}), false},
+		{"Testing key after other blocks", append([]byte("garbage\n"+string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}))), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer})...), false},
+		{"Testing invalid key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1, 2, 3}}), true},
+		{"Testing no key", []byte("no key here"), true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(path, tt.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadPrivateKey(path); (err != nil) != tt.wantErr {
+				t.Errorf("ReadPrivateKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		encrypt  bool
+		expected bool // true if the certificate can be used
+	}{
+		{"Testing valid certificate", &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}, true, true},
+		{"Testing expired certificate", &x509.Certificate{NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)}, true, false},
+		{"Testing certificate not valid yet", &x509.Certificate{NotBefore: now.Add(time.Hour), NotAfter: now.Add(2 * time.Hour)}, false, false},
+		{"Testing encryption certificate", &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), KeyUsage: x509.KeyUsageKeyEncipherment}, true, true},
+		{"Testing signing with encryption certificate", &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), KeyUsage: x509.KeyUsageKeyEncipherment}, false, false},
+		{"Testing signing certificate", &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), KeyUsage: x509.KeyUsageDigitalSignature}, false, true},
+		{"Testing encryption with signing certificate", &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), KeyUsage: x509.KeyUsageDigitalSignature}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(tt.cert, tt.encrypt, now); (err == nil) != tt.expected {
+				t.Errorf("Check() = %v, expected usable = %v", err, tt.expected)
+			}
+		})
+	}
+}
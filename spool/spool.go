@@ -0,0 +1,236 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"login-monitor/pam"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDir default directory for the spool
+const DefaultDir = "/var/spool/login-monitor"
+
+const (
+	entryExt = ".json"
+	lockFile = ".lock"
+)
+
+// InitialBackoff and MaxBackoff bounds of the delay between delivery attempts (see Backoff)
+var (
+	InitialBackoff = time.Minute
+	MaxBackoff     = 6 * time.Hour
+)
+
+// Entry a payload waiting to be delivered or a login event waiting to be handled
+type Entry struct {
+	ID          string          `json:"id"`
+	Channel     string          `json:"channel,omitempty"` // name of the channel the payload is delivered through
+	Sender      string          `json:"sender,omitempty"`
+	To          []string        `json:"to,omitempty"`  // envelope recipients in the To and Cc headers
+	Bcc         []string        `json:"bcc,omitempty"` // envelope recipients that are not in the headers
+	Payload     []byte          `json:"payload,omitempty"`
+	Event       *pam.LoginEvent `json:"event,omitempty"` // login event that couldn't be handed to the daemon (Payload is empty)
+	Attempts    int             `json:"attempts"`        // number of failed delivery attempts
+	CreatedAt   time.Time       `json:"createdAt"`       // time the entry was spooled
+	NextAttempt time.Time       `json:"nextAttempt"`     // entry won't be flushed before this time
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// Spool on-disk queue of payloads. Each entry is stored in its own file, written atomically
+type Spool struct {
+	dir string
+}
+
+// New creates a new spool in the given directory. The directory is created (with 0700 permissions) if it doesn't exist
+func New(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create spool directory %s: %w", dir, err)
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Put writes the entry to the spool, replacing any previous version of it.
+// If the entry has no ID, a new one is assigned.
+//
+// The entry is written to a temporary file which is then renamed, so readers never see a partially written entry
+func (s *Spool) Put(entry *Entry) error {
+	if entry.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-"+entry.ID+"-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create spool file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op if rename succeeded
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write spool file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), s.path(entry.ID)); err != nil {
+		return fmt.Errorf("couldn't write spool file: %w", err)
+	}
+	return nil
+}
+
+// Remove removes the entry with the given ID from the spool
+func (s *Spool) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns all the entries in the spool sorted by creation time.
+// Entries that can't be read are logged and skipped
+func (s *Spool) List() ([]*Entry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), entryExt) || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			log.Warnf("Couldn't read spool entry %s. %s", file.Name(), err)
+			continue
+		}
+		entry := &Entry{}
+		if err = json.Unmarshal(data, entry); err != nil {
+			log.Warnf("Couldn't parse spool entry %s. %s", file.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+// Fail records a failed delivery attempt for the entry and schedules the next attempt (see Backoff)
+func (s *Spool) Fail(entry *Entry, err error) error {
+	entry.Attempts++
+	entry.LastError = err.Error()
+	entry.NextAttempt = time.Now().Add(Backoff(entry.Attempts))
+	return s.Put(entry)
+}
+
+// Flush tries to deliver all the due entries (i.e. entries whose next attempt is not in the future) with send.
+// Delivered entries are removed from the spool. Failed entries are rescheduled (see Spool.Fail).
+//
+// Only one flush can run at a time, concurrent calls (even from other processes) wait for the running one.
+// Returns the number of delivered entries and the number of entries remaining in the spool
+func (s *Spool) Flush(send func(entry *Entry) error) (int, int, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	entries, err := s.List()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delivered := 0
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+
+		log.Debugf("Delivering spool entry %s (channel '%s', attempt %d)", entry.ID, entry.Channel, entry.Attempts+1)
+		if sendErr := send(entry); sendErr != nil {
+			log.Warnf("Couldn't deliver spool entry %s. %s", entry.ID, sendErr)
+			if err := s.Fail(entry, sendErr); err != nil {
+				return delivered, len(entries) - delivered, err
+			}
+			continue
+		}
+
+		if err := s.Remove(entry.ID); err != nil {
+			return delivered, len(entries) - delivered, err
+		}
+		delivered++
+	}
+
+	return delivered, len(entries) - delivered, nil
+}
+
+// Backoff returns the delay before the next delivery attempt after the given number of failed attempts.
+// The delay grows exponentially from InitialBackoff up to MaxBackoff
+func Backoff(attempts int) time.Duration {
+	delay := InitialBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= MaxBackoff {
+			return MaxBackoff
+		}
+	}
+	return delay
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.dir, id+entryExt)
+}
+
+// lock acquires an exclusive lock on the spool. The returned function releases the lock
+func (s *Spool) lock() (func(), error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open spool lock: %w", err)
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("couldn't lock spool: %w", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
+
+// newID returns a new ID, sortable by time
+func newID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
@@ -0,0 +1,115 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutListRemove(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal("Couldn't create spool", err)
+	}
+
+	first := &Entry{Channel: "go-smtp", Sender: "sender@example.com", Payload: []byte("first")}
+	second := &Entry{Channel: "gmail-oauth2", Sender: "sender@example.com", Payload: []byte("second")}
+	for _, entry := range []*Entry{first, second} {
+		if err := s.Put(entry); err != nil {
+			t.Fatal("Couldn't put entry", err)
+		}
+		if entry.ID == "" {
+			t.Fatal("Entry ID should be assigned")
+		}
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatal("Couldn't list entries", err)
+	}
+	if len(entries) != 2 || string(entries[0].Payload) != "first" || string(entries[1].Payload) != "second" {
+		t.Fatalf("Expected first and second entries, got %+v", entries)
+	}
+
+	if err := s.Remove(first.ID); err != nil {
+		t.Fatal("Couldn't remove entry", err)
+	}
+	if err := s.Remove(first.ID); err != nil {
+		t.Error("Removing a removed entry shouldn't fail", err)
+	}
+	if entries, _ = s.List(); len(entries) != 1 || entries[0].ID != second.ID {
+		t.Errorf("Expected only second entry, got %+v", entries)
+	}
+
+	// no temporary files should be left behind
+	files, _ := os.ReadDir(s.dir)
+	for _, file := range files {
+		if file.Name() != second.ID+entryExt {
+			t.Errorf("Unexpected file in spool: %s", file.Name())
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal("Couldn't create spool", err)
+	}
+
+	ok := &Entry{Payload: []byte("ok")}
+	failing := &Entry{Payload: []byte("failing")}
+	notDue := &Entry{Payload: []byte("not due"), NextAttempt: time.Now().Add(time.Hour)}
+	for _, entry := range []*Entry{ok, failing, notDue} {
+		if err := s.Put(entry); err != nil {
+			t.Fatal("Couldn't put entry", err)
+		}
+	}
+
+	var sent []string
+	delivered, remaining, err := s.Flush(func(entry *Entry) error {
+		sent = append(sent, string(entry.Payload))
+		if entry.ID == failing.ID {
+			return errors.New("relay unreachable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Couldn't flush", err)
+	}
+	if delivered != 1 || remaining != 2 {
+		t.Errorf("Flush() = %d delivered, %d remaining, want 1, 2", delivered, remaining)
+	}
+	if len(sent) != 2 || sent[0] != "ok" || sent[1] != "failing" {
+		t.Errorf("Expected ok and failing entries to be sent, got %v", sent)
+	}
+
+	entries, _ := s.List()
+	for _, entry := range entries {
+		if entry.ID == failing.ID {
+			if entry.Attempts != 1 || entry.LastError != "relay unreachable" || !entry.NextAttempt.After(time.Now()) {
+				t.Errorf("Failed entry was not rescheduled. Got %+v", entry)
+			}
+		} else if entry.ID != notDue.ID {
+			t.Errorf("Unexpected entry %+v", entry)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, InitialBackoff},
+		{2, 2 * InitialBackoff},
+		{4, 8 * InitialBackoff},
+		{100, MaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}